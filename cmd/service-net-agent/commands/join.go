@@ -43,6 +43,8 @@ func init() {
 	joinCmd.MarkFlagRequired("token")
 
 	joinCmd.Flags().StringToStringVar(&joiner.Labels, "label", nil, "Asset labels")
+	joinCmd.Flags().BoolVar(&joiner.ClientCert, "client-cert", false, "Authenticate with a client certificate signed by Edge Controller (needs an Edge Controller that supports signing)")
+	joinCmd.Flags().BoolVar(&joiner.PinServer, "pin", true, "Pin Edge Controller public keys on join, unless pins are specified")
 
 	rootCmd.AddCommand(joinCmd)
 }
@@ -66,6 +66,12 @@ func init() {
 	rootCmd.PersistentFlags().String("address", "", "Edge Controller address")
 	rootConfig.BindPFlag("controller.address", rootCmd.PersistentFlags().Lookup("address"))
 
+	rootCmd.PersistentFlags().StringSlice("fallback-address", nil, "Edge Controller addresses to fail over to, in order of preference")
+	rootConfig.BindPFlag("controller.fallback_addresses", rootCmd.PersistentFlags().Lookup("fallback-address"))
+
+	rootCmd.PersistentFlags().String("srv", "", "DNS SRV name resolving to Edge Controller addresses")
+	rootConfig.BindPFlag("controller.srv", rootCmd.PersistentFlags().Lookup("srv"))
+
 	rootCmd.PersistentFlags().Bool("tls", true, "Use TLS to connect to Edge Controller")
 	rootConfig.BindPFlag("controller.tls", rootCmd.PersistentFlags().Lookup("tls"))
 
@@ -75,6 +81,25 @@ func init() {
 	rootCmd.PersistentFlags().String("cert", "", "File with certificate to use to connect to Edge Controller")
 	rootConfig.BindPFlag("controller.cert", rootCmd.PersistentFlags().Lookup("cert"))
 
+	rootCmd.PersistentFlags().String("server-name", "", "Name to verify Edge Controller certificate against, if different from address")
+	rootConfig.BindPFlag("controller.server_name", rootCmd.PersistentFlags().Lookup("server-name"))
+
+	rootCmd.PersistentFlags().StringSlice("server-pin", nil, "Edge Controller public key pins (sha256/<base64>); certificate chain has to match one")
+	rootConfig.BindPFlag("controller.pins", rootCmd.PersistentFlags().Lookup("server-pin"))
+
+	rootCmd.PersistentFlags().String("proxy", "", "Connect to Edge Controller through HTTP CONNECT or SOCKS5 proxy (e.g., socks5://proxy:1080)")
+	rootConfig.BindPFlag("controller.proxy.url", rootCmd.PersistentFlags().Lookup("proxy"))
+
+	rootCmd.PersistentFlags().String("proxy-user", "", "Proxy username")
+	rootConfig.BindPFlag("controller.proxy.username", rootCmd.PersistentFlags().Lookup("proxy-user"))
+
+	rootCmd.PersistentFlags().String("proxy-password-file", "", "File with proxy password; otherwise taken from $"+defaults.ProxyPasswordEnv)
+	rootConfig.BindPFlag("controller.proxy.password_file", rootCmd.PersistentFlags().Lookup("proxy-password-file"))
+	rootCmd.MarkPersistentFlagFilename("proxy-password-file")
+
+	rootCmd.PersistentFlags().StringSlice("no-proxy", nil, "Hosts, domains and networks to connect to without proxy")
+	rootConfig.BindPFlag("controller.proxy.no_proxy", rootCmd.PersistentFlags().Lookup("no-proxy"))
+
 	rootCmd.PersistentFlags().BoolVar(&logToFile, "log", false, "Output to log file")
 	rootCmd.PersistentFlags().StringVar(&logFile, "logfile", filepath.Join(rootConfig.Path, defaults.LogFile), "File to write log to if --log is set")
 	rootCmd.MarkPersistentFlagFilename("logfile")
@@ -116,6 +141,10 @@ func setup(cmd *cobra.Command) {
 		rootConfig.ConfigFile = filepath.Join(rootConfig.Path, defaults.ConfigFile)
 	}
 
+	// Secrets in the configuration file are encrypted with a key that
+	// only exists on this machine
+	rootConfig.Secrets = config.NewSecretStore(filepath.Join(rootConfig.Path, defaults.SecretKey))
+
 	// Handle configuration
 	err = rootConfig.Read()
 	if err != nil {
@@ -51,10 +51,51 @@ func init() {
 	runCmd.Flags().Duration("interval", time.Second*time.Duration(defaults.AgentHeartbeatInterval), "Heartbeat interval")
 	rootConfig.BindPFlag("agent.interval", runCmd.Flags().Lookup("interval"))
 
+	runCmd.Flags().Bool("stream", false, "Receive operations on a stream from Edge Controller instead of only with heartbeats (needs an Edge Controller that supports streaming)")
+	rootConfig.BindPFlag("controller.stream", runCmd.Flags().Lookup("stream"))
+
 	// No command-line options, but can be specified in config file
+	rootConfig.SetDefault("agent.min_interval", (time.Second * time.Duration(defaults.AgentMinInterval)).String())
+	rootConfig.SetDefault("agent.max_interval", (time.Second * time.Duration(defaults.AgentMaxInterval)).String())
+	rootConfig.SetDefault("agent.interval_jitter", defaults.AgentIntervalJitter)
 	rootConfig.SetDefault("agent.comm_timeout", (time.Second * time.Duration(defaults.AgentCommTimeout)).String())
 	rootConfig.SetDefault("agent.shutdown_timeout", (time.Second * time.Duration(defaults.AgentShutdownTimeout)).String())
 	rootConfig.SetDefault("agent.opqueue_len", defaults.AgentOpQueueLen)
+	rootConfig.SetDefault("agent.lanes.control.queue_len", defaults.AgentControlQueueLen)
+	rootConfig.SetDefault("agent.lanes.high.queue_len", defaults.AgentHighQueueLen)
+	rootConfig.SetDefault("agent.lanes.low.queue_len", defaults.AgentLowQueueLen)
+	rootConfig.SetDefault("agent.max_concurrent_ops", defaults.AgentMaxConcurrentOps)
+	rootConfig.SetDefault("agent.retry.initial_interval", (time.Second * time.Duration(defaults.AgentRetryInitialInterval)).String())
+	rootConfig.SetDefault("agent.retry.max_interval", (time.Second * time.Duration(defaults.AgentRetryMaxInterval)).String())
+	rootConfig.SetDefault("agent.retry.multiplier", defaults.AgentRetryMultiplier)
+	rootConfig.SetDefault("agent.retry.jitter", defaults.AgentRetryJitter)
+	rootConfig.SetDefault("agent.retry.max_age", (time.Second * time.Duration(defaults.AgentRetryMaxAge)).String())
+	rootConfig.SetDefault("agent.retry.buffer_len", defaults.AgentRetryBufferLen)
+	rootConfig.SetDefault("agent.dedup.ttl", (time.Second * time.Duration(defaults.AgentDedupTTL)).String())
+	rootConfig.SetDefault("agent.dedup.max_entries", defaults.AgentDedupMaxEntries)
+	rootConfig.SetDefault("agent.spool.max_size", defaults.AgentSpoolMaxSize)
+	rootConfig.SetDefault("agent.spool.replay_limit", defaults.AgentSpoolReplayLimit)
+	rootConfig.SetDefault("controller.keepalive_time", (time.Second * time.Duration(defaults.ControllerKeepaliveTime)).String())
+	rootConfig.SetDefault("controller.keepalive_timeout", (time.Second * time.Duration(defaults.ControllerKeepaliveTimeout)).String())
+	rootConfig.SetDefault("controller.failure_threshold", defaults.ControllerFailureThreshold)
+	rootConfig.SetDefault("controller.redial_interval", (time.Second * time.Duration(defaults.ControllerRedialInterval)).String())
+	rootConfig.SetDefault("controller.max_redial_interval", (time.Second * time.Duration(defaults.ControllerMaxRedialInterval)).String())
+	rootConfig.SetDefault("controller.probe_interval", (time.Second * time.Duration(defaults.ControllerProbeInterval)).String())
+	rootConfig.SetDefault("controller.cert_check_interval", (time.Second * time.Duration(defaults.ControllerCertCheckInterval)).String())
+	rootConfig.SetDefault("agent.auth.max_failures", defaults.AgentAuthMaxFailures)
+	rootConfig.SetDefault("agent.auth.max_interval", (time.Second * time.Duration(defaults.AgentAuthMaxInterval)).String())
+	rootConfig.SetDefault("agent.budget.limit", 0)
+	rootConfig.SetDefault("agent.budget.period", defaults.AgentBudgetPeriod)
+	rootConfig.SetDefault("agent.budget.reduce_at", defaults.AgentBudgetReduceAt)
+	rootConfig.SetDefault("agent.budget.stretch_at", defaults.AgentBudgetStretchAt)
+	rootConfig.SetDefault("agent.budget.max_interval", (time.Second * time.Duration(defaults.AgentBudgetMaxInterval)).String())
+	rootConfig.SetDefault("agent.budget.write_interval", (time.Second * time.Duration(defaults.AgentBudgetWriteInterval)).String())
+	rootConfig.SetDefault("agent.status.enabled", true)
+	rootConfig.SetDefault("agent.health.failing_after", defaults.AgentPluginFailingAfter)
+	rootConfig.SetDefault("agent.health.critical", []string{})
+	rootConfig.SetDefault("agent.stream.reconnect_interval", (time.Second * time.Duration(defaults.AgentStreamReconnectInterval)).String())
+	rootConfig.SetDefault("agent.stream.max_reconnect_interval", (time.Second * time.Duration(defaults.AgentStreamMaxReconnectInterval)).String())
+	rootConfig.SetDefault("agent.watch_config", true)
 
 	rootCmd.AddCommand(runCmd)
 }
@@ -21,11 +21,14 @@ package join
 
 import (
 	"fmt"
+	"path/filepath"
+
 	"github.com/nalej/grpc-utils/pkg/conversions"
 
 	"github.com/nalej/derrors"
 
 	"github.com/nalej/grpc-edge-controller-go"
+	"github.com/nalej/grpc-inventory-manager-go"
 
 	"github.com/nalej/service-net-agent/internal/pkg/client"
 	"github.com/nalej/service-net-agent/internal/pkg/config"
@@ -41,15 +44,26 @@ type Joiner struct {
 
 	Token  string
 	Labels map[string]string
+
+	// Authenticate with a client certificate signed by the Edge
+	// Controller, in addition to the agent token
+	ClientCert bool
+
+	// Pin the public keys the Edge Controller presents when joining,
+	// unless pins are configured already
+	PinServer bool
 }
 
 func (j *Joiner) Validate() derrors.Error {
-	if j.Config.GetString("controller.address") == "" {
-		return derrors.NewInvalidArgumentError("address must be specified")
+	if j.Config.GetString("controller.address") == "" && j.Config.GetString("controller.srv") == "" {
+		return derrors.NewInvalidArgumentError("address or srv name must be specified")
 	}
 	if j.Token == "" {
 		return derrors.NewInvalidArgumentError("token must be specified")
 	}
+	if j.ClientCert && !j.Config.GetBool("controller.tls") {
+		return derrors.NewInvalidArgumentError("client certificate requires TLS")
+	}
 
 	return nil
 }
@@ -69,12 +83,22 @@ func (j *Joiner) Run() derrors.Error {
 	}
 	defer client.Close()
 
-	// Send request and get agent token
-	response, err := client.AgentJoin(client.GetContext(), request)
+	// Send request and get agent token, trying each endpoint until one
+	// answers
+	var response *grpc_inventory_manager_go.AgentJoinResponse
+	var err error
+	for range client.Endpoints() {
+		response, err = client.AgentJoin(client.GetContext(), request)
+		if err == nil {
+			break
+		}
+		log.Warn().Str("address", client.Address()).Str("trace", conversions.ToDerror(err).DebugReport()).Msg("unable to join")
+		client.Failover()
+	}
 	if err != nil {
-		log.Warn().Str("trace", conversions.ToDerror(err).DebugReport()).Msg("unable to join")
 		return derrors.NewUnavailableError("unable to send join request", err)
 	}
+	log.Info().Str("address", client.Address()).Msg("joined edge controller")
 
 	// Check and store join response (token and asset id)
 	token := response.GetToken()
@@ -89,6 +113,19 @@ func (j *Joiner) Run() derrors.Error {
 	j.Config.Set("agent.token", token)
 	j.Config.Set("agent.asset_id", assetId)
 
+	if j.PinServer {
+		j.pinServer(client)
+	}
+
+	if j.ClientCert {
+		// Stay with the endpoint we joined
+		client.SetToken(token)
+		derr = j.requestCertificate(client, assetId)
+		if derr != nil {
+			return derr
+		}
+	}
+
 	// Write config
 	derr = j.Config.Write()
 	if derr != nil {
@@ -98,6 +135,43 @@ func (j *Joiner) Run() derrors.Error {
 	return nil
 }
 
+// Trust the Edge Controller we just joined on first use, by requiring its
+// public keys for every later connection. If its certificate was verified,
+// we pin the CA, so endpoints to fail over to need certificates from the
+// same CA. With an insecure connection, we can only pin the keys of the
+// endpoint we joined, so all endpoints have to present the same keys.
+func (j *Joiner) pinServer(agentClient *client.AgentClient) {
+	if !j.Config.GetBool("controller.tls") || len(j.Config.GetStringSlice("controller.pins")) > 0 {
+		return
+	}
+
+	pins := agentClient.ServerPins()
+	if len(pins) == 0 {
+		log.Warn().Msg("no edge controller public keys to pin")
+		return
+	}
+
+	log.Info().Strs("pins", pins).Msg("pinning edge controller public keys")
+	j.Config.Set("controller.pins", pins)
+}
+
+// Get a client certificate for the asset, using the agent token we just
+// received to authenticate
+func (j *Joiner) requestCertificate(agentClient *client.AgentClient, assetId string) derrors.Error {
+	certFile := filepath.Join(j.Config.Path, defaults.ClientCert)
+	cert := client.NewClientCertificate(certFile)
+
+	derr := agentClient.RequestCertificate(assetId, cert)
+	if derr != nil {
+		return derr
+	}
+	log.Info().Str("file", certFile).Time("expires", cert.NotAfter()).Msg("stored client certificate")
+
+	j.Config.Set("controller.client_cert", certFile)
+
+	return nil
+}
+
 func (j *Joiner) getRequest() (*grpc_edge_controller_go.AgentJoinRequest, derrors.Error) {
 	// Gather inventory
 	inv, derr := inventory.NewInventory()
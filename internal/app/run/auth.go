@@ -0,0 +1,79 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Recognizing a revoked agent token
+
+import (
+	"time"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
+	"github.com/nalej/service-net-agent/internal/pkg/client"
+)
+
+// Keeps track of whether the Edge Controller keeps rejecting our token. If
+// it does, the token was revoked and the agent needs to be joined again;
+// there's no point in executing operations or sending heartbeats at the
+// normal rate until then. We keep sending heartbeats with increasing
+// delays, in case the Edge Controller accepts the token again.
+type authMonitor struct {
+	client *client.AgentClient
+	// Consecutive rejections after which we need to be joined again;
+	// never if zero
+	maxFailures int
+	// Delay between heartbeats while we need to be joined again
+	policy backoff.Policy
+
+	// Set while we need to be joined again
+	delay *backoff.Backoff
+}
+
+func newAuthMonitor(agentClient *client.AgentClient, maxFailures int, policy backoff.Policy) *authMonitor {
+	return &authMonitor{
+		client:      agentClient,
+		maxFailures: maxFailures,
+		policy:      policy,
+	}
+}
+
+// Update after a heartbeat; returns true if we started or stopped
+// needing to be joined again.
+func (a *authMonitor) Update(beatSent bool) bool {
+	if a.NeedsRejoin() {
+		if !beatSent {
+			return false
+		}
+		a.delay = nil
+		return true
+	}
+
+	if a.maxFailures <= 0 || a.client.AuthFailures() < a.maxFailures {
+		return false
+	}
+	a.delay = backoff.NewBackoff(a.policy)
+	return true
+}
+
+func (a *authMonitor) NeedsRejoin() bool {
+	return a.delay != nil
+}
+
+// Delay until the next heartbeat while we need to be joined again
+func (a *authMonitor) Next() time.Duration {
+	return a.delay.Next()
+}
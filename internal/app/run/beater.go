@@ -26,17 +26,40 @@ import (
 	"github.com/nalej/derrors"
 
 	"github.com/nalej/grpc-edge-controller-go"
+	"github.com/nalej/grpc-inventory-manager-go"
 
 	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
 	"github.com/nalej/service-net-agent/internal/pkg/client"
+	"github.com/nalej/service-net-agent/internal/pkg/spool"
+
+	"github.com/golang/protobuf/proto"
 
 	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type Beater struct {
 	client     *client.AgentClient
 	dispatcher *Dispatcher
 	assetId    string
+
+	// Heartbeats with plugin data that failed to be sent; can be nil
+	spool *spool.Spool
+	// Maximum number of spooled heartbeats to send along with each
+	// heartbeat, so we don't flood the Edge Controller when we're back
+	// online; no maximum if zero
+	replayLimit int
+
+	// Plugin health, reported to the Edge Controller; can be nil
+	health *healthTracker
+	// Agent status, reported to the Edge Controller; can be nil
+	status *agentStatus
+	// Bandwidth budget, reported to the Edge Controller; can be nil
+	budget *budget
+	// Heartbeat interval, which the Edge Controller can change; can be nil
+	interval *heartbeatInterval
 }
 
 func (b *Beater) Beat(timeout time.Duration) (bool, derrors.Error) {
@@ -48,11 +71,31 @@ func (b *Beater) Beat(timeout time.Duration) (bool, derrors.Error) {
 	defer cancel()
 	beatData, beatErrs := agentplugin.CollectHeartbeatData(beatCtx)
 
+	// Save bytes if we're running out of budget
+	b.budget.Update(time.Now())
+	beatData = b.budget.Filter(beatData)
+
 	// Warn about errors
-	// TODO: Decide if we're not alive anymore due to errors
 	for name, derr := range beatErrs {
 		log.Warn().Err(derr).Str("plugin", name.String()).Msg("plugin error")
 		log.Debug().Str("trace", derr.DebugReport()).Str("plugin", name.String()).Msg("plugin error trace")
+		b.status.SetError(errorClassPlugin, derr)
+	}
+
+	// Persistent errors make plugins unhealthy, which we report to the
+	// Edge Controller and which can make us not alive anymore
+	b.health.Update(beatErrs)
+	healthData := b.health.HeartbeatData(runningPlugins())
+	if healthData != nil {
+		beatData = append(beatData, healthData)
+	}
+	statusData := b.status.HeartbeatData()
+	if statusData != nil {
+		beatData = append(beatData, statusData)
+	}
+	budgetData := b.budget.HeartbeatData()
+	if budgetData != nil {
+		beatData = append(beatData, budgetData)
 	}
 
 	// Create default heartbeat message
@@ -62,33 +105,140 @@ func (b *Beater) Beat(timeout time.Duration) (bool, derrors.Error) {
 		PluginData: beatData.ToGRPC(),
 	}
 
+	// Don't bother while the connection is down; we'll send it later
+	if !b.client.Available() {
+		log.Debug().Str("breaker", b.client.BreakerState().String()).Msg("edge controller connection down, not sending heartbeat")
+		b.store(beatRequest)
+		return beatSent, nil
+	}
+
 	ctx := b.client.GetContext()
-	result, err := b.client.AgentCheck(ctx, beatRequest)
+	var header metadata.MD
+	result, err := b.client.AgentCheck(ctx, beatRequest, grpc.Header(&header))
 	if err != nil {
 		log.Warn().Err(err).Msg("failed sending heartbeat")
+		b.status.SetError(errorClassHeartbeat, err)
+		b.store(beatRequest)
 		return beatSent, nil
 	}
 	beatSent = true
 
-	operations := result.GetPendingRequests()
+	b.adjustInterval(header)
+
+	derr := b.dispatch(result)
+	if derr != nil {
+		return beatSent, derr
+	}
+
+	// We're online, catch up on what we couldn't send before
+	return beatSent, b.replay()
+}
+
+// Use the heartbeat interval the Edge Controller requested along with the
+// CheckResult, if any
+func (b *Beater) adjustInterval(header metadata.MD) {
+	if b.interval == nil {
+		return
+	}
+
+	requested, found := client.RequestedInterval(header)
+	if !found {
+		return
+	}
+
+	current := b.interval.Set(requested)
+	log.Debug().Str("requested", requested.String()).Str("interval", current.String()).Msg("edge controller requested heartbeat interval")
+}
+
+// Keep a heartbeat that failed to be sent, so we can send it later. Only
+// plugin data is worth keeping; an empty heartbeat is outdated right away.
+func (b *Beater) store(beatRequest *grpc_edge_controller_go.AgentCheckRequest) {
+	if b.spool == nil || len(beatRequest.GetPluginData()) == 0 {
+		return
+	}
+
+	data, err := proto.Marshal(beatRequest)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed encoding heartbeat for spool")
+		return
+	}
+
+	derr := b.spool.Push(data)
+	if derr != nil {
+		log.Warn().Err(derr).Msg("failed spooling heartbeat")
+		return
+	}
+	log.Debug().Int("spooled", b.spool.Len()).Msg("spooled heartbeat")
+}
+
+// Send spooled heartbeats, oldest first. We stop at the first failure and
+// try again with the next heartbeat. They are kept while we need to save
+// bytes.
+func (b *Beater) replay() derrors.Error {
+	if b.budget.Level() >= BudgetReduced {
+		return nil
+	}
+
+	for sent := 0; b.replayLimit <= 0 || sent < b.replayLimit; sent++ {
+		data, derr := b.spool.Peek()
+		if derr != nil {
+			log.Warn().Err(derr).Msg("failed reading spooled heartbeat")
+			return nil
+		}
+		if data == nil {
+			return nil
+		}
+
+		beatRequest := &grpc_edge_controller_go.AgentCheckRequest{}
+		err := proto.Unmarshal(data, beatRequest)
+		if err != nil {
+			// Not going to get better; skip it
+			log.Warn().Err(err).Msg("dropping corrupt spooled heartbeat")
+			b.spool.Pop()
+			continue
+		}
+
+		result, err := b.client.AgentCheck(b.client.GetContext(), beatRequest)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed sending spooled heartbeat")
+			return nil
+		}
+		b.spool.Pop()
+		log.Debug().Int("spooled", b.spool.Len()).Msg("sent spooled heartbeat")
+
+		derr = b.dispatch(result)
+		if derr != nil {
+			return derr
+		}
+	}
+
+	return nil
+}
+
+// Dispatch operations received from the Edge Controller
+func (b *Beater) dispatch(result *grpc_edge_controller_go.CheckResult) derrors.Error {
+	return dispatchOperations(b.dispatcher, b.assetId, result.GetPendingRequests())
+}
+
+func dispatchOperations(dispatcher *Dispatcher, assetId string, operations []*grpc_inventory_manager_go.AgentOpRequest) derrors.Error {
 	for _, operation := range operations {
 		// Check asset id
-		if operation.GetAssetId() != b.assetId {
+		if operation.GetAssetId() != assetId {
 			log.Warn().Str("operation_id", operation.GetOperationId()).
 				Str("asset_id", operation.GetAssetId()).
 				Msg("received operation with non-matching asset id")
 			continue
 		}
 
-		derr := b.dispatcher.Dispatch(operation)
+		derr := dispatcher.Dispatch(operation)
 		if derr != nil {
 			// Little risky to bail out of main loop when this fails,
 			// but the scheduling of an operation really shouldn't
 			// fail unless something is actually broken. We have a
 			// watchdog that will restart the agent in such case.
-			return beatSent, derr
+			return derr
 		}
 	}
 
-	return beatSent, nil
+	return nil
 }
@@ -18,18 +18,29 @@
 package run
 
 import (
+	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/nalej/grpc-edge-controller-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/spool"
+
+	"github.com/golang/protobuf/proto"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 )
 
 var _ = ginkgo.Describe("beater", func() {
 	ginkgo.It("should send heartbeat", func() {
-		d, derr := NewDispatcher(testClient, NewWorker(testConfig), 10)
+		d, derr := NewDispatcher(testClient, NewWorker(testConfig), &DispatcherOptions{QueueLen: 10})
 		gomega.Expect(derr).To(gomega.Succeed())
 
-		beater := Beater{testClient, d, "testasset"}
+		beater := Beater{
+			client:     testClient,
+			dispatcher: d,
+			assetId:    "testasset",
+		}
 
 		cur := testHandler.GetNumChecks()
 		gomega.Expect(beater.Beat(time.Second)).To(gomega.BeTrue())
@@ -37,10 +48,14 @@ var _ = ginkgo.Describe("beater", func() {
 	})
 
 	ginkgo.It("should dispatch received operations", func() {
-		d, derr := NewDispatcher(testClient, NewWorker(testConfig), 10)
+		d, derr := NewDispatcher(testClient, NewWorker(testConfig), &DispatcherOptions{QueueLen: 10})
 		gomega.Expect(derr).To(gomega.Succeed())
 
-		beater := Beater{testClient, d, "test-asset"}
+		beater := Beater{
+			client:     testClient,
+			dispatcher: d,
+			assetId:    "test-asset",
+		}
 
 		cur := testHandler.GetNumCallbacks()
 		gomega.Expect(beater.Beat(time.Second)).To(gomega.BeTrue())
@@ -54,4 +69,120 @@ var _ = ginkgo.Describe("beater", func() {
 		// Three operations, scheduled and succeeded, equals 6 callbacks
 		gomega.Expect(testHandler.GetNumCallbacks()).To(gomega.Equal(cur + 6))
 	})
+
+	ginkgo.It("should use interval requested by edge controller", func() {
+		d, derr := NewDispatcher(testClient, NewWorker(testConfig), &DispatcherOptions{QueueLen: 10})
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		beater := Beater{
+			client:     testClient,
+			dispatcher: d,
+			assetId:    "testasset",
+			interval:   newHeartbeatInterval(30*time.Second, 10*time.Second, time.Minute, 0),
+		}
+		defer testHandler.RequestInterval(-1)
+
+		// Nothing requested, nothing changes
+		gomega.Expect(beater.Beat(time.Second)).To(gomega.BeTrue())
+		gomega.Expect(beater.interval.Get()).To(gomega.Equal(30 * time.Second))
+
+		testHandler.RequestInterval(15 * time.Second)
+		gomega.Expect(beater.Beat(time.Second)).To(gomega.BeTrue())
+		gomega.Expect(beater.interval.Get()).To(gomega.Equal(15 * time.Second))
+		gomega.Expect(beater.interval.changeChan).To(gomega.Receive())
+
+		// Same interval again is no change
+		gomega.Expect(beater.Beat(time.Second)).To(gomega.BeTrue())
+		gomega.Expect(beater.interval.changeChan).ToNot(gomega.Receive())
+
+		// Within bounds
+		testHandler.RequestInterval(time.Hour)
+		gomega.Expect(beater.Beat(time.Second)).To(gomega.BeTrue())
+		gomega.Expect(beater.interval.Get()).To(gomega.Equal(time.Minute))
+
+		// Back to configured
+		testHandler.RequestInterval(0)
+		gomega.Expect(beater.Beat(time.Second)).To(gomega.BeTrue())
+		gomega.Expect(beater.interval.Get()).To(gomega.Equal(30 * time.Second))
+	})
+	ginkgo.Context("spool", func() {
+		var spoolPath string
+		var beatSpool *spool.Spool
+		var beater *Beater
+
+		ginkgo.BeforeEach(func() {
+			d, derr := NewDispatcher(testClient, NewWorker(testConfig), &DispatcherOptions{QueueLen: 32})
+			gomega.Expect(derr).To(gomega.Succeed())
+
+			spoolPath = filepath.Join(testPath, "spool")
+			beatSpool, derr = spool.NewSpool(spoolPath, 1024*1024)
+			gomega.Expect(derr).To(gomega.Succeed())
+
+			beater = &Beater{
+				client:     testClient,
+				dispatcher: d,
+				assetId:    "test-asset",
+				spool:      beatSpool,
+			}
+		})
+
+		ginkgo.AfterEach(func() {
+			testHandler.FailChecks(0)
+			gomega.Expect(os.RemoveAll(spoolPath)).To(gomega.Succeed())
+		})
+
+		pushBeat := func() {
+			beatRequest := &grpc_edge_controller_go.AgentCheckRequest{
+				AssetId:   "test-asset",
+				Timestamp: time.Now().UTC().Unix(),
+				PluginData: []*grpc_edge_controller_go.PluginData{
+					&grpc_edge_controller_go.PluginData{
+						Data: &grpc_edge_controller_go.PluginData_MetricsData{
+							MetricsData: &grpc_edge_controller_go.MetricsPluginData{
+								Timestamp: time.Now().UTC().Unix(),
+							},
+						},
+					},
+				},
+			}
+			data, err := proto.Marshal(beatRequest)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(beatSpool.Push(data)).To(gomega.Succeed())
+		}
+
+		ginkgo.It("should replay spooled heartbeats when online", func() {
+			pushBeat()
+			pushBeat()
+
+			testHandler.FailChecks(1)
+			cur := testHandler.GetNumChecks()
+			gomega.Expect(beater.Beat(time.Second)).To(gomega.BeFalse())
+			gomega.Expect(testHandler.GetNumChecks()).To(gomega.Equal(cur))
+			gomega.Expect(beatSpool.Len()).To(gomega.Equal(2))
+
+			gomega.Expect(beater.Beat(time.Second)).To(gomega.BeTrue())
+			gomega.Expect(testHandler.GetNumChecks()).To(gomega.Equal(cur + 3))
+			gomega.Expect(beatSpool.Len()).To(gomega.Equal(0))
+		})
+
+		ginkgo.It("should limit replayed heartbeats", func() {
+			beater.replayLimit = 2
+			pushBeat()
+			pushBeat()
+			pushBeat()
+
+			cur := testHandler.GetNumChecks()
+			gomega.Expect(beater.Beat(time.Second)).To(gomega.BeTrue())
+			gomega.Expect(testHandler.GetNumChecks()).To(gomega.Equal(cur + 3))
+			gomega.Expect(beatSpool.Len()).To(gomega.Equal(1))
+		})
+
+		ginkgo.It("should only spool heartbeats with plugin data", func() {
+			beater.store(&grpc_edge_controller_go.AgentCheckRequest{AssetId: "test-asset"})
+			gomega.Expect(beatSpool.Len()).To(gomega.Equal(0))
+
+			pushBeat()
+			gomega.Expect(beatSpool.Len()).To(gomega.Equal(1))
+		})
+	})
 })
@@ -0,0 +1,341 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Bandwidth budget for metered uplinks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin/metrics"
+	"github.com/nalej/service-net-agent/internal/pkg/atomicfile"
+	"github.com/nalej/service-net-agent/internal/pkg/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Name of the metric reporting bandwidth usage to the Edge Controller
+const agentBandwidthMetric = "agent_bandwidth"
+
+type BudgetPeriod string
+
+const (
+	BudgetDaily   BudgetPeriod = "daily"
+	BudgetMonthly BudgetPeriod = "monthly"
+)
+
+// How far we've degraded to stay within the budget
+type BudgetLevel int
+
+const (
+	// Plenty of budget left
+	BudgetNormal BudgetLevel = iota
+	// Heartbeats without metrics data
+	BudgetReduced
+	// Heartbeat interval stretched to make the rest of the budget last
+	// until the end of the period
+	BudgetStretched
+	// Budget used up; heartbeats at the maximum interval
+	BudgetExhausted
+)
+
+var budgetLevelNames = map[BudgetLevel]string{
+	BudgetNormal:    "normal",
+	BudgetReduced:   "reduced",
+	BudgetStretched: "stretched",
+	BudgetExhausted: "exhausted",
+}
+
+func (l BudgetLevel) String() string {
+	return budgetLevelNames[l]
+}
+
+type BudgetOptions struct {
+	// Bytes we can send and receive per period
+	Limit  uint64
+	Period BudgetPeriod
+	// Fractions of the limit at which we drop metrics data and stretch
+	// the heartbeat interval
+	ReduceAt  float64
+	StretchAt float64
+	// Longest heartbeat interval we stretch to
+	MaxInterval time.Duration
+
+	// How often usage is written to disk; on every update if zero
+	WriteInterval time.Duration
+}
+
+// Keeps track of the bytes the Edge Controller connection uses in the
+// current period, and degrades gracefully as the budget runs out. Usage is
+// written to disk when the period or level changes, and otherwise once per
+// write interval, so it survives a restart without writing on every
+// heartbeat.
+//
+// All methods can be called on a nil budget, which never runs out.
+type budget struct {
+	client *client.AgentClient
+	file   string
+	opts   *BudgetOptions
+
+	lock  sync.Mutex
+	usage budgetUsage
+	level BudgetLevel
+	// Client traffic counters at last update
+	lastSent     uint64
+	lastReceived uint64
+	// Bytes used since the update before
+	lastUsed uint64
+	// Last time usage was written to disk
+	lastWrite time.Time
+}
+
+type budgetUsage struct {
+	PeriodStart time.Time `json:"period_start"`
+	Sent        uint64    `json:"sent"`
+	Received    uint64    `json:"received"`
+}
+
+func newBudget(agentClient *client.AgentClient, file string, opts *BudgetOptions) (*budget, derrors.Error) {
+	if opts.Period != BudgetDaily && opts.Period != BudgetMonthly {
+		return nil, derrors.NewInvalidArgumentError("invalid budget period").WithParams(opts.Period)
+	}
+
+	b := &budget{
+		client: agentClient,
+		file:   file,
+		opts:   opts,
+	}
+	b.lastSent, b.lastReceived = agentClient.Traffic()
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, derrors.NewInternalError("failed reading bandwidth usage", err).WithParams(file)
+	}
+
+	// Starting from scratch is better than refusing to start
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &b.usage)
+		if err != nil {
+			log.Warn().Err(err).Str("file", file).Msg("ignoring corrupt bandwidth usage")
+			b.usage = budgetUsage{}
+		}
+	}
+
+	b.updateLocked(time.Now())
+
+	return b, nil
+}
+
+// Start of the period that includes t
+func (b *budget) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	if b.opts.Period == BudgetDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (b *budget) periodEnd() time.Time {
+	if b.opts.Period == BudgetDaily {
+		return b.usage.PeriodStart.AddDate(0, 0, 1)
+	}
+	return b.usage.PeriodStart.AddDate(0, 1, 0)
+}
+
+// Update adds the bytes used since the last update, starting a new period
+// when the current one is over.
+func (b *budget) Update(now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.updateLocked(now)
+}
+
+func (b *budget) updateLocked(now time.Time) {
+	write := now.Sub(b.lastWrite) >= b.opts.WriteInterval
+
+	// Start a new period before counting, so the bytes used since the
+	// last update count towards the period we're in now
+	start := b.periodStart(now)
+	if !start.Equal(b.usage.PeriodStart) {
+		log.Info().Time("start", start).Msg("new bandwidth budget period")
+		b.usage = budgetUsage{PeriodStart: start}
+		write = true
+	}
+
+	sent, received := b.client.Traffic()
+	b.lastUsed = (sent - b.lastSent) + (received - b.lastReceived)
+	b.usage.Sent += sent - b.lastSent
+	b.usage.Received += received - b.lastReceived
+	b.lastSent, b.lastReceived = sent, received
+
+	level := b.levelLocked()
+	if level != b.level {
+		log.Info().Str("level", level.String()).Uint64("used", b.usage.Sent+b.usage.Received).Uint64("limit", b.opts.Limit).Msg("bandwidth budget level changed")
+		b.level = level
+		write = true
+	}
+
+	if write {
+		b.writeLocked(now)
+	}
+}
+
+// Flush writes usage as of the last update to disk, so nothing is lost
+// when stopping
+func (b *budget) Flush() {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.writeLocked(time.Now())
+}
+
+func (b *budget) levelLocked() BudgetLevel {
+	used := float64(b.usage.Sent + b.usage.Received)
+	limit := float64(b.opts.Limit)
+
+	switch {
+	case used >= limit:
+		return BudgetExhausted
+	case used >= b.opts.StretchAt*limit:
+		return BudgetStretched
+	case used >= b.opts.ReduceAt*limit:
+		return BudgetReduced
+	}
+	return BudgetNormal
+}
+
+func (b *budget) Level() BudgetLevel {
+	if b == nil {
+		return BudgetNormal
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.level
+}
+
+// Delay until the next heartbeat, given the normal delay. When stretched,
+// we pace heartbeats so that, using as many bytes as since the last
+// update, what's left lasts until the end of the period.
+func (b *budget) Delay(now time.Time, delay time.Duration) time.Duration {
+	if b == nil {
+		return delay
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var stretched time.Duration
+	switch b.level {
+	case BudgetNormal, BudgetReduced:
+		return delay
+	case BudgetStretched:
+		remaining := float64(b.opts.Limit - b.usage.Sent - b.usage.Received)
+		stretched = time.Duration(float64(b.periodEnd().Sub(now)) * float64(b.lastUsed) / remaining)
+	case BudgetExhausted:
+		stretched = b.opts.MaxInterval
+	}
+
+	if stretched > b.opts.MaxInterval {
+		stretched = b.opts.MaxInterval
+	}
+	if stretched > delay {
+		return stretched
+	}
+	return delay
+}
+
+// Leave out metrics data when we need to save bytes
+func (b *budget) Filter(data agentplugin.PluginHeartbeatDataList) agentplugin.PluginHeartbeatDataList {
+	if b.Level() < BudgetReduced {
+		return data
+	}
+
+	filtered := make(agentplugin.PluginHeartbeatDataList, 0, len(data))
+	for _, d := range data {
+		if _, isMetrics := d.(*metrics.MetricsData); isMetrics {
+			continue
+		}
+		filtered = append(filtered, d)
+	}
+	return filtered
+}
+
+// Heartbeat data with the bandwidth used in the current period, as metric
+// with the period and level as tags.
+func (b *budget) HeartbeatData() agentplugin.PluginHeartbeatData {
+	if b == nil {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	data := &metrics.MetricsData{
+		Timestamp: time.Now(),
+		Metrics: []*metrics.Metric{
+			&metrics.Metric{
+				Name: agentBandwidthMetric,
+				Tags: map[string]string{
+					"period": string(b.opts.Period),
+					"level":  b.level.String(),
+				},
+				Fields: map[string]uint64{
+					"sent":         b.usage.Sent,
+					"received":     b.usage.Received,
+					"limit":        b.opts.Limit,
+					"period_start": uint64(b.usage.PeriodStart.Unix()),
+				},
+			},
+		},
+	}
+
+	return data
+}
+
+func (b *budget) writeLocked(now time.Time) {
+	b.lastWrite = now
+
+	data, err := json.Marshal(b.usage)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed encoding bandwidth usage")
+		return
+	}
+
+	derr := atomicfile.WriteFile(b.file, data)
+	if derr != nil {
+		log.Warn().Err(derr).Str("file", b.file).Msg("failed writing bandwidth usage")
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin/metrics"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("bandwidth budget", func() {
+
+	var budgetFile string
+	var opts *BudgetOptions
+
+	ginkgo.BeforeEach(func() {
+		budgetFile = filepath.Join(testPath, "bandwidth.json")
+		opts = &BudgetOptions{
+			Limit:       1000,
+			Period:      BudgetMonthly,
+			ReduceAt:    0.5,
+			StretchAt:   0.8,
+			MaxInterval: time.Hour,
+
+			WriteInterval: time.Minute,
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		os.Remove(budgetFile)
+	})
+
+	// Pretend we used some bytes
+	var use = func(b *budget, used uint64, now time.Time) {
+		b.lock.Lock()
+		b.usage.Sent += used
+		b.lock.Unlock()
+		b.Update(now)
+	}
+
+	ginkgo.It("should degrade as the budget runs out", func() {
+		b, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(b.Level()).To(gomega.Equal(BudgetNormal))
+
+		now := time.Now()
+		use(b, 500, now)
+		gomega.Expect(b.Level()).To(gomega.Equal(BudgetReduced))
+		use(b, 300, now)
+		gomega.Expect(b.Level()).To(gomega.Equal(BudgetStretched))
+		use(b, 200, now)
+		gomega.Expect(b.Level()).To(gomega.Equal(BudgetExhausted))
+	})
+
+	ginkgo.It("should remember usage after restart", func() {
+		b, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+		use(b, 600, time.Now())
+
+		b2, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(b2.usage.Sent).To(gomega.Equal(uint64(600)))
+		gomega.Expect(b2.Level()).To(gomega.Equal(BudgetReduced))
+	})
+
+	ginkgo.It("should not write usage on every update", func() {
+		b, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		// Still at the same level
+		now := time.Now()
+		use(b, 100, now)
+		b2, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(b2.usage.Sent).To(gomega.BeZero())
+
+		use(b, 100, now.Add(opts.WriteInterval))
+		b2, derr = newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(b2.usage.Sent).To(gomega.Equal(uint64(200)))
+
+		use(b, 100, now.Add(opts.WriteInterval))
+		b.Flush()
+		b2, derr = newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(b2.usage.Sent).To(gomega.Equal(uint64(300)))
+	})
+
+	ginkgo.It("should start over in a new period", func() {
+		opts.Period = BudgetDaily
+		b, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		now := time.Now()
+		use(b, 1000, now)
+		gomega.Expect(b.Level()).To(gomega.Equal(BudgetExhausted))
+
+		b.Update(now.AddDate(0, 0, 1))
+		gomega.Expect(b.Level()).To(gomega.Equal(BudgetNormal))
+		gomega.Expect(b.usage.Sent).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should count traffic since the last update in the new period", func() {
+		opts.Period = BudgetDaily
+		b, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		now := time.Now()
+		use(b, 1000, now)
+
+		// Pretend the client sent 100 bytes since
+		b.lock.Lock()
+		b.lastSent -= 100
+		b.lock.Unlock()
+
+		b.Update(now.AddDate(0, 0, 1))
+		gomega.Expect(b.usage.Sent).To(gomega.BeNumerically(">=", 100))
+		gomega.Expect(b.usage.Sent).To(gomega.BeNumerically("<", 1000))
+	})
+
+	ginkgo.It("should stretch the heartbeat interval", func() {
+		opts.Period = BudgetDaily
+		b, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		now := b.usage.PeriodStart.Add(12 * time.Hour)
+		gomega.Expect(b.Delay(now, time.Minute)).To(gomega.Equal(time.Minute))
+
+		// 100 bytes left for 12 hours, at 10 bytes per heartbeat
+		use(b, 900, now)
+		b.lastUsed = 10
+		gomega.Expect(b.Delay(now, time.Minute)).To(gomega.Equal(time.Hour))
+		b.lastUsed = 1
+		gomega.Expect(b.Delay(now, time.Minute)).To(gomega.Equal(12 * time.Hour / 100))
+
+		use(b, 100, now)
+		gomega.Expect(b.Delay(now, time.Minute)).To(gomega.Equal(opts.MaxInterval))
+	})
+
+	ginkgo.It("should drop metrics data when reduced", func() {
+		b, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		data := agentplugin.PluginHeartbeatDataList{&metrics.MetricsData{}}
+		gomega.Expect(b.Filter(data)).To(gomega.HaveLen(1))
+
+		use(b, 500, time.Now())
+		gomega.Expect(b.Filter(data)).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should create heartbeat data", func() {
+		b, derr := newBudget(testClient, budgetFile, opts)
+		gomega.Expect(derr).To(gomega.Succeed())
+		use(b, 600, time.Now())
+
+		data := b.HeartbeatData()
+		gomega.Expect(data).To(gomega.BeAssignableToTypeOf(&metrics.MetricsData{}))
+
+		metric := data.(*metrics.MetricsData).Metrics[0]
+		gomega.Expect(metric.Name).To(gomega.Equal(agentBandwidthMetric))
+		gomega.Expect(metric.Tags).To(gomega.Equal(map[string]string{
+			"period": "monthly",
+			"level":  "reduced",
+		}))
+		gomega.Expect(metric.Fields).To(gomega.HaveKeyWithValue("sent", uint64(600)))
+		gomega.Expect(metric.Fields).To(gomega.HaveKeyWithValue("limit", uint64(1000)))
+	})
+
+	ginkgo.It("should never run out when nil", func() {
+		var b *budget
+		b.Update(time.Now())
+		b.Flush()
+		gomega.Expect(b.Level()).To(gomega.Equal(BudgetNormal))
+		gomega.Expect(b.Delay(time.Now(), time.Minute)).To(gomega.Equal(time.Minute))
+		gomega.Expect(b.HeartbeatData()).To(gomega.BeNil())
+	})
+})
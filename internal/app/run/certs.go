@@ -0,0 +1,120 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Client certificate renewal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/service-net-agent/internal/pkg/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Renews the client certificate before it expires, by having the Edge
+// Controller sign a certificate for a new key while the current one is
+// still valid.
+//
+// All methods can be called on a nil certRenewer, which never renews.
+type certRenewer struct {
+	client  *client.AgentClient
+	cert    *client.ClientCertificate
+	assetId string
+	// How often to check if the certificate needs renewal
+	interval time.Duration
+
+	cancel    context.CancelFunc
+	waitgroup sync.WaitGroup
+}
+
+func newCertRenewer(agentClient *client.AgentClient, assetId string, interval time.Duration) *certRenewer {
+	cert := agentClient.ClientCertificate()
+	if cert == nil {
+		return nil
+	}
+
+	return &certRenewer{
+		client:   agentClient,
+		cert:     cert,
+		assetId:  assetId,
+		interval: interval,
+	}
+}
+
+func (r *certRenewer) Start() {
+	if r == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	r.waitgroup.Add(1)
+	go r.loop(ctx)
+}
+
+func (r *certRenewer) Stop() {
+	if r == nil || r.cancel == nil {
+		return
+	}
+
+	r.cancel()
+	r.waitgroup.Wait()
+}
+
+func (r *certRenewer) loop(ctx context.Context) {
+	defer r.waitgroup.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		derr := r.renew(time.Now())
+		if derr != nil {
+			// We try again next time, hopefully before it expires
+			log.Warn().Err(derr).Time("expires", r.cert.NotAfter()).Msg("failed renewing client certificate")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Renew the certificate if it is due
+func (r *certRenewer) renew(now time.Time) derrors.Error {
+	if !r.cert.NeedsRenewal(now) {
+		return nil
+	}
+
+	log.Info().Time("expires", r.cert.NotAfter()).Msg("renewing client certificate")
+	derr := r.client.RequestCertificate(r.assetId, r.cert)
+	if derr != nil {
+		return derr
+	}
+
+	log.Info().Time("expires", r.cert.NotAfter()).Msg("renewed client certificate")
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/nalej/service-net-agent/internal/pkg/client"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("certificate renewal", func() {
+	ginkgo.It("should renew a certificate that is due", func() {
+		cert := client.NewClientCertificate(filepath.Join(testPath, "renew", "agent.pem"))
+		r := &certRenewer{
+			client:   testClient,
+			cert:     cert,
+			assetId:  "test-asset",
+			interval: time.Hour,
+		}
+
+		cur := testHandler.GetNumCertificates()
+		gomega.Expect(r.renew(time.Now())).To(gomega.Succeed())
+		gomega.Expect(testHandler.GetNumCertificates()).To(gomega.Equal(cur + 1))
+		gomega.Expect(cert.NotAfter()).To(gomega.BeTemporally(">", time.Now()))
+
+		// Not due anymore
+		gomega.Expect(r.renew(time.Now())).To(gomega.Succeed())
+		gomega.Expect(testHandler.GetNumCertificates()).To(gomega.Equal(cur + 1))
+	})
+
+	ginkgo.It("should not renew without client certificate", func() {
+		r := newCertRenewer(testClient, "test-asset", time.Hour)
+		gomega.Expect(r).To(gomega.BeNil())
+		r.Start()
+		r.Stop()
+	})
+})
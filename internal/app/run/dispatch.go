@@ -21,20 +21,34 @@ package run
 
 import (
 	"context"
-	grpc_inventory_go "github.com/nalej/grpc-inventory-go"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nalej/derrors"
 	"github.com/nalej/infra-net-plugin"
 
+	"github.com/nalej/grpc-inventory-go"
 	"github.com/nalej/grpc-inventory-manager-go"
 
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
 	"github.com/nalej/service-net-agent/internal/pkg/client"
 
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// Message of operations cancelled by the Edge Controller, which
+	// fail with an Aborted error to tell them apart from operations
+	// that failed by themselves
+	opCancelledMsg = "operation cancelled"
+
+	// Plugin for agent control operations
+	corePlugin plugin.PluginName = "core"
+)
+
 type Dispatcher struct {
 	// Client connection to Edge Controller
 	client *client.AgentClient
@@ -52,43 +66,257 @@ type Dispatcher struct {
 
 	// Cancel function to interrupt operations worker
 	cancelOpWorker context.CancelFunc
+	// Cancel function to interrupt response worker, to stop retrying
+	cancelResWorker context.CancelFunc
+
+	// Persistent record of queued operations and responses; can be nil
+	journal *Journal
+	// Recently seen operations, to recognize repeated ones; can be nil
+	opCache *OperationCache
+	// Operations to execute later; can be nil
+	scheduler *Scheduler
+	// Retry policy for sending responses; no retries if nil
+	retry *RetryOptions
+	// Maximum number of operations executing at the same time; no
+	// maximum if zero
+	maxConcurrent int
+
+	// Maximum number of queued operations per lane; no maximum for
+	// lanes that are not in the map. Protected by opsLock, as it can
+	// be changed while running.
+	laneLen map[Lane]int
+
+	// Operations arrive from both heartbeat and stream; checking whether
+	// we've seen an operation and queueing it happens as one step
+	dispatchLock sync.Mutex
+
+	// Operations that are queued or executing, so they can be cancelled
+	opsLock sync.Mutex
+	ops     map[string]*opState
+	// Signals the operation worker that a waiting operation was cancelled
+	wakeChan chan struct{}
+	// Plugins that no operations are started for, so they can be
+	// restarted; also protected by opsLock
+	held map[plugin.PluginName]int
+	// Plugins executing an operation, and channels closed when they're
+	// done; also protected by opsLock
+	executing map[plugin.PluginName]int
+	idle      map[plugin.PluginName]chan struct{}
+	// Results of scheduled operations, which are kept until delivered;
+	// also protected by opsLock
+	kept map[*grpc_inventory_manager_go.AgentOpResponse]bool
+
+	// Number of responses that failed to be sent
+	failedCallbacks uint64
+	// Set while operations should not be started
+	paused int32
+}
+
+// State of an operation that is queued or executing
+type opState struct {
+	lane Lane
+	// Set when the operation is executing
+	cancel context.CancelFunc
+	// Cancelled by the Edge Controller
+	cancelled bool
+	// A run of a scheduled operation
+	run bool
+}
+
+// Snapshot of the operations handled by the dispatcher
+type DispatcherStatus struct {
+	Queued          int
+	Executing       int
+	Scheduled       int
+	FailedCallbacks uint64
+}
+
+type DispatcherOptions struct {
+	// Maximum number of queued operations in each lane that is not in
+	// LaneLen
+	QueueLen int
+	// Maximum number of queued operations per lane
+	LaneLen map[Lane]int
+	// Optional journal to persist queued operations and responses
+	Journal *Journal
+	// Optional cache of recently seen operations
+	OperationCache *OperationCache
+	// Optional scheduler for operations to execute later or repeatedly;
+	// such operations are refused without it
+	Scheduler *Scheduler
+	// Optional policy to retry sending responses that failed
+	Retry *RetryOptions
+	// Maximum number of operations for different plugins that are
+	// executed at the same time; no maximum if zero
+	MaxConcurrent int
+}
+
+// Results of scheduled operations are never dropped; the Edge Controller
+// doesn't send those operations again to ask for them.
+type RetryOptions struct {
+	// Delay between attempts to send the same response
+	backoff.Policy
+	// Responses older than this are dropped instead of sent
+	MaxAge time.Duration
+	// Maximum number of responses waiting to be sent; the oldest is
+	// dropped when more are added
+	BufferLen int
 }
 
-func NewDispatcher(client *client.AgentClient, worker *Worker, queueLen int) (*Dispatcher, derrors.Error) {
+func NewDispatcher(client *client.AgentClient, worker *Worker, opts *DispatcherOptions) (*Dispatcher, derrors.Error) {
 	// We want to be able to cancel
 	ctx, cancelOpWorker := context.WithCancel(context.Background())
+	resCtx, cancelResWorker := context.WithCancel(context.Background())
+
+	// The operation queue holds operations for all lanes until the
+	// operation worker sorts them out
+	laneLen := laneLengths(opts.QueueLen, opts.LaneLen)
+	queueLen := 0
+	for _, l := range laneLen {
+		queueLen += l
+	}
 
 	d := &Dispatcher{
-		client:         client,
-		worker:         worker,
-		opQueue:        make(chan *grpc_inventory_manager_go.AgentOpRequest, queueLen),
-		resQueue:       make(chan *grpc_inventory_manager_go.AgentOpResponse, queueLen),
-		cancelOpWorker: cancelOpWorker,
+		client:          client,
+		worker:          worker,
+		opQueue:         make(chan *grpc_inventory_manager_go.AgentOpRequest, queueLen),
+		resQueue:        make(chan *grpc_inventory_manager_go.AgentOpResponse, queueLen),
+		cancelOpWorker:  cancelOpWorker,
+		cancelResWorker: cancelResWorker,
+		journal:         opts.Journal,
+		opCache:         opts.OperationCache,
+		scheduler:       opts.Scheduler,
+		retry:           opts.Retry,
+		maxConcurrent:   opts.MaxConcurrent,
+		laneLen:         laneLen,
+		ops:             make(map[string]*opState),
+		wakeChan:        make(chan struct{}, 1),
 	}
 
 	// Start response routine
 	d.resWorkerWaitgroup.Add(1)
 	// We stop the sending of responses by closing the channel, this allows
 	// us to still send all responses that are queued so the edge
-	// controller is aware of their status.
-	go d.resWorker(context.Background())
+	// controller is aware of their status. We only cancel it if that
+	// takes too long.
+	go d.resWorker(resCtx)
 
 	// Start worker routine
 	d.opWorkerWaitgroup.Add(1)
 	go d.opWorker(ctx)
 
+	// Pick up where we left off before a restart
+	derr := d.replay()
+	if derr != nil {
+		d.Stop(0)
+		return nil, derr
+	}
+
+	// Start executing scheduled operations
+	d.scheduler.Start(d.runScheduled)
+
 	return d, nil
 }
 
+// Maximum number of queued operations for each lane, using queueLen for
+// lanes without their own length
+func laneLengths(queueLen int, laneLen map[Lane]int) map[Lane]int {
+	lengths := make(map[Lane]int, len(Lanes))
+	for _, lane := range Lanes {
+		lengths[lane] = queueLen
+		if l, found := laneLen[lane]; found && l > 0 {
+			lengths[lane] = l
+		}
+	}
+
+	return lengths
+}
+
+// SetQueueLen changes the maximum number of queued operations per lane,
+// like DispatcherOptions. Operations that are queued already stay queued
+// when it is lowered. The operation worker takes operations off the
+// operation queue right away, so its capacity doesn't limit the lanes.
+func (d *Dispatcher) SetQueueLen(queueLen int, laneLen map[Lane]int) {
+	lengths := laneLengths(queueLen, laneLen)
+
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	d.laneLen = lengths
+}
+
+// Queue the operations and responses left in the journal by a previous
+// run. The Edge Controller already received a SCHEDULED response for the
+// operations, so we don't send that again.
+func (d *Dispatcher) replay() derrors.Error {
+	requests, responses, derr := d.journal.Pending()
+	if derr != nil {
+		return derr
+	}
+
+	// Operations with a final result were executed, but we were
+	// stopped before we got to clean up
+	executed := make(map[string]bool, len(responses))
+	for _, response := range responses {
+		log.Info().Str("operation_id", response.GetOperationId()).Msg("re-sending undelivered operation response")
+		if d.journal.IsRunResponse(response) {
+			d.keep(response)
+		}
+		d.resQueue <- response
+		if response.GetStatus() != grpc_inventory_go.OpStatus_SCHEDULED {
+			executed[response.GetOperationId()] = true
+		}
+	}
+
+	for _, op := range requests {
+		if executed[op.GetOperationId()] {
+			d.journal.RemoveRequest(op)
+			continue
+		}
+
+		lane, _ := operationLane(op)
+		run := d.journal.IsRunRequest(op)
+		queued, already := d.track(op, lane, run)
+		if already {
+			continue
+		}
+		if queued {
+			select {
+			case d.opQueue <- op:
+				log.Info().Str("operation_id", op.GetOperationId()).Msg("re-queued unexecuted operation")
+			default:
+				d.untrack(op)
+				queued = false
+			}
+		}
+		if !queued {
+			log.Warn().Str("operation_id", op.GetOperationId()).Str("lane", lane.String()).Msg("operation queue full")
+			d.queueResponse(d.newResponse(op, grpc_inventory_go.OpStatus_FAIL, queueFullResult(lane).Info()), run)
+			d.journal.RemoveRequest(op)
+			d.opCache.Remove(op.GetOperationId())
+		}
+	}
+
+	return nil
+}
+
 func (d *Dispatcher) Stop(timeout time.Duration) derrors.Error {
 	log.Debug().Msg("stopping operation dispatcher")
 
+	// Write whatever the operation cache hasn't written yet
+	defer d.opCache.Flush()
+
 	// Set timeout for complete shutdown routine
 	timeoutChan := time.After(timeout)
 
+	// No more scheduled operations are queued after this
+	d.scheduler.Stop()
+
 	// We cancel the operation worker routine - this potentially
-	// finishes the in-progress operation if it doesn't use the
-	// context properly - which is ok, we have a timeout.
+	// finishes the in-progress operations if they don't use the
+	// context properly - which is ok, we have a timeout. Operations
+	// that were received but not started yet are cancelled by the
+	// worker routine.
 	d.cancelOpWorker()
 
 	// We loop over queued operation requests and tell the edge
@@ -99,8 +327,11 @@ func (d *Dispatcher) Stop(timeout time.Duration) derrors.Error {
 	close(d.opQueue)
 	for op := range d.opQueue {
 		status := grpc_inventory_go.OpStatus_FAIL
-		info := "agent stopped"
+		info := failedResult(derrors.NewUnavailableError("agent stopped")).Info()
 		d.respond(op, status, info)
+		d.journal.RemoveRequest(op)
+		d.opCache.Remove(op.GetOperationId())
+		d.untrack(op)
 	}
 
 	// Wait for operation routine
@@ -118,6 +349,10 @@ func (d *Dispatcher) Stop(timeout time.Duration) derrors.Error {
 	// Wait for response worker with same timeout
 	timedout = wait(&d.resWorkerWaitgroup, timeoutChan)
 	if timedout {
+		// Stop retrying; whatever is left is still in the journal
+		if d.cancelResWorker != nil {
+			d.cancelResWorker()
+		}
 		return derrors.NewDeadlineExceededError("waiting for response workers timed out - communication taking too long").WithParams(timeout)
 	}
 
@@ -148,27 +383,365 @@ func wait(wg *sync.WaitGroup, timeoutChan <-chan time.Time) bool {
 // We don't return an error unless something is really broken. Under normal
 // operation we can return an error to Edge Controller.
 func (d *Dispatcher) Dispatch(op *grpc_inventory_manager_go.AgentOpRequest) derrors.Error {
+	d.dispatchLock.Lock()
+	defer d.dispatchLock.Unlock()
+
+	// The Edge Controller sends an operation again if it didn't get
+	// our response. We send the last response again instead of
+	// executing the operation again.
+	status, info, found := d.opCache.Get(op.GetOperationId())
+	if found {
+		log.Info().Str("operation_id", op.GetOperationId()).Str("status", status.String()).Msg("received repeated operation")
+		d.respond(op, status, info)
+		return nil
+	}
+
+	// Operations for later are kept by the scheduler, which queues
+	// them when they're due
+	if isScheduled(op) {
+		derr := d.scheduler.Add(op)
+		if derr != nil {
+			log.Warn().Err(derr).Str("operation_id", op.GetOperationId()).Msg("failed scheduling operation")
+			d.finish(op, failedResult(derr))
+			return nil
+		}
+		d.opCache.Set(op.GetOperationId(), grpc_inventory_go.OpStatus_SCHEDULED, "")
+		d.respond(op, grpc_inventory_go.OpStatus_SCHEDULED, "")
+		return nil
+	}
+
+	failed := d.enqueue(op, false)
+	if failed != nil {
+		d.respond(op, failed.Status(), failed.Info())
+		return nil
+	}
+
+	// Add to response queue
+	d.respond(op, grpc_inventory_go.OpStatus_SCHEDULED, "")
+
+	return nil
+}
+
+// Add operation to queue, or a run of a scheduled operation. Returns the
+// result to send to the Edge Controller if the operation can't be queued.
+// That's not a result of the operation; we'll try again if the Edge
+// Controller sends it again.
+func (d *Dispatcher) enqueue(op *grpc_inventory_manager_go.AgentOpRequest, run bool) *OperationResult {
+	lane, derr := operationLane(op)
+	if derr != nil {
+		log.Warn().Err(derr).Str("operation_id", op.GetOperationId()).Msg("invalid operation")
+		return failedResult(derr)
+	}
+
+	tracked, already := d.track(op, lane, run)
+	if already {
+		// Queued or executing already; it's not queued twice
+		log.Debug().Str("operation_id", op.GetOperationId()).Msg("operation already queued or executing")
+		return nil
+	}
+	if !tracked {
+		log.Debug().Str("operation_id", op.GetOperationId()).Str("lane", lane.String()).Msg("operation queue full")
+		return queueFullResult(lane)
+	}
+
+	// Record operation before queueing it, so we find it back when
+	// we're restarted before it gets executed. Not being able to
+	// persist it is not a reason to refuse it.
+	if run {
+		derr = d.journal.AddRunRequest(op)
+	} else {
+		derr = d.journal.AddRequest(op)
+	}
+	if derr != nil {
+		log.Warn().Err(derr).Str("operation_id", op.GetOperationId()).Msg("failed journaling operation")
+	}
+	d.opCache.Set(op.GetOperationId(), grpc_inventory_go.OpStatus_SCHEDULED, "")
+
 	// Make dispatching non-blocking
-	var status grpc_inventory_go.OpStatus
-	var info string
 	select {
 	case d.opQueue <- op:
-		log.Debug().Str("operation_id", op.GetOperationId()).Msg("queued operation")
-		status = grpc_inventory_go.OpStatus_SCHEDULED
+		log.Debug().Str("operation_id", op.GetOperationId()).Str("lane", lane.String()).Msg("queued operation")
+		return nil
 	default:
 		log.Debug().Str("operation_id", op.GetOperationId()).Msg("operation queue full")
-		status = grpc_inventory_go.OpStatus_FAIL
-		info = "agent operation queue full"
+		d.journal.RemoveRequest(op)
+		d.opCache.Remove(op.GetOperationId())
+		d.untrack(op)
+		return queueFullResult(lane)
 	}
+}
 
-	// Add to response queue
-	d.respond(op, status, info)
+// Queue a run of a scheduled operation. The Edge Controller already knows
+// the operation is scheduled, so we only report the result.
+func (d *Dispatcher) runScheduled(op *grpc_inventory_manager_go.AgentOpRequest) {
+	if d.isTracked(op) {
+		log.Warn().Str("operation_id", op.GetOperationId()).Msg("previous run of scheduled operation still in progress, skipping")
+		return
+	}
+
+	log.Info().Str("operation_id", op.GetOperationId()).Msg("running scheduled operation")
+	failed := d.enqueue(op, true)
+	if failed != nil {
+		d.queueResponse(d.newResponse(op, failed.Status(), failed.Info()), true)
+	}
+}
+
+func queueFullResult(lane Lane) *OperationResult {
+	return failedResult(derrors.NewUnavailableError(fmt.Sprintf("agent operation queue full (%s lane)", lane.String())))
+}
+
+// Cancel an operation that is scheduled, queued or executing. A scheduled
+// or queued operation is not executed; an executing operation has its
+// context cancelled. Either way, the Edge Controller receives a response
+// with an Aborted error.
+func (d *Dispatcher) Cancel(id string) derrors.Error {
+	// No more runs of a scheduled operation. A run in progress is
+	// cancelled below.
+	scheduled := d.scheduler.Remove(id)
+	if scheduled != nil {
+		log.Info().Str("operation_id", id).Msg("cancelling scheduled operation")
+		result := failedResult(derrors.NewAbortedError(opCancelledMsg))
+		d.opCache.Set(id, result.Status(), result.Info())
+		d.queueResponse(d.newResponse(scheduled, result.Status(), result.Info()), true)
+	}
+
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	state, found := d.ops[id]
+	if !found {
+		if scheduled != nil {
+			return nil
+		}
+		return derrors.NewFailedPreconditionError("operation not scheduled, queued or executing").WithParams(id)
+	}
+
+	log.Info().Str("operation_id", id).Msg("cancelling operation")
+	state.cancelled = true
+	if state.cancel != nil {
+		state.cancel()
+		return nil
+	}
+
+	// Let the operation worker remove it from the waiting operations
+	d.wake()
 
 	return nil
 }
 
-func (d *Dispatcher) respond(op *grpc_inventory_manager_go.AgentOpRequest, status grpc_inventory_go.OpStatus, info string) {
-	response := &grpc_inventory_manager_go.AgentOpResponse{
+// Pause stops starting operations; queued operations wait until resumed.
+// Operations that are executing are not interrupted.
+func (d *Dispatcher) Pause() {
+	if atomic.SwapInt32(&d.paused, 1) == 0 {
+		log.Info().Msg("pausing operations")
+	}
+}
+
+func (d *Dispatcher) Resume() {
+	if atomic.SwapInt32(&d.paused, 0) == 1 {
+		log.Info().Msg("resuming operations")
+		d.wake()
+	}
+}
+
+// Let the operation worker re-check waiting operations
+func (d *Dispatcher) wake() {
+	select {
+	case d.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// Keep track of a queued operation, so it can be cancelled. Returns false
+// if its lane is full. An operation that is queued or executing already is
+// not tracked again; already is true for those.
+func (d *Dispatcher) track(op *grpc_inventory_manager_go.AgentOpRequest, lane Lane, run bool) (tracked bool, already bool) {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	if d.ops == nil {
+		d.ops = make(map[string]*opState)
+	}
+
+	if _, found := d.ops[op.GetOperationId()]; found {
+		return false, true
+	}
+
+	if max, found := d.laneLen[lane]; found {
+		queued := 0
+		for _, state := range d.ops {
+			// Executing operations have left the queue
+			if state.lane == lane && state.cancel == nil {
+				queued++
+			}
+		}
+		if queued >= max {
+			return false, false
+		}
+	}
+
+	d.ops[op.GetOperationId()] = &opState{
+		lane: lane,
+		run:  run,
+	}
+	return true, false
+}
+
+func (d *Dispatcher) untrack(op *grpc_inventory_manager_go.AgentOpRequest) {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	delete(d.ops, op.GetOperationId())
+}
+
+// Returns whether a waiting operation is cancelled. If not, it is marked
+// as executing with the given cancel function.
+func (d *Dispatcher) startTracking(op *grpc_inventory_manager_go.AgentOpRequest, cancel context.CancelFunc) bool {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	state, found := d.ops[op.GetOperationId()]
+	if !found {
+		// Not dispatched through Dispatch, can't be cancelled
+		return false
+	}
+	if state.cancelled {
+		return true
+	}
+
+	state.cancel = cancel
+	return false
+}
+
+// Hold stops starting operations for a plugin and waits up to timeout for
+// the operation it is executing, so the plugin can be restarted safely.
+// Release has to be called afterwards, even if waiting timed out.
+func (d *Dispatcher) Hold(name plugin.PluginName, timeout time.Duration) derrors.Error {
+	d.opsLock.Lock()
+	if d.held == nil {
+		d.held = make(map[plugin.PluginName]int)
+	}
+	d.held[name]++
+
+	var idle chan struct{}
+	if d.executing[name] > 0 {
+		if d.idle == nil {
+			d.idle = make(map[plugin.PluginName]chan struct{})
+		}
+		idle = d.idle[name]
+		if idle == nil {
+			idle = make(chan struct{})
+			d.idle[name] = idle
+		}
+	}
+	d.opsLock.Unlock()
+
+	if idle == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-idle:
+		return nil
+	case <-timer.C:
+		return derrors.NewDeadlineExceededError("plugin still executing operation").WithParams(name)
+	}
+}
+
+// Release lets operations for a plugin held with Hold start again
+func (d *Dispatcher) Release(name plugin.PluginName) {
+	d.opsLock.Lock()
+	d.held[name]--
+	if d.held[name] <= 0 {
+		delete(d.held, name)
+	}
+	d.opsLock.Unlock()
+
+	d.wake()
+}
+
+// Returns whether an operation can be started for a plugin, and if so
+// marks the plugin as executing
+func (d *Dispatcher) startExecuting(name plugin.PluginName) bool {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	if d.held[name] > 0 {
+		return false
+	}
+
+	if d.executing == nil {
+		d.executing = make(map[plugin.PluginName]int)
+	}
+	d.executing[name]++
+	return true
+}
+
+func (d *Dispatcher) stopExecuting(name plugin.PluginName) {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	d.executing[name]--
+	if d.executing[name] > 0 {
+		return
+	}
+
+	delete(d.executing, name)
+	if idle, found := d.idle[name]; found {
+		close(idle)
+		delete(d.idle, name)
+	}
+}
+
+func (d *Dispatcher) Status() DispatcherStatus {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	status := DispatcherStatus{
+		Scheduled:       d.scheduler.Len(),
+		FailedCallbacks: atomic.LoadUint64(&d.failedCallbacks),
+	}
+	for _, state := range d.ops {
+		if state.cancel == nil {
+			status.Queued++
+		} else {
+			status.Executing++
+		}
+	}
+
+	return status
+}
+
+func (d *Dispatcher) isTracked(op *grpc_inventory_manager_go.AgentOpRequest) bool {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	_, found := d.ops[op.GetOperationId()]
+	return found
+}
+
+// Whether a tracked operation is a run of a scheduled operation
+func (d *Dispatcher) isRun(op *grpc_inventory_manager_go.AgentOpRequest) bool {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	state, found := d.ops[op.GetOperationId()]
+	return found && state.run
+}
+
+func (d *Dispatcher) isCancelled(op *grpc_inventory_manager_go.AgentOpRequest) bool {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	state, found := d.ops[op.GetOperationId()]
+	return found && state.cancelled
+}
+
+func (d *Dispatcher) newResponse(op *grpc_inventory_manager_go.AgentOpRequest, status grpc_inventory_go.OpStatus, info string) *grpc_inventory_manager_go.AgentOpResponse {
+	return &grpc_inventory_manager_go.AgentOpResponse{
 		OrganizationId:   op.GetOrganizationId(),
 		EdgeControllerId: op.GetEdgeControllerId(),
 		AssetId:          op.GetAssetId(),
@@ -177,6 +750,27 @@ func (d *Dispatcher) respond(op *grpc_inventory_manager_go.AgentOpRequest, statu
 		Status:           status,
 		Info:             info,
 	}
+}
+
+func (d *Dispatcher) respond(op *grpc_inventory_manager_go.AgentOpRequest, status grpc_inventory_go.OpStatus, info string) {
+	d.queueResponse(d.newResponse(op, status, info), d.isRun(op))
+}
+
+// Queue a response to be sent. Kept responses are not dropped when they
+// get old or the buffer is full.
+func (d *Dispatcher) queueResponse(response *grpc_inventory_manager_go.AgentOpResponse, keep bool) {
+	// Responses that don't make it to the Edge Controller before a
+	// restart are sent again after
+	var derr derrors.Error
+	if keep {
+		d.keep(response)
+		derr = d.journal.AddRunResponse(response)
+	} else {
+		derr = d.journal.AddResponse(response)
+	}
+	if derr != nil {
+		log.Warn().Err(derr).Str("operation_id", response.GetOperationId()).Msg("failed journaling operation response")
+	}
 
 	// We want to response in order, while not blocking main loop; hence
 	// we have a response queue and worker. If the response queue is full
@@ -184,14 +778,82 @@ func (d *Dispatcher) respond(op *grpc_inventory_manager_go.AgentOpRequest, statu
 	// ok to block main loop - agent might die but something is wrong anyway
 	// so an agent restart might help.
 	d.resQueue <- response
-	log.Debug().Str("operation_id", op.GetOperationId()).Msg("queued operation response")
+	log.Debug().Str("operation_id", response.GetOperationId()).Msg("queued operation response")
+}
+
+func (d *Dispatcher) keep(response *grpc_inventory_manager_go.AgentOpResponse) {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	if d.kept == nil {
+		d.kept = make(map[*grpc_inventory_manager_go.AgentOpResponse]bool)
+	}
+	d.kept[response] = true
+}
+
+func (d *Dispatcher) isKept(response *grpc_inventory_manager_go.AgentOpResponse) bool {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	return d.kept[response]
+}
+
+// Stop keeping a response that was sent or is left to the journal
+func (d *Dispatcher) forget(response *grpc_inventory_manager_go.AgentOpResponse) {
+	d.opsLock.Lock()
+	defer d.opsLock.Unlock()
+
+	delete(d.kept, response)
 }
 
 func (d *Dispatcher) resWorker(ctx context.Context) {
 	defer d.resWorkerWaitgroup.Done()
 
 	log.Debug().Msg("starting operation response worker")
-	for ctx.Err() == nil && d.resQueue != nil {
+
+	// Responses waiting to be sent, oldest first. We only ever send
+	// the oldest one, so the Edge Controller receives them in order.
+	pending := []*grpc_inventory_manager_go.AgentOpResponse{}
+
+	var retry *backoff.Backoff
+	if d.retry != nil {
+		retry = backoff.NewBackoff(d.retry.Policy)
+	}
+	// Set while waiting to retry the oldest response
+	var retryChan <-chan time.Time
+
+	for ctx.Err() == nil && (d.resQueue != nil || len(pending) > 0) {
+		if len(pending) > 0 && retryChan == nil {
+			response := pending[0]
+			if d.expired(response) {
+				log.Warn().Str("operation_id", response.GetOperationId()).Msg("dropping expired operation response")
+				d.journal.RemoveResponse(response)
+				d.forget(response)
+				pending = pending[1:]
+				continue
+			}
+
+			if d.sendResponse(response) {
+				pending = pending[1:]
+				if retry != nil {
+					retry.Reset()
+				}
+				continue
+			}
+
+			if retry == nil {
+				// Stays in the journal, so we try again when
+				// we're restarted
+				d.forget(response)
+				pending = pending[1:]
+				continue
+			}
+
+			delay := retry.Next()
+			log.Debug().Str("operation_id", response.GetOperationId()).Str("delay", delay.String()).Msg("retrying operation response")
+			retryChan = time.After(delay)
+		}
+
 		select {
 		case response, ok := <-d.resQueue:
 			if !ok {
@@ -199,11 +861,9 @@ func (d *Dispatcher) resWorker(ctx context.Context) {
 				d.resQueue = nil
 				break
 			}
-			log.Debug().Str("operation_id", response.GetOperationId()).Msg("sending operation response")
-			_, err := d.client.CallbackAgentOperation(d.client.GetContext(), response)
-			if err != nil {
-				log.Warn().Err(err).Msg("failed sending operation response to edge controller")
-			}
+			pending = d.bufferResponse(pending, response)
+		case <-retryChan:
+			retryChan = nil
 		case <-ctx.Done():
 			break
 		}
@@ -212,12 +872,73 @@ func (d *Dispatcher) resWorker(ctx context.Context) {
 	log.Debug().Msg("operation response worker stopped")
 }
 
+// Add a response to the responses waiting to be sent, dropping the oldest
+// that isn't kept if we have too many.
+func (d *Dispatcher) bufferResponse(pending []*grpc_inventory_manager_go.AgentOpResponse, response *grpc_inventory_manager_go.AgentOpResponse) []*grpc_inventory_manager_go.AgentOpResponse {
+	pending = append(pending, response)
+	if d.retry == nil || d.retry.BufferLen <= 0 {
+		return pending
+	}
+
+	for len(pending) > d.retry.BufferLen {
+		oldest := 0
+		for oldest < len(pending) && d.isKept(pending[oldest]) {
+			oldest++
+		}
+		if oldest == len(pending) {
+			// Only kept responses left
+			break
+		}
+
+		log.Warn().Str("operation_id", pending[oldest].GetOperationId()).Msg("response buffer full, dropping oldest operation response")
+		d.journal.RemoveResponse(pending[oldest])
+		d.forget(pending[oldest])
+		pending = append(pending[:oldest], pending[oldest+1:]...)
+	}
+
+	return pending
+}
+
+// Check if a response is too old to still be sent
+func (d *Dispatcher) expired(response *grpc_inventory_manager_go.AgentOpResponse) bool {
+	if d.retry == nil || d.retry.MaxAge <= 0 || d.isKept(response) {
+		return false
+	}
+
+	return time.Since(time.Unix(response.GetTimestamp(), 0)) > d.retry.MaxAge
+}
+
+func (d *Dispatcher) sendResponse(response *grpc_inventory_manager_go.AgentOpResponse) bool {
+	log.Debug().Str("operation_id", response.GetOperationId()).Msg("sending operation response")
+	_, err := d.client.CallbackAgentOperation(d.client.GetContext(), response)
+	if err != nil {
+		log.Warn().Err(err).Str("operation_id", response.GetOperationId()).Msg("failed sending operation response to edge controller")
+		atomic.AddUint64(&d.failedCallbacks, 1)
+		return false
+	}
+
+	d.journal.RemoveResponse(response)
+	d.forget(response)
+	return true
+}
+
+// The operation worker takes operations from the queue and executes them.
+// Operations for the same plugin are executed one after the other, in the
+// order they were received. Operations for different plugins are executed
+// in parallel, up to the maximum number of concurrent operations.
 func (d *Dispatcher) opWorker(ctx context.Context) {
 	defer d.opWorkerWaitgroup.Done()
 
 	log.Debug().Msg("starting operation worker")
 
-	for ctx.Err() == nil && d.opQueue != nil {
+	// Operations received but not yet started, in order of arrival
+	waiting := []*grpc_inventory_manager_go.AgentOpRequest{}
+	// Plugins currently executing an operation
+	busy := make(map[plugin.PluginName]bool)
+	// Executing operations signal their plugin when done
+	doneChan := make(chan plugin.PluginName)
+
+	for ctx.Err() == nil && (d.opQueue != nil || len(busy) > 0) {
 		select {
 		case op, ok := <-d.opQueue:
 			if !ok {
@@ -225,31 +946,129 @@ func (d *Dispatcher) opWorker(ctx context.Context) {
 				d.opQueue = nil
 				break
 			}
-
-			var pluginName = plugin.PluginName(op.GetPlugin())
-			var opName = plugin.CommandName(op.GetOperation())
-			var params = op.GetParams()
-			var opId = op.GetOperationId()
-
-			log.Debug().
-				Str("operation_id", opId).
-				Str("plugin", pluginName.String()).
-				Str("operation", opName.String()).
-				Interface("params", params).
-				Msg("executing operation request")
-
-			status := grpc_inventory_go.OpStatus_SUCCESS
-			result, derr := d.worker.Execute(ctx, pluginName, opName, params)
-			if derr != nil {
-				log.Warn().Err(derr).Str("operation_id", opId).Msg("failed executing operation")
-				status = grpc_inventory_go.OpStatus_FAIL
-				result = derr.Error()
-			}
-			d.respond(op, status, result)
+			waiting = append(waiting, op)
+		case name := <-doneChan:
+			delete(busy, name)
+		case <-d.wakeChan:
+			// Re-check waiting operations for cancellation or
+			// resume
 		case <-ctx.Done():
 			break
 		}
+
+		waiting = d.startOperations(ctx, waiting, busy, doneChan)
+	}
+
+	// Cancelled - we tell the Edge Controller about the operations we're
+	// not going to execute, and wait for the ones in progress. Those
+	// will finish quickly as they are cancelled as well.
+	for _, op := range waiting {
+		d.respond(op, grpc_inventory_go.OpStatus_FAIL, failedResult(derrors.NewUnavailableError("agent stopped")).Info())
+		d.journal.RemoveRequest(op)
+		d.opCache.Remove(op.GetOperationId())
+		d.untrack(op)
+	}
+	for len(busy) > 0 {
+		delete(busy, <-doneChan)
 	}
 
 	log.Debug().Msg("operation worker stopped")
 }
+
+// Start the oldest waiting operation of each plugin that is not executing
+// anything, as long as we're below the maximum of concurrent operations.
+// Plugins with an operation in a higher priority lane go first. Core
+// operations don't count towards the maximum, so the agent can always be
+// controlled. Cancelled operations are removed. Nothing is started while
+// paused. Returns the operations that are still waiting, in order.
+func (d *Dispatcher) startOperations(ctx context.Context, waiting []*grpc_inventory_manager_go.AgentOpRequest, busy map[plugin.PluginName]bool, doneChan chan<- plugin.PluginName) []*grpc_inventory_manager_go.AgentOpRequest {
+	if ctx.Err() != nil || atomic.LoadInt32(&d.paused) == 1 {
+		return waiting
+	}
+
+	pending := make([]*grpc_inventory_manager_go.AgentOpRequest, 0, len(waiting))
+	for _, op := range waiting {
+		if d.isCancelled(op) {
+			d.finish(op, failedResult(derrors.NewAbortedError(opCancelledMsg)))
+			continue
+		}
+		pending = append(pending, op)
+	}
+
+	started := make(map[*grpc_inventory_manager_go.AgentOpRequest]bool)
+	for _, op := range nextByLane(pending) {
+		name := plugin.PluginName(op.GetPlugin())
+		full := d.maxConcurrent > 0 && len(busy) >= d.maxConcurrent && name != corePlugin
+		if full || busy[name] || !d.startExecuting(name) {
+			continue
+		}
+
+		started[op] = true
+		opCtx, cancel := context.WithCancel(ctx)
+		if d.startTracking(op, cancel) {
+			// Cancelled just now; the next operation for the
+			// plugin can start
+			cancel()
+			d.stopExecuting(name)
+			d.finish(op, failedResult(derrors.NewAbortedError(opCancelledMsg)))
+			d.wake()
+			continue
+		}
+
+		busy[name] = true
+		go d.execute(opCtx, cancel, op, doneChan)
+	}
+
+	remaining := make([]*grpc_inventory_manager_go.AgentOpRequest, 0, len(pending))
+	for _, op := range pending {
+		if !started[op] {
+			remaining = append(remaining, op)
+		}
+	}
+
+	return remaining
+}
+
+func (d *Dispatcher) execute(ctx context.Context, cancel context.CancelFunc, op *grpc_inventory_manager_go.AgentOpRequest, doneChan chan<- plugin.PluginName) {
+	var pluginName = plugin.PluginName(op.GetPlugin())
+	var opName = plugin.CommandName(op.GetOperation())
+	var params = op.GetParams()
+	var opId = op.GetOperationId()
+
+	defer func() {
+		cancel()
+		d.stopExecuting(pluginName)
+		doneChan <- pluginName
+	}()
+
+	log.Debug().
+		Str("operation_id", opId).
+		Str("plugin", pluginName.String()).
+		Str("operation", opName.String()).
+		Interface("params", agentplugin.RedactParams(pluginName, params)).
+		Msg("executing operation request")
+
+	// Plugin commands can report progress through the context
+	progress := newProgressReporter(d, op)
+	ctx = agentplugin.WithProgress(ctx, progress.report)
+
+	output, derr := d.worker.Execute(ctx, pluginName, opName, params)
+	progress.finish()
+	// An operation that completed anyway did not fail
+	if derr != nil && d.isCancelled(op) {
+		log.Info().Str("operation_id", opId).Msg("operation cancelled")
+		derr = derrors.NewAbortedError(opCancelledMsg, derr)
+	} else if derr != nil {
+		log.Warn().Err(derr).Str("operation_id", opId).Msg("failed executing operation")
+	}
+	d.finish(op, NewOperationResult(output, derr))
+}
+
+// Record and send the final result of an operation
+func (d *Dispatcher) finish(op *grpc_inventory_manager_go.AgentOpRequest, result *OperationResult) {
+	status, info := result.Status(), result.Info()
+	d.opCache.Set(op.GetOperationId(), status, info)
+	d.respond(op, status, info)
+	d.journal.RemoveRequest(op)
+	d.untrack(op)
+}
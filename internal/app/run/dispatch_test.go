@@ -20,9 +20,13 @@ package run
 import (
 	"context"
 	"github.com/nalej/grpc-inventory-go"
+	"sync"
 	"time"
 
 	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
 
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
@@ -30,6 +34,16 @@ import (
 
 var _ = ginkgo.Describe("dispatch", func() {
 
+	var testRetryOptions = &RetryOptions{
+		Policy: backoff.Policy{
+			Initial:    time.Millisecond,
+			Max:        10 * time.Millisecond,
+			Multiplier: 2,
+		},
+		MaxAge:    time.Minute,
+		BufferLen: 10,
+	}
+
 	var testRequest = &grpc_inventory_manager_go.AgentOpRequest{
 		OrganizationId:   "testorg",
 		EdgeControllerId: "testec",
@@ -63,6 +77,337 @@ var _ = ginkgo.Describe("dispatch", func() {
 			gomega.Expect(time.Unix(response.GetTimestamp(), 0)).To(gomega.BeTemporally("~", time.Now(), time.Second))
 			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
 		})
+
+		ginkgo.It("should send progress of executing operations", func() {
+			gomega.Expect(plugin.StartPlugin(testBlockPlugin, nil)).To(gomega.Succeed())
+
+			d := &Dispatcher{
+				worker:   NewWorker(testConfig),
+				opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 1),
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 2),
+			}
+
+			op := newBlockRequest("progressop", 0)
+			op.Params["progress"] = "halfway"
+			d.opQueue <- op
+			close(d.opQueue)
+
+			d.opWorkerWaitgroup.Add(1)
+			d.opWorker(context.Background())
+
+			response := <-d.resQueue
+			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_SCHEDULED))
+			gomega.Expect(response.GetInfo()).To(gomega.MatchJSON(`{"percent":50,"message":"halfway"}`))
+
+			response = <-d.resQueue
+			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
+		})
+
+		ginkgo.It("should execute operations for different plugins in parallel", func() {
+			gomega.Expect(plugin.StartPlugin(testBlockPlugin, nil)).To(gomega.Succeed())
+
+			d := &Dispatcher{
+				worker:   NewWorker(testConfig),
+				opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 2),
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 2),
+			}
+
+			d.opQueue <- newBlockRequest("blockop", time.Minute)
+			d.opQueue <- testRequest
+			close(d.opQueue)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			d.opWorkerWaitgroup.Add(1)
+			go d.opWorker(ctx)
+
+			// Other plugin isn't blocked
+			var response *grpc_inventory_manager_go.AgentOpResponse
+			gomega.Eventually(d.resQueue).Should(gomega.Receive(&response))
+			gomega.Expect(response.GetOperationId()).To(gomega.Equal("testop"))
+			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
+
+			// Blocking operation is interrupted on stop
+			cancel()
+			d.opWorkerWaitgroup.Wait()
+			gomega.Expect(d.resQueue).To(gomega.Receive(&response))
+			gomega.Expect(response.GetOperationId()).To(gomega.Equal("blockop"))
+			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL))
+		})
+
+		ginkgo.It("should execute operations for the same plugin in order", func() {
+			gomega.Expect(plugin.StartPlugin(testBlockPlugin, nil)).To(gomega.Succeed())
+
+			d := &Dispatcher{
+				worker:   NewWorker(testConfig),
+				opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 2),
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 2),
+			}
+
+			d.opQueue <- newBlockRequest("blockop1", 100*time.Millisecond)
+			d.opQueue <- newBlockRequest("blockop2", 0)
+			close(d.opQueue)
+
+			d.opWorkerWaitgroup.Add(1)
+			d.opWorker(context.Background())
+
+			gomega.Expect((<-d.resQueue).GetOperationId()).To(gomega.Equal("blockop1"))
+			gomega.Expect((<-d.resQueue).GetOperationId()).To(gomega.Equal("blockop2"))
+		})
+
+		ginkgo.It("should not execute more than the maximum of concurrent operations", func() {
+			gomega.Expect(plugin.StartPlugin(testBlockPlugin, nil)).To(gomega.Succeed())
+
+			d := &Dispatcher{
+				worker:        NewWorker(testConfig),
+				opQueue:       make(chan *grpc_inventory_manager_go.AgentOpRequest, 2),
+				resQueue:      make(chan *grpc_inventory_manager_go.AgentOpResponse, 2),
+				maxConcurrent: 1,
+			}
+
+			d.opQueue <- newBlockRequest("blockop", time.Minute)
+			d.opQueue <- testRequest
+			close(d.opQueue)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			d.opWorkerWaitgroup.Add(1)
+			go d.opWorker(ctx)
+
+			// Second operation has to wait for first
+			gomega.Consistently(d.resQueue, 100*time.Millisecond).ShouldNot(gomega.Receive())
+
+			// When stopped, first is interrupted and second never runs
+			cancel()
+			d.opWorkerWaitgroup.Wait()
+			responses := map[string]string{}
+			for len(d.resQueue) > 0 {
+				response := <-d.resQueue
+				responses[response.GetOperationId()] = response.GetInfo()
+			}
+			gomega.Expect(responses).To(gomega.HaveLen(2))
+			gomega.Expect(responses["testop"]).To(gomega.ContainSubstring("stopped"))
+		})
+	})
+
+	ginkgo.It("should not start operations while paused", func() {
+		d := &Dispatcher{
+			worker:   NewWorker(testConfig),
+			opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 1),
+			resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 2),
+			wakeChan: make(chan struct{}, 1),
+		}
+		d.Pause()
+
+		d.opQueue <- testRequest
+
+		ctx, cancel := context.WithCancel(context.Background())
+		d.opWorkerWaitgroup.Add(1)
+		go d.opWorker(ctx)
+
+		gomega.Consistently(d.resQueue, 100*time.Millisecond).ShouldNot(gomega.Receive())
+
+		d.Resume()
+		gomega.Eventually(d.resQueue).Should(gomega.Receive())
+
+		cancel()
+		d.opWorkerWaitgroup.Wait()
+	})
+
+	ginkgo.Context("lanes", func() {
+		newPriorityRequest := func(id string, priority string) *grpc_inventory_manager_go.AgentOpRequest {
+			op := newBlockRequest(id, 0)
+			op.Params[priorityParam] = priority
+			return op
+		}
+
+		ginkgo.It("should start operations in higher priority lanes first", func() {
+			gomega.Expect(plugin.StartPlugin(testBlockPlugin, nil)).To(gomega.Succeed())
+
+			d := &Dispatcher{
+				worker:        NewWorker(testConfig),
+				resQueue:      make(chan *grpc_inventory_manager_go.AgentOpResponse, 1),
+				maxConcurrent: 1,
+			}
+
+			lowOp := newPriorityRequest("lowop", "low")
+			lowOp.Plugin = testPlugin
+			normalOp := newPriorityRequest("normalop", "normal")
+			normalOp.Plugin = testPlugin
+			highOp := newPriorityRequest("highop", "high")
+
+			doneChan := make(chan plugin.PluginName, 1)
+			waiting := []*grpc_inventory_manager_go.AgentOpRequest{lowOp, normalOp, highOp}
+			waiting = d.startOperations(context.Background(), waiting, map[plugin.PluginName]bool{}, doneChan)
+			<-doneChan
+
+			gomega.Expect((<-d.resQueue).GetOperationId()).To(gomega.Equal("highop"))
+			gomega.Expect(waiting).To(gomega.Equal([]*grpc_inventory_manager_go.AgentOpRequest{lowOp, normalOp}))
+		})
+
+		ginkgo.It("should start operations for the same plugin in order of arrival", func() {
+			gomega.Expect(plugin.StartPlugin(testBlockPlugin, nil)).To(gomega.Succeed())
+
+			d := &Dispatcher{
+				worker:   NewWorker(testConfig),
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 1),
+			}
+
+			lowOp := newPriorityRequest("lowop", "low")
+			highOp := newPriorityRequest("highop", "high")
+
+			doneChan := make(chan plugin.PluginName, 1)
+			waiting := []*grpc_inventory_manager_go.AgentOpRequest{lowOp, highOp}
+			waiting = d.startOperations(context.Background(), waiting, map[plugin.PluginName]bool{}, doneChan)
+			<-doneChan
+
+			gomega.Expect((<-d.resQueue).GetOperationId()).To(gomega.Equal("lowop"))
+			gomega.Expect(waiting).To(gomega.Equal([]*grpc_inventory_manager_go.AgentOpRequest{highOp}))
+		})
+
+		ginkgo.It("should put core operations in the control lane", func() {
+			op := &grpc_inventory_manager_go.AgentOpRequest{
+				Plugin: "core",
+				Params: map[string]string{
+					priorityParam: "low",
+				},
+			}
+			gomega.Expect(operationLane(op)).To(gomega.Equal(LaneControl))
+		})
+
+		ginkgo.It("should not accept operations when their lane is full", func() {
+			d := &Dispatcher{
+				opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 10),
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 10),
+				laneLen: map[Lane]int{
+					LaneLow: 1,
+				},
+			}
+
+			gomega.Expect(d.Dispatch(newPriorityRequest("lowop1", "low"))).To(gomega.Succeed())
+			gomega.Expect(d.Dispatch(newPriorityRequest("lowop2", "low"))).To(gomega.Succeed())
+			gomega.Expect(d.Dispatch(newPriorityRequest("highop", "high"))).To(gomega.Succeed())
+
+			gomega.Expect((<-d.resQueue).GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_SCHEDULED))
+			response := <-d.resQueue
+			gomega.Expect(response.GetOperationId()).To(gomega.Equal("lowop2"))
+			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL))
+			gomega.Expect(response.GetInfo()).To(gomega.ContainSubstring("full (low lane)"))
+			gomega.Expect((<-d.resQueue).GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_SCHEDULED))
+		})
+
+		ginkgo.It("should not accept operations with an invalid priority", func() {
+			d := &Dispatcher{
+				opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 1),
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 1),
+			}
+
+			gomega.Expect(d.Dispatch(newPriorityRequest("op", "urgent"))).To(gomega.Succeed())
+			gomega.Expect(d.opQueue).To(gomega.BeEmpty())
+
+			response := <-d.resQueue
+			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL))
+			gomega.Expect(response.GetInfo()).To(gomega.ContainSubstring("priority"))
+		})
+	})
+
+	ginkgo.It("should hold a plugin until its operation finishes", func() {
+		gomega.Expect(plugin.StartPlugin(testBlockPlugin, nil)).To(gomega.Succeed())
+
+		d := &Dispatcher{
+			worker:   NewWorker(testConfig),
+			resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 2),
+		}
+
+		doneChan := make(chan plugin.PluginName, 2)
+		busy := map[plugin.PluginName]bool{}
+		waiting := d.startOperations(context.Background(), []*grpc_inventory_manager_go.AgentOpRequest{newBlockRequest("firstop", 100*time.Millisecond)}, busy, doneChan)
+		gomega.Expect(waiting).To(gomega.BeEmpty())
+
+		// Waits for the executing operation
+		gomega.Expect(d.Hold(testBlockPlugin, 0)).ToNot(gomega.Succeed())
+		d.Release(testBlockPlugin)
+		gomega.Expect(d.Hold(testBlockPlugin, time.Second)).To(gomega.Succeed())
+		gomega.Expect((<-d.resQueue).GetOperationId()).To(gomega.Equal("firstop"))
+		delete(busy, <-doneChan)
+
+		// Nothing starts while held
+		waiting = d.startOperations(context.Background(), []*grpc_inventory_manager_go.AgentOpRequest{newBlockRequest("secondop", 0)}, busy, doneChan)
+		gomega.Expect(waiting).To(gomega.HaveLen(1))
+
+		d.Release(testBlockPlugin)
+		waiting = d.startOperations(context.Background(), waiting, busy, doneChan)
+		gomega.Expect(waiting).To(gomega.BeEmpty())
+		gomega.Expect((<-d.resQueue).GetOperationId()).To(gomega.Equal("secondop"))
+		<-doneChan
+	})
+
+	ginkgo.Context("Cancel", func() {
+		var d *Dispatcher
+		var cancel context.CancelFunc
+
+		ginkgo.BeforeEach(func() {
+			gomega.Expect(plugin.StartPlugin(testBlockPlugin, nil)).To(gomega.Succeed())
+
+			d = &Dispatcher{
+				worker:   NewWorker(testConfig),
+				opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 2),
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 4),
+				wakeChan: make(chan struct{}, 1),
+			}
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			d.opWorkerWaitgroup.Add(1)
+			go d.opWorker(ctx)
+		})
+
+		ginkgo.AfterEach(func() {
+			cancel()
+			d.opWorkerWaitgroup.Wait()
+		})
+
+		// Skip responses until we get the final one for an operation
+		finalResponse := func(id string) *grpc_inventory_manager_go.AgentOpResponse {
+			for {
+				var response *grpc_inventory_manager_go.AgentOpResponse
+				gomega.Eventually(d.resQueue).Should(gomega.Receive(&response))
+				if response.GetOperationId() == id && response.GetStatus() != grpc_inventory_go.OpStatus_SCHEDULED {
+					return response
+				}
+			}
+		}
+
+		ginkgo.It("should cancel executing operations", func() {
+			gomega.Expect(d.Dispatch(newBlockRequest("blockop", time.Minute))).To(gomega.Succeed())
+
+			// Wait until executing
+			gomega.Eventually(func() bool {
+				d.opsLock.Lock()
+				defer d.opsLock.Unlock()
+				return d.ops["blockop"].cancel != nil
+			}).Should(gomega.BeTrue())
+
+			gomega.Expect(d.Cancel("blockop")).To(gomega.Succeed())
+
+			response := finalResponse("blockop")
+			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL))
+			gomega.Expect(response.GetInfo()).To(gomega.ContainSubstring(`"code":"Aborted"`))
+		})
+
+		ginkgo.It("should cancel waiting operations", func() {
+			gomega.Expect(d.Dispatch(newBlockRequest("blockop1", time.Minute))).To(gomega.Succeed())
+			gomega.Expect(d.Dispatch(newBlockRequest("blockop2", 0))).To(gomega.Succeed())
+
+			gomega.Expect(d.Cancel("blockop2")).To(gomega.Succeed())
+
+			// Removed while first operation is still executing
+			response := finalResponse("blockop2")
+			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL))
+			gomega.Expect(response.GetInfo()).To(gomega.ContainSubstring(`"code":"Aborted"`))
+		})
+
+		ginkgo.It("should not cancel unknown operations", func() {
+			gomega.Expect(d.Cancel("unknownop")).NotTo(gomega.Succeed())
+		})
 	})
 
 	ginkgo.Context("resWorker", func() {
@@ -83,10 +428,158 @@ var _ = ginkgo.Describe("dispatch", func() {
 			gomega.Expect(len(d.resQueue)).To(gomega.BeZero())
 			gomega.Expect(testHandler.GetNumCallbacks()).To(gomega.Equal(cur + 1))
 		})
+
+		ginkgo.It("should retry responses that failed to send", func() {
+			d := &Dispatcher{
+				client:   testClient,
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 2),
+				retry:    testRetryOptions,
+			}
+
+			d.respond(testRequest, grpc_inventory_go.OpStatus_SCHEDULED, "")
+			d.respond(testRequest, grpc_inventory_go.OpStatus_SUCCESS, "")
+			close(d.resQueue)
+
+			cur := testHandler.GetNumCallbacks()
+			testHandler.FailCallbacks(3)
+			d.resWorkerWaitgroup.Add(1)
+			d.resWorker(context.Background())
+
+			// Both responses eventually made it
+			gomega.Expect(testHandler.GetNumCallbacks()).To(gomega.Equal(cur + 2))
+		})
+
+		ginkgo.It("should not retry without a retry policy", func() {
+			d := &Dispatcher{
+				client:   testClient,
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 1),
+			}
+
+			d.respond(testRequest, grpc_inventory_go.OpStatus_SUCCESS, "")
+			close(d.resQueue)
+
+			cur := testHandler.GetNumCallbacks()
+			testHandler.FailCallbacks(1)
+			d.resWorkerWaitgroup.Add(1)
+			d.resWorker(context.Background())
+
+			gomega.Expect(testHandler.GetNumCallbacks()).To(gomega.Equal(cur))
+		})
+
+		ginkgo.It("should drop responses that are too old", func() {
+			d := &Dispatcher{
+				client:   testClient,
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 1),
+				retry:    testRetryOptions,
+			}
+
+			d.resQueue <- &grpc_inventory_manager_go.AgentOpResponse{
+				OperationId: "testop",
+				Timestamp:   time.Now().Add(-2 * testRetryOptions.MaxAge).Unix(),
+				Status:      grpc_inventory_go.OpStatus_SUCCESS,
+			}
+			close(d.resQueue)
+
+			cur := testHandler.GetNumCallbacks()
+			d.resWorkerWaitgroup.Add(1)
+			d.resWorker(context.Background())
+
+			gomega.Expect(testHandler.GetNumCallbacks()).To(gomega.Equal(cur))
+		})
+
+		ginkgo.It("should keep results of scheduled operations until delivered", func() {
+			d := &Dispatcher{
+				client:   testClient,
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 2),
+				retry:    testRetryOptions,
+			}
+
+			// The Edge Controller comes back when both responses
+			// are older than the maximum age
+			timestamp := time.Now().Add(-2 * testRetryOptions.MaxAge).Unix()
+			d.queueResponse(&grpc_inventory_manager_go.AgentOpResponse{
+				OperationId: "testop",
+				Timestamp:   timestamp,
+				Status:      grpc_inventory_go.OpStatus_SUCCESS,
+			}, false)
+			d.queueResponse(&grpc_inventory_manager_go.AgentOpResponse{
+				OperationId: "testscheduledop",
+				Timestamp:   timestamp,
+				Status:      grpc_inventory_go.OpStatus_SUCCESS,
+			}, true)
+			close(d.resQueue)
+
+			cur := testHandler.GetNumCallbacks()
+			testHandler.FailCallbacks(3)
+			d.resWorkerWaitgroup.Add(1)
+			d.resWorker(context.Background())
+
+			// Only the result of the scheduled operation is sent
+			gomega.Expect(testHandler.GetNumCallbacks()).To(gomega.Equal(cur + 1))
+			gomega.Expect(d.kept).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should stop retrying when cancelled", func() {
+			d := &Dispatcher{
+				client:   testClient,
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 1),
+				retry:    testRetryOptions,
+			}
+
+			d.respond(testRequest, grpc_inventory_go.OpStatus_SUCCESS, "")
+			close(d.resQueue)
+
+			testHandler.FailCallbacks(1000)
+			defer testHandler.FailCallbacks(0)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			d.resWorkerWaitgroup.Add(1)
+			d.resWorker(ctx)
+
+			gomega.Expect(ctx.Err()).To(gomega.HaveOccurred())
+		})
+
+		ginkgo.It("should drop the oldest responses when the buffer is full", func() {
+			d := &Dispatcher{
+				retry: &RetryOptions{
+					BufferLen: 2,
+				},
+			}
+
+			pending := []*grpc_inventory_manager_go.AgentOpResponse{}
+			for _, id := range []string{"op1", "op2", "op3"} {
+				pending = d.bufferResponse(pending, &grpc_inventory_manager_go.AgentOpResponse{OperationId: id})
+			}
+
+			gomega.Expect(pending).To(gomega.HaveLen(2))
+			gomega.Expect(pending[0].GetOperationId()).To(gomega.Equal("op2"))
+			gomega.Expect(pending[1].GetOperationId()).To(gomega.Equal("op3"))
+		})
+
+		ginkgo.It("should not drop results of scheduled operations when the buffer is full", func() {
+			d := &Dispatcher{
+				retry: &RetryOptions{
+					BufferLen: 2,
+				},
+			}
+
+			scheduled := &grpc_inventory_manager_go.AgentOpResponse{OperationId: "scheduledop"}
+			d.keep(scheduled)
+
+			pending := d.bufferResponse(nil, scheduled)
+			for _, id := range []string{"op1", "op2"} {
+				pending = d.bufferResponse(pending, &grpc_inventory_manager_go.AgentOpResponse{OperationId: id})
+			}
+
+			gomega.Expect(pending).To(gomega.HaveLen(2))
+			gomega.Expect(pending[0].GetOperationId()).To(gomega.Equal("scheduledop"))
+			gomega.Expect(pending[1].GetOperationId()).To(gomega.Equal("op2"))
+		})
 	})
 
 	ginkgo.It("should dispatch operations", func() {
-		d, derr := NewDispatcher(testClient, NewWorker(testConfig), 10)
+		d, derr := NewDispatcher(testClient, NewWorker(testConfig), &DispatcherOptions{QueueLen: 10})
 		gomega.Expect(derr).To(gomega.Succeed())
 
 		cur := testHandler.GetNumCallbacks()
@@ -121,6 +614,28 @@ var _ = ginkgo.Describe("dispatch", func() {
 		gomega.Expect(response.GetInfo()).To(gomega.ContainSubstring("stopped"))
 	})
 
+	ginkgo.It("should queue an operation received twice at the same time once", func() {
+		d := &Dispatcher{
+			opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 10),
+			resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 10),
+		}
+
+		// Like an operation received on the stream and in a heartbeat
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer ginkgo.GinkgoRecover()
+				defer wg.Done()
+				gomega.Expect(d.Dispatch(testRequest)).To(gomega.Succeed())
+			}()
+		}
+		wg.Wait()
+
+		gomega.Expect(d.opQueue).To(gomega.HaveLen(1))
+		gomega.Expect(d.Status().Queued).To(gomega.Equal(1))
+	})
+
 	ginkgo.It("should not accept operations when the queue is full", func() {
 		d := &Dispatcher{
 			opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 0),
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Plugin health based on heartbeat errors
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+type PluginHealth int
+
+const (
+	PluginHealthy PluginHealth = iota
+	PluginDegraded
+	PluginFailing
+)
+
+var pluginHealthNames = map[PluginHealth]string{
+	PluginHealthy:  "healthy",
+	PluginDegraded: "degraded",
+	PluginFailing:  "failing",
+}
+
+func (h PluginHealth) String() string {
+	return pluginHealthNames[h]
+}
+
+// Name of the metric reporting plugin health to the Edge Controller
+const pluginHealthMetric = "agent_plugin_health"
+
+// Health of the running plugins, based on the number of consecutive
+// heartbeats in which they returned an error or timed out. A plugin is
+// degraded after its first error and failing when errors persist; it is
+// healthy again after the first heartbeat without error. If a critical
+// plugin is failing, the agent is no longer considered alive, so the
+// service manager can restart it.
+//
+// All methods can be called on a nil healthTracker, in which case all
+// plugins are healthy.
+type healthTracker struct {
+	// Consecutive errors before a plugin is failing
+	failingAfter int
+	// Plugins the agent can't do without
+	critical map[plugin.PluginName]bool
+
+	lock sync.Mutex
+	// Consecutive errors, for plugins that are not healthy
+	errors map[plugin.PluginName]int
+}
+
+func newHealthTracker(failingAfter int, critical []string) *healthTracker {
+	h := &healthTracker{
+		failingAfter: failingAfter,
+		critical:     make(map[plugin.PluginName]bool, len(critical)),
+		errors:       make(map[plugin.PluginName]int),
+	}
+
+	for _, name := range critical {
+		h.critical[plugin.PluginName(name)] = true
+	}
+
+	return h
+}
+
+// Update health with the errors from the latest heartbeat; plugins
+// without an error are healthy.
+func (h *healthTracker) Update(errs map[plugin.PluginName]derrors.Error) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for name := range h.errors {
+		if _, found := errs[name]; !found {
+			log.Info().Str("plugin", name.String()).Msg("plugin healthy again")
+			delete(h.errors, name)
+		}
+	}
+
+	for name := range errs {
+		before := h.healthLocked(name)
+		h.errors[name]++
+		after := h.healthLocked(name)
+		if after != before {
+			log.Warn().Str("plugin", name.String()).Str("health", after.String()).
+				Int("errors", h.errors[name]).Msg("plugin health changed")
+		}
+	}
+}
+
+func (h *healthTracker) Health(name plugin.PluginName) PluginHealth {
+	if h == nil {
+		return PluginHealthy
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.healthLocked(name)
+}
+
+// Failed returns the critical plugins that are failing
+func (h *healthTracker) Failed() []plugin.PluginName {
+	if h == nil {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	failed := []plugin.PluginName{}
+	for name := range h.critical {
+		if h.healthLocked(name) == PluginFailing {
+			failed = append(failed, name)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i] < failed[j]
+	})
+
+	return failed
+}
+
+// Heartbeat data reporting the health of the running plugins to the Edge
+// Controller, as metric with the plugin and health as tags.
+func (h *healthTracker) HeartbeatData(running []plugin.PluginName) agentplugin.PluginHeartbeatData {
+	if h == nil || len(running) == 0 {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	data := &metrics.MetricsData{
+		Timestamp: time.Now(),
+		Metrics:   make([]*metrics.Metric, 0, len(running)),
+	}
+	for _, name := range running {
+		health := h.healthLocked(name)
+		metric := &metrics.Metric{
+			Name: pluginHealthMetric,
+			Tags: map[string]string{
+				"plugin": name.String(),
+				"health": health.String(),
+			},
+			Fields: map[string]uint64{
+				"health": uint64(health),
+				"errors": uint64(h.errors[name]),
+			},
+		}
+		data.Metrics = append(data.Metrics, metric)
+	}
+
+	return data
+}
+
+func (h *healthTracker) healthLocked(name plugin.PluginName) PluginHealth {
+	count := h.errors[name]
+	switch {
+	case count == 0:
+		return PluginHealthy
+	case count < h.failingAfter:
+		return PluginDegraded
+	default:
+		return PluginFailing
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin/metrics"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("plugin health", func() {
+	var errs = map[plugin.PluginName]derrors.Error{
+		"critical": derrors.NewDeadlineExceededError("plugin beat timed out"),
+		"other":    derrors.NewInternalError("plugin error"),
+	}
+
+	ginkgo.It("should become degraded and failing with consecutive errors", func() {
+		h := newHealthTracker(3, nil)
+		gomega.Expect(h.Health("other")).To(gomega.Equal(PluginHealthy))
+
+		h.Update(errs)
+		gomega.Expect(h.Health("other")).To(gomega.Equal(PluginDegraded))
+		h.Update(errs)
+		gomega.Expect(h.Health("other")).To(gomega.Equal(PluginDegraded))
+		h.Update(errs)
+		gomega.Expect(h.Health("other")).To(gomega.Equal(PluginFailing))
+	})
+
+	ginkgo.It("should become healthy after a heartbeat without error", func() {
+		h := newHealthTracker(1, nil)
+
+		h.Update(errs)
+		gomega.Expect(h.Health("other")).To(gomega.Equal(PluginFailing))
+
+		h.Update(map[plugin.PluginName]derrors.Error{"critical": errs["critical"]})
+		gomega.Expect(h.Health("other")).To(gomega.Equal(PluginHealthy))
+		gomega.Expect(h.Health("critical")).To(gomega.Equal(PluginFailing))
+	})
+
+	ginkgo.It("should only report failing critical plugins", func() {
+		h := newHealthTracker(2, []string{"critical", "missing"})
+
+		h.Update(errs)
+		gomega.Expect(h.Failed()).To(gomega.BeEmpty())
+
+		h.Update(errs)
+		gomega.Expect(h.Failed()).To(gomega.ConsistOf(plugin.PluginName("critical")))
+	})
+
+	ginkgo.It("should create heartbeat data for running plugins", func() {
+		h := newHealthTracker(3, nil)
+		h.Update(errs)
+
+		data := h.HeartbeatData([]plugin.PluginName{"healthy", "other"})
+		gomega.Expect(data).To(gomega.BeAssignableToTypeOf(&metrics.MetricsData{}))
+
+		metricsData := data.(*metrics.MetricsData)
+		gomega.Expect(metricsData.Metrics).To(gomega.HaveLen(2))
+		gomega.Expect(metricsData.Metrics[0].Tags).To(gomega.Equal(map[string]string{
+			"plugin": "healthy",
+			"health": "healthy",
+		}))
+		gomega.Expect(metricsData.Metrics[1].Tags).To(gomega.Equal(map[string]string{
+			"plugin": "other",
+			"health": "degraded",
+		}))
+		gomega.Expect(metricsData.Metrics[1].Fields).To(gomega.Equal(map[string]uint64{
+			"health": uint64(PluginDegraded),
+			"errors": 1,
+		}))
+	})
+
+	ginkgo.It("should consider all plugins healthy when nil", func() {
+		var h *healthTracker
+		h.Update(errs)
+		gomega.Expect(h.Health("other")).To(gomega.Equal(PluginHealthy))
+		gomega.Expect(h.Failed()).To(gomega.BeEmpty())
+		gomega.Expect(h.HeartbeatData([]plugin.PluginName{"other"})).To(gomega.BeNil())
+	})
+})
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Heartbeat interval
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The heartbeat interval in effect. It starts out as configured, and the
+// Edge Controller can change it within the configured bounds, for example
+// to hear from us more often while it has operations for us. Each
+// heartbeat is randomly moved a bit, so agents that started at the same
+// time don't all send their heartbeat at the same time.
+type heartbeatInterval struct {
+	// Protects everything below; the configuration can be reloaded
+	lock sync.Mutex
+
+	configured time.Duration
+	// Bounds for the interval set by the Edge Controller; no bound if zero
+	min, max time.Duration
+	// Fraction of the interval randomly added or subtracted
+	jitter float64
+
+	current time.Duration
+
+	// Signals the interval changed
+	changeChan chan struct{}
+}
+
+func newHeartbeatInterval(configured, min, max time.Duration, jitter float64) *heartbeatInterval {
+	return &heartbeatInterval{
+		configured: configured,
+		min:        min,
+		max:        max,
+		jitter:     jitter,
+		current:    configured,
+		changeChan: make(chan struct{}, 1),
+	}
+}
+
+func (h *heartbeatInterval) Get() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.current
+}
+
+// Set a new interval, limited to the bounds, or go back to the configured
+// interval if zero. Returns the interval in effect. Only signals a change
+// if the interval in effect is different, as the Edge Controller can
+// request the same interval with every heartbeat.
+func (h *heartbeatInterval) Set(interval time.Duration) time.Duration {
+	h.lock.Lock()
+	if interval <= 0 {
+		interval = h.configured
+	}
+	if h.min > 0 && interval < h.min {
+		interval = h.min
+	}
+	if h.max > 0 && interval > h.max {
+		interval = h.max
+	}
+	changed := h.current != interval
+	h.current = interval
+	h.lock.Unlock()
+
+	if changed {
+		h.changed()
+	}
+
+	return interval
+}
+
+// Configure a new interval and bounds, which replaces any interval set by
+// the Edge Controller. Returns false if nothing changed.
+func (h *heartbeatInterval) Configure(configured, min, max time.Duration, jitter float64) bool {
+	h.lock.Lock()
+	if h.configured == configured && h.min == min && h.max == max && h.jitter == jitter {
+		h.lock.Unlock()
+		return false
+	}
+	h.configured, h.min, h.max, h.jitter = configured, min, max, jitter
+	h.current = configured
+	h.lock.Unlock()
+
+	h.changed()
+
+	return true
+}
+
+func (h *heartbeatInterval) changed() {
+	select {
+	case h.changeChan <- struct{}{}:
+	default:
+	}
+}
+
+// Delay until the next heartbeat
+func (h *heartbeatInterval) Next() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delta := float64(h.current) * h.jitter * (2*rand.Float64() - 1)
+
+	return h.current + time.Duration(delta)
+}
+
+// Longest possible delay until the next heartbeat
+func (h *heartbeatInterval) MaxDelay() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.current + time.Duration(float64(h.current)*h.jitter)
+}
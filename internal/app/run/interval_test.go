@@ -0,0 +1,84 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("heartbeat interval", func() {
+	ginkgo.It("should limit interval to bounds", func() {
+		h := newHeartbeatInterval(30*time.Second, 5*time.Second, time.Minute, 0)
+		gomega.Expect(h.Get()).To(gomega.Equal(30 * time.Second))
+
+		gomega.Expect(h.Set(time.Second)).To(gomega.Equal(5 * time.Second))
+		gomega.Expect(h.Set(time.Hour)).To(gomega.Equal(time.Minute))
+		gomega.Expect(h.Set(10 * time.Second)).To(gomega.Equal(10 * time.Second))
+		gomega.Expect(h.Get()).To(gomega.Equal(10 * time.Second))
+	})
+
+	ginkgo.It("should go back to configured interval", func() {
+		h := newHeartbeatInterval(30*time.Second, 0, 0, 0)
+		h.Set(time.Second)
+		gomega.Expect(h.Set(0)).To(gomega.Equal(30 * time.Second))
+	})
+
+	ginkgo.It("should signal changes", func() {
+		h := newHeartbeatInterval(30*time.Second, 0, 0, 0)
+		h.Set(time.Second)
+		h.Set(2 * time.Second)
+		gomega.Expect(h.changeChan).To(gomega.Receive())
+		gomega.Expect(h.changeChan).ToNot(gomega.Receive())
+
+		// Same interval is no change
+		h.Set(2 * time.Second)
+		gomega.Expect(h.changeChan).ToNot(gomega.Receive())
+	})
+
+	ginkgo.It("should reconfigure interval", func() {
+		h := newHeartbeatInterval(30*time.Second, 0, 0, 0)
+		h.Set(time.Second)
+		<-h.changeChan
+
+		gomega.Expect(h.Configure(30*time.Second, 0, 0, 0)).To(gomega.BeFalse())
+		gomega.Expect(h.changeChan).ToNot(gomega.Receive())
+		gomega.Expect(h.Get()).To(gomega.Equal(time.Second))
+
+		gomega.Expect(h.Configure(time.Minute, 10*time.Second, 0, 0)).To(gomega.BeTrue())
+		gomega.Expect(h.changeChan).To(gomega.Receive())
+		gomega.Expect(h.Get()).To(gomega.Equal(time.Minute))
+		gomega.Expect(h.Set(time.Second)).To(gomega.Equal(10 * time.Second))
+	})
+
+	ginkgo.It("should add jitter", func() {
+		h := newHeartbeatInterval(10*time.Second, 0, 0, 0.2)
+		gomega.Expect(h.MaxDelay()).To(gomega.Equal(12 * time.Second))
+
+		delays := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			delay := h.Next()
+			gomega.Expect(delay).To(gomega.BeNumerically(">=", 8*time.Second))
+			gomega.Expect(delay).To(gomega.BeNumerically("<=", 12*time.Second))
+			delays[delay] = true
+		}
+		gomega.Expect(len(delays)).To(gomega.BeNumerically(">", 1))
+	})
+})
@@ -0,0 +1,308 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Persistent journal for operation requests and responses
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+	"github.com/nalej/service-net-agent/internal/pkg/config"
+	"github.com/nalej/service-net-agent/internal/pkg/filequeue"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	journalRequestExt  = ".request"
+	journalResponseExt = ".response"
+	// Runs of scheduled operations and their results, which are kept
+	// until delivered
+	journalRunRequestExt  = ".run-request"
+	journalRunResponseExt = ".run-response"
+)
+
+// Journal is a write-ahead log of the operations the dispatcher has
+// accepted but not yet executed, and the responses it has not yet been
+// able to deliver to the Edge Controller. Entries are kept in a file
+// queue, so that we can replay them in the order they were added. Entries
+// are removed when the operation has been executed or the response has
+// been delivered; whatever is left when the agent starts has been lost by
+// a restart and is handed back to the dispatcher.
+//
+// Secret operation parameters are encrypted with the secret store; without
+// one, operations with secret parameters are not journaled.
+//
+// All methods can be called on a nil Journal, in which case nothing is
+// persisted.
+type Journal struct {
+	queue   *filequeue.Queue
+	secrets *config.SecretStore
+
+	// Protects entry maps
+	lock sync.Mutex
+
+	// Files for queued requests, by operation id
+	requests map[string]string
+	// Files for queued responses
+	responses map[*grpc_inventory_manager_go.AgentOpResponse]string
+}
+
+func NewJournal(path string, secrets *config.SecretStore) (*Journal, derrors.Error) {
+	// Operation parameters and responses might contain sensitive
+	// information; the queue is only readable by the agent user
+	queue, derr := filequeue.Open(path)
+	if derr != nil {
+		return nil, derr
+	}
+
+	j := &Journal{
+		queue:     queue,
+		secrets:   secrets,
+		requests:  make(map[string]string),
+		responses: make(map[*grpc_inventory_manager_go.AgentOpResponse]string),
+	}
+
+	return j, nil
+}
+
+// Pending returns the requests and responses left in the journal, in the
+// order they were added. Returned entries are tracked as if they were
+// just added, so they can be removed when dealt with.
+func (j *Journal) Pending() ([]*grpc_inventory_manager_go.AgentOpRequest, []*grpc_inventory_manager_go.AgentOpResponse, derrors.Error) {
+	if j == nil {
+		return nil, nil, nil
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entries, derr := j.queue.Entries()
+	if derr != nil {
+		return nil, nil, derr
+	}
+
+	requests := []*grpc_inventory_manager_go.AgentOpRequest{}
+	responses := []*grpc_inventory_manager_go.AgentOpResponse{}
+	for _, entry := range entries {
+		file := entry.Name
+		data, derr := j.queue.Read(file)
+		if derr != nil {
+			return nil, nil, derr
+		}
+
+		var err error
+		switch filepath.Ext(file) {
+		case journalRequestExt, journalRunRequestExt:
+			request := &grpc_inventory_manager_go.AgentOpRequest{}
+			err = proto.Unmarshal(data, request)
+			if err == nil {
+				err = j.openRequest(request)
+			}
+			if err == nil {
+				requests = append(requests, request)
+				j.requests[request.GetOperationId()] = file
+			}
+		case journalResponseExt, journalRunResponseExt:
+			response := &grpc_inventory_manager_go.AgentOpResponse{}
+			err = proto.Unmarshal(data, response)
+			if err == nil {
+				responses = append(responses, response)
+				j.responses[response] = file
+			}
+		}
+
+		// A corrupt entry is not going to get better; we skip it
+		// so it doesn't block the rest of the journal
+		if err != nil {
+			log.Warn().Err(err).Str("file", file).Msg("removing corrupt journal entry")
+			j.queue.Remove(file)
+		}
+	}
+
+	return requests, responses, nil
+}
+
+func (j *Journal) AddRequest(op *grpc_inventory_manager_go.AgentOpRequest) derrors.Error {
+	return j.addRequest(op, journalRequestExt)
+}
+
+// AddRunRequest adds a run of a scheduled operation
+func (j *Journal) AddRunRequest(op *grpc_inventory_manager_go.AgentOpRequest) derrors.Error {
+	return j.addRequest(op, journalRunRequestExt)
+}
+
+func (j *Journal) addRequest(op *grpc_inventory_manager_go.AgentOpRequest, ext string) derrors.Error {
+	if j == nil {
+		return nil
+	}
+
+	sealed, derr := j.sealRequest(op)
+	if derr != nil {
+		return derr
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	file, derr := j.writeEntry(sealed, ext)
+	if derr != nil {
+		return derr
+	}
+
+	// An operation that is sent again replaces the earlier entry
+	if existing, found := j.requests[op.GetOperationId()]; found {
+		j.queue.Remove(existing)
+	}
+	j.requests[op.GetOperationId()] = file
+
+	return nil
+}
+
+func (j *Journal) RemoveRequest(op *grpc_inventory_manager_go.AgentOpRequest) {
+	if j == nil {
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	file, found := j.requests[op.GetOperationId()]
+	if !found {
+		return
+	}
+
+	delete(j.requests, op.GetOperationId())
+	j.queue.Remove(file)
+}
+
+func (j *Journal) AddResponse(response *grpc_inventory_manager_go.AgentOpResponse) derrors.Error {
+	return j.addResponse(response, journalResponseExt)
+}
+
+// AddRunResponse adds the result of a scheduled operation
+func (j *Journal) AddRunResponse(response *grpc_inventory_manager_go.AgentOpResponse) derrors.Error {
+	return j.addResponse(response, journalRunResponseExt)
+}
+
+func (j *Journal) addResponse(response *grpc_inventory_manager_go.AgentOpResponse, ext string) derrors.Error {
+	if j == nil {
+		return nil
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	file, derr := j.writeEntry(response, ext)
+	if derr != nil {
+		return derr
+	}
+	j.responses[response] = file
+
+	return nil
+}
+
+func (j *Journal) RemoveResponse(response *grpc_inventory_manager_go.AgentOpResponse) {
+	if j == nil {
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	file, found := j.responses[response]
+	if !found {
+		return
+	}
+
+	delete(j.responses, response)
+	j.queue.Remove(file)
+}
+
+// IsRunRequest returns whether a pending request is a run of a scheduled
+// operation
+func (j *Journal) IsRunRequest(op *grpc_inventory_manager_go.AgentOpRequest) bool {
+	if j == nil {
+		return false
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return filepath.Ext(j.requests[op.GetOperationId()]) == journalRunRequestExt
+}
+
+// IsRunResponse returns whether a pending response is the result of a
+// scheduled operation
+func (j *Journal) IsRunResponse(response *grpc_inventory_manager_go.AgentOpResponse) bool {
+	if j == nil {
+		return false
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return filepath.Ext(j.responses[response]) == journalRunResponseExt
+}
+
+// Add an entry to the queue; it's written atomically, so we never replay
+// half an entry
+func (j *Journal) writeEntry(msg proto.Message, ext string) (string, derrors.Error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return "", derrors.NewInternalError("failed encoding journal entry", err)
+	}
+
+	entry, derr := j.queue.Add(data, ext)
+	if derr != nil {
+		return "", derr
+	}
+
+	return entry.Name, nil
+}
+
+// Copy of a request with secret parameters encrypted
+func (j *Journal) sealRequest(op *grpc_inventory_manager_go.AgentOpRequest) (*grpc_inventory_manager_go.AgentOpRequest, derrors.Error) {
+	params, derr := agentplugin.SealParams(j.secrets, plugin.PluginName(op.GetPlugin()), op.GetParams())
+	if derr != nil {
+		return nil, derr
+	}
+
+	sealed := proto.Clone(op).(*grpc_inventory_manager_go.AgentOpRequest)
+	sealed.Params = params
+	return sealed, nil
+}
+
+// Decrypt the secret parameters of a request read from the journal
+func (j *Journal) openRequest(op *grpc_inventory_manager_go.AgentOpRequest) error {
+	params, derr := agentplugin.OpenParams(j.secrets, plugin.PluginName(op.GetPlugin()), op.GetParams())
+	if derr != nil {
+		return derr
+	}
+
+	op.Params = params
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("journal", func() {
+
+	var journalPath string
+
+	var testJournalRequest = &grpc_inventory_manager_go.AgentOpRequest{
+		OrganizationId:   "testorg",
+		EdgeControllerId: "testec",
+		AssetId:          "testasset",
+		Plugin:           testPlugin,
+		Operation:        "start",
+		OperationId:      "testjournalop",
+	}
+
+	var testJournalResponse = &grpc_inventory_manager_go.AgentOpResponse{
+		OrganizationId:   "testorg",
+		EdgeControllerId: "testec",
+		AssetId:          "testasset",
+		OperationId:      "testjournalprevop",
+		Status:           grpc_inventory_go.OpStatus_SUCCESS,
+		Info:             "test result",
+	}
+
+	ginkgo.BeforeEach(func() {
+		journalPath = filepath.Join(testPath, "journal")
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(journalPath)
+	})
+
+	ginkgo.It("should return pending entries after restart", func() {
+		j, derr := NewJournal(journalPath, nil)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		gomega.Expect(j.AddResponse(testJournalResponse)).To(gomega.Succeed())
+		gomega.Expect(j.AddRequest(testJournalRequest)).To(gomega.Succeed())
+
+		// Open again, as we would after a restart
+		j2, derr := NewJournal(journalPath, nil)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		requests, responses, derr := j2.Pending()
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(requests).To(gomega.HaveLen(1))
+		gomega.Expect(requests[0].GetOperationId()).To(gomega.Equal("testjournalop"))
+		gomega.Expect(responses).To(gomega.HaveLen(1))
+		gomega.Expect(responses[0].GetOperationId()).To(gomega.Equal("testjournalprevop"))
+		gomega.Expect(responses[0].GetInfo()).To(gomega.Equal("test result"))
+	})
+
+	ginkgo.It("should return runs of scheduled operations after restart", func() {
+		j, derr := NewJournal(journalPath, nil)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		gomega.Expect(j.AddRunResponse(testJournalResponse)).To(gomega.Succeed())
+		gomega.Expect(j.AddRunRequest(testJournalRequest)).To(gomega.Succeed())
+
+		j2, derr := NewJournal(journalPath, nil)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		requests, responses, derr := j2.Pending()
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(requests).To(gomega.HaveLen(1))
+		gomega.Expect(j2.IsRunRequest(requests[0])).To(gomega.BeTrue())
+		gomega.Expect(responses).To(gomega.HaveLen(1))
+		gomega.Expect(j2.IsRunResponse(responses[0])).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should remove entries", func() {
+		j, derr := NewJournal(journalPath, nil)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		gomega.Expect(j.AddResponse(testJournalResponse)).To(gomega.Succeed())
+		gomega.Expect(j.AddRequest(testJournalRequest)).To(gomega.Succeed())
+		j.RemoveResponse(testJournalResponse)
+		j.RemoveRequest(testJournalRequest)
+
+		requests, responses, derr := j.Pending()
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(requests).To(gomega.BeEmpty())
+		gomega.Expect(responses).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should not journal secret parameters without a secret store", func() {
+		j, derr := NewJournal(journalPath, nil)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		op := &grpc_inventory_manager_go.AgentOpRequest{
+			Plugin:      "core",
+			Operation:   "rotate_token",
+			OperationId: "testjournalsecretop",
+			Params:      map[string]string{"token": "secrettoken"},
+		}
+		gomega.Expect(j.AddRequest(op)).ToNot(gomega.Succeed())
+
+		requests, _, derr := j.Pending()
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(requests).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should ignore a nil journal", func() {
+		var j *Journal
+		gomega.Expect(j.AddRequest(testJournalRequest)).To(gomega.Succeed())
+		j.RemoveRequest(testJournalRequest)
+
+		requests, responses, derr := j.Pending()
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(requests).To(gomega.BeEmpty())
+		gomega.Expect(responses).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should replay pending entries in the dispatcher", func() {
+		j, derr := NewJournal(journalPath, nil)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(j.AddResponse(testJournalResponse)).To(gomega.Succeed())
+		gomega.Expect(j.AddRequest(testJournalRequest)).To(gomega.Succeed())
+
+		cur := testHandler.GetNumCallbacks()
+
+		d, derr := NewDispatcher(testClient, NewWorker(testConfig), &DispatcherOptions{QueueLen: 10, Journal: j})
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(d.Stop(time.Second)).To(gomega.Succeed())
+
+		// Two callbacks: the replayed response and the result of the
+		// replayed operation. No new scheduled response.
+		gomega.Expect(testHandler.GetNumCallbacks()).To(gomega.Equal(cur + 2))
+
+		// Everything dealt with
+		requests, responses, derr := j.Pending()
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(requests).To(gomega.BeEmpty())
+		gomega.Expect(responses).To(gomega.BeEmpty())
+	})
+})
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Operation priority lanes
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/grpc-inventory-manager-go"
+)
+
+// Lane is the priority of an operation. Operations in a higher priority
+// lane are started before those in lower priority lanes for other plugins;
+// operations for the same plugin always run in order of arrival. Each lane
+// has its own queue capacity so a full lane doesn't hold up the others.
+type Lane int
+
+const (
+	// Agent control operations, for the core plugin
+	LaneControl Lane = iota
+	LaneHigh
+	LaneNormal
+	LaneLow
+)
+
+// Lanes in order of priority
+var Lanes = []Lane{LaneControl, LaneHigh, LaneNormal, LaneLow}
+
+// Requested priority of an operation: high, normal or low. Operations for
+// the core plugin are always in the control lane.
+const priorityParam = reservedParamPrefix + "priority"
+
+var laneNames = map[Lane]string{
+	LaneControl: "control",
+	LaneHigh:    "high",
+	LaneNormal:  "normal",
+	LaneLow:     "low",
+}
+
+func (l Lane) String() string {
+	return laneNames[l]
+}
+
+// Lane for an operation. An invalid priority returns an error, together
+// with the normal lane.
+func operationLane(op *grpc_inventory_manager_go.AgentOpRequest) (Lane, derrors.Error) {
+	if plugin.PluginName(op.GetPlugin()) == corePlugin {
+		return LaneControl, nil
+	}
+
+	priority, found := op.GetParams()[priorityParam]
+	if !found {
+		return LaneNormal, nil
+	}
+
+	switch strings.ToLower(priority) {
+	case LaneHigh.String():
+		return LaneHigh, nil
+	case LaneNormal.String():
+		return LaneNormal, nil
+	case LaneLow.String():
+		return LaneLow, nil
+	}
+
+	return LaneNormal, derrors.NewInvalidArgumentError("invalid operation priority").WithParams(priority)
+}
+
+// Oldest operation of each plugin, ordered by lane. Operations for the
+// same plugin are executed in order of arrival, so lanes only decide which
+// plugin goes first.
+func nextByLane(ops []*grpc_inventory_manager_go.AgentOpRequest) []*grpc_inventory_manager_go.AgentOpRequest {
+	seen := make(map[plugin.PluginName]bool)
+	next := []*grpc_inventory_manager_go.AgentOpRequest{}
+	lanes := make(map[*grpc_inventory_manager_go.AgentOpRequest]Lane)
+	for _, op := range ops {
+		name := plugin.PluginName(op.GetPlugin())
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		next = append(next, op)
+		lanes[op], _ = operationLane(op)
+	}
+
+	sort.SliceStable(next, func(i, j int) bool {
+		return lanes[next[i]] < lanes[next[j]]
+	})
+
+	return next
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Cache of recently seen operations, to avoid executing operations twice
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/grpc-inventory-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/atomicfile"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Changes are written this long after the first one, so all changes for
+// an operation, or a burst of operations, are written at once
+const opCacheWriteDelay = time.Second
+
+// OperationCache remembers the last status of operations we received, so
+// that when the Edge Controller sends an operation again (for example
+// because it never got our response), we send that status again instead
+// of executing the operation a second time. Entries expire after a while
+// and only a limited number is kept. The cache is written to disk shortly
+// after it changes and when the dispatcher stops, so it survives a
+// restart without a write for every change. Operations still to be
+// executed are in the journal, so a crash only risks sending a result we
+// just sent again.
+//
+// All methods can be called on a nil OperationCache, in which case
+// nothing is remembered.
+type OperationCache struct {
+	file       string
+	ttl        time.Duration
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[string]*operationRecord
+	// Writes pending changes; nil if there are none
+	writeTimer *time.Timer
+}
+
+type operationRecord struct {
+	Status grpc_inventory_go.OpStatus `json:"status"`
+	Info   string                     `json:"info,omitempty"`
+	// Last update
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func NewOperationCache(file string, ttl time.Duration, maxEntries int) (*OperationCache, derrors.Error) {
+	c := &OperationCache{
+		file:       file,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*operationRecord),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, derrors.NewInternalError("failed reading operation cache", err).WithParams(file)
+	}
+
+	// We can do without a cache that's corrupt, there's no reason
+	// to refuse to start.
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &c.entries)
+		if err != nil {
+			log.Warn().Err(err).Str("file", file).Msg("ignoring corrupt operation cache")
+			c.entries = make(map[string]*operationRecord)
+		}
+	}
+
+	c.expireLocked()
+
+	return c, nil
+}
+
+// Get returns the last status of an operation, if we've seen it recently
+func (c *OperationCache) Get(id string) (grpc_inventory_go.OpStatus, string, bool) {
+	if c == nil {
+		return grpc_inventory_go.OpStatus_SCHEDULED, "", false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	record, found := c.entries[id]
+	if !found || c.expired(record) {
+		return grpc_inventory_go.OpStatus_SCHEDULED, "", false
+	}
+
+	return record.Status, record.Info, true
+}
+
+func (c *OperationCache) Set(id string, status grpc_inventory_go.OpStatus, info string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[id] = &operationRecord{
+		Status:    status,
+		Info:      info,
+		Timestamp: time.Now().UTC(),
+	}
+
+	c.expireLocked()
+	c.changedLocked()
+}
+
+// Remove forgets an operation, so it is executed when received again
+func (c *OperationCache) Remove(id string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, found := c.entries[id]; !found {
+		return
+	}
+
+	delete(c.entries, id)
+	c.changedLocked()
+}
+
+// Flush writes pending changes to disk right away
+func (c *OperationCache) Flush() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.writeTimer == nil {
+		return
+	}
+	c.writeTimer.Stop()
+	c.writeTimer = nil
+
+	c.writeLocked()
+}
+
+// Schedule writing the changes, unless that's scheduled already
+func (c *OperationCache) changedLocked() {
+	if c.writeTimer != nil {
+		return
+	}
+	c.writeTimer = time.AfterFunc(opCacheWriteDelay, c.Flush)
+}
+
+func (c *OperationCache) expired(record *operationRecord) bool {
+	return c.ttl > 0 && time.Since(record.Timestamp) > c.ttl
+}
+
+// Remove expired entries, and the oldest entries if we have too many
+func (c *OperationCache) expireLocked() {
+	for id, record := range c.entries {
+		if c.expired(record) {
+			delete(c.entries, id)
+		}
+	}
+
+	for c.maxEntries > 0 && len(c.entries) > c.maxEntries {
+		var oldestId string
+		var oldest *operationRecord
+		for id, record := range c.entries {
+			if oldest == nil || record.Timestamp.Before(oldest.Timestamp) {
+				oldestId, oldest = id, record
+			}
+		}
+		delete(c.entries, oldestId)
+	}
+}
+
+// Written atomically, so we never leave a partial file.
+// Failing to write is not fatal; we just might not recognize a repeated
+// operation after a restart.
+func (c *OperationCache) writeLocked() {
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed encoding operation cache")
+		return
+	}
+
+	derr := atomicfile.WriteFile(c.file, data)
+	if derr != nil {
+		log.Warn().Err(derr).Str("file", c.file).Msg("failed writing operation cache")
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("operation cache", func() {
+
+	var cacheFile string
+
+	ginkgo.BeforeEach(func() {
+		cacheFile = filepath.Join(testPath, "operations.json")
+	})
+
+	ginkgo.AfterEach(func() {
+		os.Remove(cacheFile)
+	})
+
+	ginkgo.It("should remember operations after restart", func() {
+		c, derr := NewOperationCache(cacheFile, time.Hour, 10)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		c.Set("op1", grpc_inventory_go.OpStatus_SUCCESS, "test result")
+		c.Flush()
+
+		c2, derr := NewOperationCache(cacheFile, time.Hour, 10)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		status, info, found := c2.Get("op1")
+		gomega.Expect(found).To(gomega.BeTrue())
+		gomega.Expect(status).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
+		gomega.Expect(info).To(gomega.Equal("test result"))
+
+		_, _, found = c2.Get("op2")
+		gomega.Expect(found).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should write changes at once", func() {
+		// Not written by pending changes of other tests
+		cacheFile = filepath.Join(testPath, "batched.json")
+		c, derr := NewOperationCache(cacheFile, time.Hour, 10)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		c.Set("op1", grpc_inventory_go.OpStatus_SCHEDULED, "")
+		c.Set("op1", grpc_inventory_go.OpStatus_SUCCESS, "")
+		c.Set("op2", grpc_inventory_go.OpStatus_SCHEDULED, "")
+		gomega.Expect(cacheFile).ToNot(gomega.BeAnExistingFile())
+		gomega.Eventually(cacheFile, 5*opCacheWriteDelay).Should(gomega.BeAnExistingFile())
+
+		c2, derr := NewOperationCache(cacheFile, time.Hour, 10)
+		gomega.Expect(derr).To(gomega.Succeed())
+		status, _, found := c2.Get("op1")
+		gomega.Expect(found).To(gomega.BeTrue())
+		gomega.Expect(status).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
+		_, _, found = c2.Get("op2")
+		gomega.Expect(found).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should forget removed operations", func() {
+		c, derr := NewOperationCache(cacheFile, time.Hour, 10)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		c.Set("op1", grpc_inventory_go.OpStatus_SCHEDULED, "")
+		c.Remove("op1")
+
+		_, _, found := c.Get("op1")
+		gomega.Expect(found).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should forget expired operations", func() {
+		c, derr := NewOperationCache(cacheFile, 10*time.Millisecond, 10)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		c.Set("op1", grpc_inventory_go.OpStatus_SUCCESS, "")
+		time.Sleep(20 * time.Millisecond)
+
+		_, _, found := c.Get("op1")
+		gomega.Expect(found).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should forget the oldest operations when full", func() {
+		c, derr := NewOperationCache(cacheFile, time.Hour, 2)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		for _, id := range []string{"op1", "op2", "op3"} {
+			c.Set(id, grpc_inventory_go.OpStatus_SUCCESS, "")
+			// Make sure timestamps differ
+			time.Sleep(time.Millisecond)
+		}
+
+		_, _, found := c.Get("op1")
+		gomega.Expect(found).To(gomega.BeFalse())
+		_, _, found = c.Get("op2")
+		gomega.Expect(found).To(gomega.BeTrue())
+		_, _, found = c.Get("op3")
+		gomega.Expect(found).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should ignore a corrupt cache file", func() {
+		f, err := os.Create(cacheFile)
+		gomega.Expect(err).To(gomega.Succeed())
+		f.WriteString("not json")
+		f.Close()
+
+		c, derr := NewOperationCache(cacheFile, time.Hour, 10)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		_, _, found := c.Get("op1")
+		gomega.Expect(found).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should ignore a nil cache", func() {
+		var c *OperationCache
+		c.Set("op1", grpc_inventory_go.OpStatus_SUCCESS, "")
+		c.Remove("op1")
+		c.Flush()
+
+		_, _, found := c.Get("op1")
+		gomega.Expect(found).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should not execute repeated operations in the dispatcher", func() {
+		c, derr := NewOperationCache(cacheFile, time.Hour, 10)
+		gomega.Expect(derr).To(gomega.Succeed())
+		c.Set("testcacheop", grpc_inventory_go.OpStatus_SUCCESS, "previous result")
+
+		d := &Dispatcher{
+			opCache:  c,
+			opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 1),
+			resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 1),
+		}
+
+		derr = d.Dispatch(newBlockRequest("testcacheop", time.Millisecond))
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		// Not queued for execution, previous result sent instead
+		gomega.Expect(d.opQueue).To(gomega.BeEmpty())
+		response := <-d.resQueue
+		gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
+		gomega.Expect(response.GetInfo()).To(gomega.Equal("previous result"))
+	})
+})
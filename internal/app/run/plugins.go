@@ -20,6 +20,8 @@ package run
 // Available plugins
 
 import (
+	"sort"
+
 	_ "github.com/nalej/infra-net-plugin/ping"
 	_ "github.com/nalej/service-net-agent/internal/pkg/agentplugin/core"
 	_ "github.com/nalej/service-net-agent/internal/pkg/agentplugin/metrics"
@@ -34,3 +36,18 @@ func printRegisteredPlugins() {
 		log.Info().Str("name", name.String()).Str("description", entry.Description).Bool("running", entry.Running).Msg("plugin loaded")
 	}
 }
+
+// Names of the running plugins, sorted
+func runningPlugins() []plugin.PluginName {
+	running := []plugin.PluginName{}
+	for name, entry := range plugin.ListPlugins() {
+		if entry.Running {
+			running = append(running, name)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i] < running[j]
+	})
+
+	return running
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Sending progress of executing operations to the Edge Controller
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Minimum time between progress updates for an operation, so a chatty
+// plugin doesn't flood the Edge Controller
+const progressInterval = time.Second
+
+// Sends progress reported by an executing operation as an extra
+// SCHEDULED response, with the progress encoded as JSON in the info.
+// Progress responses are not journaled or cached; only the final result
+// of an operation is important enough for that.
+type progressReporter struct {
+	d  *Dispatcher
+	op *grpc_inventory_manager_go.AgentOpRequest
+
+	lock sync.Mutex
+	last time.Time
+	// Set when the operation has finished; we don't want to send any
+	// progress after the final result
+	done bool
+}
+
+func newProgressReporter(d *Dispatcher, op *grpc_inventory_manager_go.AgentOpRequest) *progressReporter {
+	return &progressReporter{
+		d:  d,
+		op: op,
+	}
+}
+
+func (r *progressReporter) report(progress agentplugin.Progress) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Completion is always interesting
+	if r.done || (progress.Percent < 100 && time.Since(r.last) < progressInterval) {
+		return
+	}
+
+	info, err := json.Marshal(progress)
+	if err != nil {
+		log.Warn().Err(err).Str("operation_id", r.op.GetOperationId()).Msg("failed encoding operation progress")
+		return
+	}
+
+	response := r.d.newResponse(r.op, grpc_inventory_go.OpStatus_SCHEDULED, string(info))
+
+	// Progress is not worth blocking the operation for
+	select {
+	case r.d.resQueue <- response:
+		r.last = time.Now()
+		log.Debug().Str("operation_id", r.op.GetOperationId()).Int("percent", progress.Percent).Msg("queued operation progress")
+	default:
+		log.Debug().Str("operation_id", r.op.GetOperationId()).Msg("response queue full, dropping operation progress")
+	}
+}
+
+func (r *progressReporter) finish() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.done = true
+}
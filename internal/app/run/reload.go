@@ -0,0 +1,343 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Reloading the configuration while running
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/service-net-agent/internal/pkg/client"
+	"github.com/nalej/service-net-agent/internal/pkg/config"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Time to wait for more changes to the configuration file before reloading
+const configWatchDelay = time.Second
+
+// Configuration that is applied when reloading; changes to anything else
+// need a restart
+var liveConfigKeys = []string{
+	"agent.interval",
+	"agent.min_interval",
+	"agent.max_interval",
+	"agent.interval_jitter",
+	"agent.log_level",
+	"agent.shutdown_timeout",
+	"agent.opqueue_len",
+	"agent.lanes",
+	"controller.tls",
+	"controller.cert",
+	"controller.insecure",
+	"controller.server_name",
+	"controller.pins",
+	plugin.DefaultPluginPrefix,
+}
+
+// Reload implements svcmgr.Reloader. An invalid configuration is rejected
+// and the running configuration is kept.
+func (s *Service) Reload() derrors.Error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	previous := s.Config.AllSettings()
+	changed, derr := s.Config.Reload(s.validateReload)
+	if derr != nil {
+		log.Warn().Err(derr).Msg("rejected configuration, keeping running configuration")
+		return derr
+	}
+	if !changed {
+		log.Debug().Msg("configuration unchanged")
+		return nil
+	}
+
+	current := s.Config.AllSettings()
+	keys := changedKeys("", previous, current)
+
+	s.lock.Lock()
+	interval, worker, dispatcher := s.interval, s.worker, s.dispatcher
+	s.lock.Unlock()
+
+	s.setLogLevel()
+	if interval != nil && interval.Configure(
+		s.Config.GetDuration("agent.interval"),
+		s.Config.GetDuration("agent.min_interval"),
+		s.Config.GetDuration("agent.max_interval"),
+		s.Config.GetFloat64("agent.interval_jitter"),
+	) {
+		log.Info().Str("interval", interval.Get().String()).Msg("heartbeat interval reconfigured")
+	}
+	if dispatcher != nil {
+		dispatcher.SetQueueLen(s.Config.GetInt("agent.opqueue_len"), s.laneLen())
+	}
+	if worker != nil {
+		worker.SetConfig(s.Config.GetSubConfig(plugin.DefaultPluginPrefix))
+	}
+	s.reloadPlugins(previous, current)
+
+	restart := []string{}
+	for _, key := range keys {
+		if !isLiveConfigKey(key) {
+			restart = append(restart, key)
+		}
+	}
+	if len(restart) > 0 {
+		log.Warn().Strs("keys", restart).Msg("configuration changes take effect after restart")
+	}
+
+	log.Info().Strs("keys", keys).Msg("configuration reloaded")
+	return nil
+}
+
+// Validate a new configuration and switch the Edge Controller connection to
+// its TLS settings. That is the last thing that can fail, so a configuration
+// with TLS settings we can't use is rejected as a whole.
+func (s *Service) validateReload(conf *config.Config) derrors.Error {
+	derr := validateConfig(conf)
+	if derr != nil {
+		return derr
+	}
+
+	if s.Client == nil {
+		return nil
+	}
+
+	opts, derr := client.OptionsFromConfig(conf)
+	if derr != nil {
+		return derr
+	}
+
+	return s.Client.Reconfigure(opts)
+}
+
+// Apply configured log level, if any
+func (s *Service) setLogLevel() {
+	level := s.Config.GetString("agent.log_level")
+	if level == "" {
+		return
+	}
+
+	// Validated before
+	parsed, _ := zerolog.ParseLevel(level)
+	zerolog.SetGlobalLevel(parsed)
+}
+
+// Restart plugins with changed configuration; stop the ones that are no
+// longer enabled. Operations for a plugin wait while it restarts.
+func (s *Service) reloadPlugins(previous, current map[string]interface{}) {
+	previousPlugins, _ := previous[plugin.DefaultPluginPrefix].(map[string]interface{})
+	currentPlugins, _ := current[plugin.DefaultPluginPrefix].(map[string]interface{})
+
+	names := make(map[string]bool, len(currentPlugins))
+	for name := range previousPlugins {
+		names[name] = true
+	}
+	for name := range currentPlugins {
+		names[name] = true
+	}
+
+	s.lock.Lock()
+	dispatcher := s.dispatcher
+	s.lock.Unlock()
+
+	for name := range names {
+		// What's configured for the agent applies right away
+		if reflect.DeepEqual(withoutAgentConfig(previousPlugins[name]), withoutAgentConfig(currentPlugins[name])) {
+			continue
+		}
+		s.restartPlugin(dispatcher, plugin.PluginName(name))
+	}
+}
+
+// Plugin settings without what's reserved for the agent
+func withoutAgentConfig(settings interface{}) interface{} {
+	m, ok := settings.(map[string]interface{})
+	if !ok {
+		return settings
+	}
+
+	filtered := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if k != pluginAgentKey {
+			filtered[k] = v
+		}
+	}
+
+	return filtered
+}
+
+func (s *Service) restartPlugin(dispatcher *Dispatcher, name plugin.PluginName) {
+	if dispatcher != nil {
+		defer dispatcher.Release(name)
+		derr := dispatcher.Hold(name, s.Config.GetDuration("agent.shutdown_timeout"))
+		if derr != nil {
+			log.Warn().Err(derr).Str("plugin", name.String()).Msg("plugin busy, new configuration takes effect after restart")
+			return
+		}
+	}
+
+	if _, found := plugin.DefaultRegistry().Running()[name]; found {
+		log.Info().Str("plugin", name.String()).Msg("stopping plugin for new configuration")
+		derr := plugin.StopPlugin(name)
+		if derr != nil {
+			log.Warn().Err(derr).Str("plugin", name.String()).Msg("failed stopping plugin")
+			return
+		}
+	}
+
+	conf := s.Config.Sub(fmt.Sprintf("%s.%s", plugin.DefaultPluginPrefix, name))
+	if conf == nil || !conf.GetBool("enabled") {
+		return
+	}
+	log.Info().Str("plugin", name.String()).Msg("starting plugin with new configuration")
+	derr := plugin.StartPlugin(name, pluginConfig(conf))
+	if derr != nil {
+		log.Warn().Err(derr).Str("plugin", name.String()).Msg("failed starting plugin")
+	}
+}
+
+func isLiveConfigKey(key string) bool {
+	for _, live := range liveConfigKeys {
+		if key == live || strings.HasPrefix(key, live+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sorted keys of values that differ between two nested settings maps
+func changedKeys(prefix string, previous, current map[string]interface{}) []string {
+	keys := []string{}
+	seen := make(map[string]bool, len(current))
+	for _, settings := range []map[string]interface{}{previous, current} {
+		for k := range settings {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+
+			previousMap, previousOk := previous[k].(map[string]interface{})
+			currentMap, currentOk := current[k].(map[string]interface{})
+			if previousOk && currentOk {
+				keys = append(keys, changedKeys(key, previousMap, currentMap)...)
+			} else if !reflect.DeepEqual(previous[k], current[k]) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Watches the configuration file and reloads when it changes. We watch the
+// directory, as the file is replaced rather than written when it's saved.
+//
+// All methods can be called on a nil configWatcher, which never reloads.
+type configWatcher struct {
+	file   string
+	reload func() derrors.Error
+
+	watcher   *fsnotify.Watcher
+	stopChan  chan struct{}
+	waitgroup sync.WaitGroup
+}
+
+func newConfigWatcher(file string, reload func() derrors.Error) *configWatcher {
+	return &configWatcher{
+		file:   filepath.Clean(file),
+		reload: reload,
+	}
+}
+
+func (w *configWatcher) Start() {
+	if w == nil {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to watch configuration file")
+		return
+	}
+	err = watcher.Add(filepath.Dir(w.file))
+	if err != nil {
+		watcher.Close()
+		log.Warn().Err(err).Str("file", w.file).Msg("unable to watch configuration file")
+		return
+	}
+
+	w.watcher = watcher
+	w.stopChan = make(chan struct{})
+
+	w.waitgroup.Add(1)
+	go w.loop()
+}
+
+func (w *configWatcher) Stop() {
+	if w == nil || w.watcher == nil {
+		return
+	}
+
+	close(w.stopChan)
+	w.waitgroup.Wait()
+	w.watcher.Close()
+}
+
+func (w *configWatcher) loop() {
+	defer w.waitgroup.Done()
+
+	// Editors and our own writes touch the file more than once; we
+	// reload when it's quiet again
+	var delay <-chan time.Time
+	for {
+		select {
+		case event := <-w.watcher.Events:
+			if filepath.Clean(event.Name) != w.file || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			delay = time.After(configWatchDelay)
+		case err := <-w.watcher.Errors:
+			log.Warn().Err(err).Msg("error watching configuration file")
+		case <-delay:
+			delay = nil
+			// Reload logs what happened
+			w.reload()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
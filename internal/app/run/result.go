@@ -0,0 +1,96 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Structured operation results
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/grpc-inventory-go"
+
+	"github.com/rs/zerolog/log"
+)
+
+// OperationResult is the final result of an operation. It is encoded as
+// JSON in the info of the operation response, so the Edge Controller can
+// tell what went wrong without parsing error messages.
+type OperationResult struct {
+	// Output of the plugin command. If the command returned a JSON
+	// object or array it is included as is, otherwise as a string.
+	Output json.RawMessage `json:"output,omitempty"`
+	// Set if the operation failed
+	Error *OperationError `json:"error,omitempty"`
+}
+
+type OperationError struct {
+	// The derrors error type, e.g. "InvalidArgument"
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	DebugReport string `json:"debug_report,omitempty"`
+}
+
+func NewOperationResult(output string, derr derrors.Error) *OperationResult {
+	result := &OperationResult{}
+
+	trimmed := strings.TrimSpace(output)
+	isJSON := (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed))
+	if isJSON {
+		result.Output = json.RawMessage(trimmed)
+	} else if output != "" {
+		// Encoding a string doesn't fail
+		result.Output, _ = json.Marshal(output)
+	}
+
+	if derr != nil {
+		result.Error = &OperationError{
+			Code:        string(derr.Type()),
+			Message:     derr.Error(),
+			DebugReport: derr.DebugReport(),
+		}
+	}
+
+	return result
+}
+
+// Result of an operation that failed before or instead of being executed
+func failedResult(derr derrors.Error) *OperationResult {
+	return NewOperationResult("", derr)
+}
+
+func (r *OperationResult) Status() grpc_inventory_go.OpStatus {
+	if r.Error != nil {
+		return grpc_inventory_go.OpStatus_FAIL
+	}
+	return grpc_inventory_go.OpStatus_SUCCESS
+}
+
+// Info encodes the result for an operation response
+func (r *OperationResult) Info() string {
+	info, err := json.Marshal(r)
+	if err != nil {
+		// Can only happen with invalid output, which we checked
+		log.Warn().Err(err).Msg("failed encoding operation result")
+		return ""
+	}
+
+	return string(info)
+}
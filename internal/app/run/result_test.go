@@ -0,0 +1,58 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"encoding/json"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-inventory-go"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("operation result", func() {
+	ginkgo.It("should encode text output", func() {
+		result := NewOperationResult("pong test", nil)
+		gomega.Expect(result.Status()).To(gomega.Equal(grpc_inventory_go.OpStatus_SUCCESS))
+		gomega.Expect(result.Info()).To(gomega.MatchJSON(`{"output":"pong test"}`))
+	})
+
+	ginkgo.It("should include JSON output as is", func() {
+		result := NewOperationResult(`{"key": "value"}`, nil)
+		gomega.Expect(result.Info()).To(gomega.MatchJSON(`{"output":{"key":"value"}}`))
+	})
+
+	ginkgo.It("should not take other JSON values for objects", func() {
+		result := NewOperationResult("42", nil)
+		gomega.Expect(result.Info()).To(gomega.MatchJSON(`{"output":"42"}`))
+	})
+
+	ginkgo.It("should encode errors", func() {
+		result := NewOperationResult("", derrors.NewInvalidArgumentError("test error"))
+		gomega.Expect(result.Status()).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL))
+
+		decoded := &OperationResult{}
+		gomega.Expect(json.Unmarshal([]byte(result.Info()), decoded)).To(gomega.Succeed())
+		gomega.Expect(decoded.Output).To(gomega.BeEmpty())
+		gomega.Expect(decoded.Error.Code).To(gomega.Equal(string(derrors.InvalidArgument)))
+		gomega.Expect(decoded.Error.Message).To(gomega.ContainSubstring("test error"))
+		gomega.Expect(decoded.Error.DebugReport).ToNot(gomega.BeEmpty())
+	})
+})
@@ -27,9 +27,11 @@ import (
 	"github.com/nalej/grpc-utils/pkg/test"
 	"github.com/nalej/infra-net-plugin"
 
+	"github.com/nalej/service-net-agent/internal/pkg/certsign"
 	"github.com/nalej/service-net-agent/internal/pkg/client"
 	"github.com/nalej/service-net-agent/internal/pkg/config"
 	"github.com/nalej/service-net-agent/internal/pkg/ec-stub"
+	"github.com/nalej/service-net-agent/internal/pkg/opstream"
 
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
@@ -75,6 +77,8 @@ var _ = ginkgo.BeforeSuite(func() {
 
 	testHandler = ec_stub.NewHandler()
 	grpc_edge_controller_go.RegisterAgentServer(testServer, testHandler)
+	opstream.RegisterAgentStreamServer(testServer, testHandler)
+	certsign.RegisterAgentCertificateServer(testServer, testHandler)
 	test.LaunchServer(testServer, testListener)
 
 	testClient = client.NewFakeAgentClient(conn)
@@ -0,0 +1,348 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Operations executed at a later time or repeatedly
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+	"github.com/nalej/service-net-agent/internal/pkg/config"
+	"github.com/nalej/service-net-agent/internal/pkg/cron"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Time to execute the operation once, in RFC3339 format
+	runAtParam = reservedParamPrefix + "run_at"
+	// Cron-style schedule to execute the operation repeatedly, e.g.
+	// "0 3 * * *" for every night at 3:00 local time
+	scheduleParam = reservedParamPrefix + "schedule"
+
+	// Configuration key for the list of scheduled operations
+	schedulesKey = "agent.schedules"
+)
+
+// Scheduler keeps operations that are to be executed at a later time or
+// repeatedly, and hands them to the dispatcher when they're due. This
+// does not depend on the connection with the Edge Controller; results of
+// operations executed while offline are sent when we're connected again.
+//
+// Scheduled operations are stored in the agent configuration, so they
+// survive a restart. A one-time operation that was due while the agent
+// wasn't running is executed right away; missed runs of a repeated
+// operation are skipped. Secret operation parameters are encrypted with
+// the configuration's secret store; without one, operations with secret
+// parameters are only kept until a restart.
+//
+// All methods can be called on a nil Scheduler, which doesn't accept
+// operations.
+type Scheduler struct {
+	config *config.Config
+
+	lock    sync.Mutex
+	entries map[string]*scheduledOp
+
+	// Signals the scheduling routine that entries changed
+	wakeChan  chan struct{}
+	cancel    context.CancelFunc
+	waitgroup sync.WaitGroup
+}
+
+type scheduledOp struct {
+	op *grpc_inventory_manager_go.AgentOpRequest
+	// Nil for one-time operations
+	schedule *cron.Schedule
+	next     time.Time
+}
+
+func NewScheduler(config *config.Config) (*Scheduler, derrors.Error) {
+	s := &Scheduler{
+		config:   config,
+		entries:  make(map[string]*scheduledOp),
+		wakeChan: make(chan struct{}, 1),
+	}
+
+	for _, encoded := range config.GetStringSlice(schedulesKey) {
+		op := &grpc_inventory_manager_go.AgentOpRequest{}
+		err := jsonpb.UnmarshalString(encoded, op)
+		if err != nil {
+			log.Warn().Err(err).Msg("ignoring invalid scheduled operation")
+			continue
+		}
+
+		params, derr := agentplugin.OpenParams(config.Secrets, plugin.PluginName(op.GetPlugin()), op.GetParams())
+		if derr != nil {
+			log.Warn().Err(derr).Str("operation_id", op.GetOperationId()).Msg("ignoring scheduled operation with unreadable parameters")
+			continue
+		}
+		op.Params = params
+
+		entry, derr := newScheduledOp(op, time.Now())
+		if derr != nil {
+			log.Warn().Err(derr).Str("operation_id", op.GetOperationId()).Msg("ignoring invalid scheduled operation")
+			continue
+		}
+		if entry.next.IsZero() {
+			continue
+		}
+		s.entries[op.GetOperationId()] = entry
+	}
+
+	return s, nil
+}
+
+// Whether an operation is to be executed later, or repeatedly
+func isScheduled(op *grpc_inventory_manager_go.AgentOpRequest) bool {
+	params := op.GetParams()
+	_, runAt := params[runAtParam]
+	_, schedule := params[scheduleParam]
+	return runAt || schedule
+}
+
+func newScheduledOp(op *grpc_inventory_manager_go.AgentOpRequest, now time.Time) (*scheduledOp, derrors.Error) {
+	entry := &scheduledOp{
+		op: op,
+	}
+
+	params := op.GetParams()
+	if spec, found := params[scheduleParam]; found {
+		schedule, derr := cron.Parse(spec)
+		if derr != nil {
+			return nil, derr
+		}
+		entry.schedule = schedule
+		entry.next = schedule.Next(now)
+	}
+
+	// A one-time operation that's overdue is executed right away
+	if value, found := params[runAtParam]; found {
+		runAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, derrors.NewInvalidArgumentError("invalid operation run time", err).WithParams(value)
+		}
+		if entry.schedule != nil {
+			return nil, derrors.NewInvalidArgumentError("operation can't have both run time and schedule")
+		}
+		entry.next = runAt
+	}
+
+	return entry, nil
+}
+
+// Add an operation to be executed later. An operation with the same id
+// replaces the existing one.
+func (s *Scheduler) Add(op *grpc_inventory_manager_go.AgentOpRequest) derrors.Error {
+	if s == nil {
+		return derrors.NewFailedPreconditionError("scheduled operations not supported")
+	}
+
+	entry, derr := newScheduledOp(op, time.Now())
+	if derr != nil {
+		return derr
+	}
+	if entry.next.IsZero() {
+		return derrors.NewInvalidArgumentError("operation schedule never runs").WithParams(op.GetParams()[scheduleParam])
+	}
+
+	s.lock.Lock()
+	s.entries[op.GetOperationId()] = entry
+	s.writeLocked()
+	s.lock.Unlock()
+
+	log.Info().Str("operation_id", op.GetOperationId()).Str("next", entry.next.String()).Msg("scheduled operation")
+	s.wake()
+
+	return nil
+}
+
+// Remove an operation so it won't be executed anymore. Returns the
+// operation, or nil if it wasn't scheduled.
+func (s *Scheduler) Remove(id string) *grpc_inventory_manager_go.AgentOpRequest {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, found := s.entries[id]
+	if !found {
+		return nil
+	}
+
+	delete(s.entries, id)
+	s.writeLocked()
+
+	return entry.op
+}
+
+// Number of scheduled operations
+func (s *Scheduler) Len() int {
+	if s == nil {
+		return 0
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.entries)
+}
+
+// Start calling run for operations when they are due
+func (s *Scheduler) Start(run func(*grpc_inventory_manager_go.AgentOpRequest)) {
+	if s == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	s.waitgroup.Add(1)
+	go s.loop(ctx, run)
+}
+
+// Stop the scheduling routine; run is not called anymore after this
+func (s *Scheduler) Stop() {
+	if s == nil || s.cancel == nil {
+		return
+	}
+
+	s.cancel()
+	s.waitgroup.Wait()
+}
+
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, run func(*grpc_inventory_manager_go.AgentOpRequest)) {
+	defer s.waitgroup.Done()
+
+	log.Debug().Msg("starting operation scheduler")
+
+	for ctx.Err() == nil {
+		due, next := s.takeDue(time.Now())
+		for _, op := range due {
+			run(op)
+		}
+
+		// Nothing scheduled: wait until something is added
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+
+		select {
+		case <-timer:
+		case <-s.wakeChan:
+		case <-ctx.Done():
+		}
+	}
+
+	log.Debug().Msg("operation scheduler stopped")
+}
+
+// Returns the runs of operations that are due and moves their entries to
+// the next run, and returns the time of the first next run.
+func (s *Scheduler) takeDue(now time.Time) ([]*grpc_inventory_manager_go.AgentOpRequest, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	due := []*grpc_inventory_manager_go.AgentOpRequest{}
+	var first time.Time
+	changed := false
+
+	for id, entry := range s.entries {
+		if !entry.next.After(now) {
+			due = append(due, runOf(entry.op))
+			changed = true
+
+			if entry.schedule == nil {
+				delete(s.entries, id)
+				continue
+			}
+			entry.next = entry.schedule.Next(now)
+			if entry.next.IsZero() {
+				delete(s.entries, id)
+				continue
+			}
+		}
+
+		if first.IsZero() || entry.next.Before(first) {
+			first = entry.next
+		}
+	}
+
+	if changed {
+		s.writeLocked()
+	}
+
+	return due, first
+}
+
+// A single run of a scheduled operation
+func runOf(op *grpc_inventory_manager_go.AgentOpRequest) *grpc_inventory_manager_go.AgentOpRequest {
+	run := proto.Clone(op).(*grpc_inventory_manager_go.AgentOpRequest)
+	delete(run.Params, runAtParam)
+	delete(run.Params, scheduleParam)
+
+	return run
+}
+
+// Store the scheduled operations in the configuration file. Failing to
+// write is not fatal; we just lose the operations on a restart.
+func (s *Scheduler) writeLocked() {
+	encoded := make([]string, 0, len(s.entries))
+	marshaler := &jsonpb.Marshaler{}
+	for _, entry := range s.entries {
+		params, derr := agentplugin.SealParams(s.config.Secrets, plugin.PluginName(entry.op.GetPlugin()), entry.op.GetParams())
+		if derr != nil {
+			log.Warn().Err(derr).Str("operation_id", entry.op.GetOperationId()).Msg("not persisting scheduled operation with secret parameters")
+			continue
+		}
+		sealed := proto.Clone(entry.op).(*grpc_inventory_manager_go.AgentOpRequest)
+		sealed.Params = params
+
+		str, err := marshaler.MarshalToString(sealed)
+		if err != nil {
+			log.Warn().Err(err).Str("operation_id", entry.op.GetOperationId()).Msg("failed encoding scheduled operation")
+			continue
+		}
+		encoded = append(encoded, str)
+	}
+
+	derr := s.config.SetAndWrite(schedulesKey, encoded)
+	if derr != nil {
+		log.Warn().Err(derr).Str("trace", derr.DebugReport()).Msg("failed persisting scheduled operations")
+	}
+}
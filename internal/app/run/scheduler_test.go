@@ -0,0 +1,171 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"time"
+
+	"github.com/nalej/grpc-inventory-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/config"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("scheduler", func() {
+
+	newScheduledRequest := func(id string, key string, value string) *grpc_inventory_manager_go.AgentOpRequest {
+		op := newBlockRequest(id, 0)
+		op.Params[key] = value
+		return op
+	}
+
+	// Scheduler reading the configuration file, as after a restart
+	restartScheduler := func() *Scheduler {
+		c := config.NewConfig()
+		c.ConfigFile = testConfigFile
+		gomega.Expect(c.Read()).To(gomega.Succeed())
+
+		s, derr := NewScheduler(c)
+		gomega.Expect(derr).To(gomega.Succeed())
+		return s
+	}
+
+	ginkgo.It("should run operations at their time", func() {
+		s, derr := NewScheduler(testConfig)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		runAt := time.Now().Add(50 * time.Millisecond)
+		gomega.Expect(s.Add(newScheduledRequest("runatop", runAtParam, runAt.Format(time.RFC3339Nano)))).To(gomega.Succeed())
+
+		runChan := make(chan *grpc_inventory_manager_go.AgentOpRequest, 1)
+		s.Start(func(op *grpc_inventory_manager_go.AgentOpRequest) {
+			runChan <- op
+		})
+		defer s.Stop()
+
+		var run *grpc_inventory_manager_go.AgentOpRequest
+		gomega.Eventually(runChan).Should(gomega.Receive(&run))
+		gomega.Expect(time.Now()).To(gomega.BeTemporally(">=", runAt))
+		gomega.Expect(run.GetOperationId()).To(gomega.Equal("runatop"))
+		gomega.Expect(run.GetParams()).ToNot(gomega.HaveKey(runAtParam))
+
+		// Only once
+		gomega.Expect(s.Remove("runatop")).To(gomega.BeNil())
+	})
+
+	ginkgo.It("should keep scheduled operations after restart", func() {
+		s, derr := NewScheduler(testConfig)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(s.Add(newScheduledRequest("nightlyop", scheduleParam, "0 3 * * *"))).To(gomega.Succeed())
+
+		s2 := restartScheduler()
+		op := s2.Remove("nightlyop")
+		gomega.Expect(op).ToNot(gomega.BeNil())
+		gomega.Expect(op.GetParams()).To(gomega.HaveKeyWithValue(scheduleParam, "0 3 * * *"))
+	})
+
+	ginkgo.It("should run overdue operations after restart", func() {
+		s, derr := NewScheduler(testConfig)
+		gomega.Expect(derr).To(gomega.Succeed())
+		runAt := time.Now().Add(-time.Minute)
+		gomega.Expect(s.Add(newScheduledRequest("overdueop", runAtParam, runAt.Format(time.RFC3339)))).To(gomega.Succeed())
+
+		s2 := restartScheduler()
+		runChan := make(chan *grpc_inventory_manager_go.AgentOpRequest, 1)
+		s2.Start(func(op *grpc_inventory_manager_go.AgentOpRequest) {
+			runChan <- op
+		})
+		defer s2.Stop()
+
+		gomega.Eventually(runChan).Should(gomega.Receive())
+	})
+
+	ginkgo.It("should reject invalid schedules", func() {
+		s, derr := NewScheduler(testConfig)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		gomega.Expect(s.Add(newScheduledRequest("op", scheduleParam, "every night"))).ToNot(gomega.Succeed())
+		gomega.Expect(s.Add(newScheduledRequest("op", runAtParam, "tonight"))).ToNot(gomega.Succeed())
+		gomega.Expect(s.Add(newScheduledRequest("op", scheduleParam, "0 0 30 2 *"))).ToNot(gomega.Succeed())
+
+		op := newScheduledRequest("op", scheduleParam, "@daily")
+		op.Params[runAtParam] = time.Now().Format(time.RFC3339)
+		gomega.Expect(s.Add(op)).ToNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should not accept operations when nil", func() {
+		var s *Scheduler
+		gomega.Expect(s.Add(newScheduledRequest("op", scheduleParam, "@daily"))).ToNot(gomega.Succeed())
+		gomega.Expect(s.Remove("op")).To(gomega.BeNil())
+		s.Stop()
+	})
+
+	ginkgo.Context("dispatcher", func() {
+		ginkgo.It("should schedule operations instead of queueing them", func() {
+			s, derr := NewScheduler(testConfig)
+			gomega.Expect(derr).To(gomega.Succeed())
+
+			d := &Dispatcher{
+				scheduler: s,
+				opQueue:   make(chan *grpc_inventory_manager_go.AgentOpRequest, 1),
+				resQueue:  make(chan *grpc_inventory_manager_go.AgentOpResponse, 2),
+			}
+
+			gomega.Expect(d.Dispatch(newScheduledRequest("nightlyop", scheduleParam, "@daily"))).To(gomega.Succeed())
+			gomega.Expect(d.opQueue).To(gomega.BeEmpty())
+			gomega.Expect((<-d.resQueue).GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_SCHEDULED))
+
+			// Cancelling removes it from the scheduler
+			gomega.Expect(d.Cancel("nightlyop")).To(gomega.Succeed())
+			response := <-d.resQueue
+			gomega.Expect(response.GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL))
+			gomega.Expect(response.GetInfo()).To(gomega.ContainSubstring(`"code":"Aborted"`))
+			gomega.Expect(s.Remove("nightlyop")).To(gomega.BeNil())
+		})
+
+		ginkgo.It("should queue scheduled operations when due", func() {
+			d := &Dispatcher{
+				opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 1),
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 1),
+			}
+
+			d.runScheduled(newBlockRequest("nightlyop", 0))
+			gomega.Expect(d.opQueue).To(gomega.HaveLen(1))
+			// No new scheduled response
+			gomega.Expect(d.resQueue).To(gomega.BeEmpty())
+
+			// Not while the previous run is still queued
+			d.runScheduled(newBlockRequest("nightlyop", 0))
+			gomega.Expect(d.opQueue).To(gomega.HaveLen(1))
+		})
+
+		ginkgo.It("should refuse scheduled operations without scheduler", func() {
+			d := &Dispatcher{
+				opQueue:  make(chan *grpc_inventory_manager_go.AgentOpRequest, 1),
+				resQueue: make(chan *grpc_inventory_manager_go.AgentOpResponse, 1),
+			}
+
+			gomega.Expect(d.Dispatch(newScheduledRequest("nightlyop", scheduleParam, "@daily"))).To(gomega.Succeed())
+			gomega.Expect(d.opQueue).To(gomega.BeEmpty())
+			gomega.Expect((<-d.resQueue).GetStatus()).To(gomega.Equal(grpc_inventory_go.OpStatus_FAIL))
+		})
+	})
+})
@@ -21,14 +21,20 @@ package run
 
 import (
 	"fmt"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/nalej/derrors"
 	"github.com/nalej/infra-net-plugin"
 
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
 	"github.com/nalej/service-net-agent/internal/pkg/client"
 	"github.com/nalej/service-net-agent/internal/pkg/config"
+	"github.com/nalej/service-net-agent/internal/pkg/defaults"
+	"github.com/nalej/service-net-agent/internal/pkg/spool"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
@@ -39,22 +45,104 @@ type Service struct {
 
 	stopChan    chan struct{}
 	disableChan chan struct{}
-	lastBeat    time.Time
+
+	// Serializes configuration reloads
+	reloadLock sync.Mutex
+
+	// Protects state that is read from other goroutines, like the core
+	// plugin and the service manager
+	lock     sync.Mutex
+	lastBeat time.Time
+	// Delay until the next heartbeat
+	beatDelay time.Duration
+
+	// Set while running
+	dispatcher *Dispatcher
+	worker     *Worker
+	interval   *heartbeatInterval
+	health     *healthTracker
 }
 
 func (s *Service) Validate() derrors.Error {
-	if s.Config.GetString("agent.token") == "" {
+	return validateConfig(s.Config)
+}
+
+// Validate configuration for the service; also used for a reloaded
+// configuration before putting it in place
+func validateConfig(conf *config.Config) derrors.Error {
+	if conf.GetString("agent.token") == "" {
 		return derrors.NewFailedPreconditionError("no token found - agent not joined to edge controller")
 	}
-	if s.Config.GetString("agent.asset_id") == "" {
+	if conf.GetString("agent.asset_id") == "" {
 		return derrors.NewFailedPreconditionError("no asset id found - agent not joined to edge controller")
 	}
-	if s.Config.GetString("controller.address") == "" {
-		return derrors.NewInvalidArgumentError("address must be specified")
+	if conf.GetString("controller.address") == "" && conf.GetString("controller.srv") == "" {
+		return derrors.NewInvalidArgumentError("address or srv name must be specified")
+	}
+	if conf.GetInt("agent.auth.max_failures") < 0 {
+		return derrors.NewInvalidArgumentError("valid maximum of token rejections (>= 0) must be specified")
+	}
+	reduceAt, stretchAt := conf.GetFloat64("agent.budget.reduce_at"), conf.GetFloat64("agent.budget.stretch_at")
+	if reduceAt < 0 || reduceAt > stretchAt || stretchAt > 1 {
+		return derrors.NewInvalidArgumentError("valid bandwidth budget thresholds (0 <= reduce_at <= stretch_at <= 1) must be specified")
+	}
+	if conf.GetSizeInBytes("agent.budget.limit") > 0 && conf.GetDuration("agent.budget.max_interval") <= 0 {
+		return derrors.NewInvalidArgumentError("valid bandwidth budget maximum interval (> 0) must be specified")
+	}
+	if conf.GetDuration("agent.budget.write_interval") < 0 {
+		return derrors.NewInvalidArgumentError("valid bandwidth budget write interval (>= 0) must be specified")
+	}
+	if conf.GetDuration("controller.probe_interval") < 0 {
+		return derrors.NewInvalidArgumentError("valid endpoint probe interval (>= 0) must be specified")
 	}
-	if s.Config.GetDuration("agent.interval") <= 0 {
+	if conf.GetInt("controller.failure_threshold") < 0 {
+		return derrors.NewInvalidArgumentError("valid connection failure threshold (>= 0) must be specified")
+	}
+	if conf.GetInt("controller.failure_threshold") > 0 && conf.GetDuration("controller.redial_interval") <= 0 {
+		return derrors.NewInvalidArgumentError("valid redial interval (> 0) must be specified")
+	}
+	if conf.GetString("controller.client_cert") != "" && conf.GetDuration("controller.cert_check_interval") <= 0 {
+		return derrors.NewInvalidArgumentError("valid client certificate check interval (> 0) must be specified")
+	}
+	if level := conf.GetString("agent.log_level"); level != "" {
+		_, err := zerolog.ParseLevel(level)
+		if err != nil {
+			return derrors.NewInvalidArgumentError("valid log level must be specified", err).WithParams(level)
+		}
+	}
+	if conf.GetDuration("agent.interval") <= 0 {
 		return derrors.NewInvalidArgumentError("valid interval (> 0) must be specified")
 	}
+	minInterval := conf.GetDuration("agent.min_interval")
+	maxInterval := conf.GetDuration("agent.max_interval")
+	if minInterval < 0 || maxInterval < 0 || (maxInterval > 0 && maxInterval < minInterval) {
+		return derrors.NewInvalidArgumentError("valid interval bounds (0 <= min <= max) must be specified")
+	}
+	intervalJitter := conf.GetFloat64("agent.interval_jitter")
+	if intervalJitter < 0 || intervalJitter >= 1 {
+		return derrors.NewInvalidArgumentError("valid interval jitter (at least 0, less than 1) must be specified")
+	}
+	if conf.GetInt("agent.max_concurrent_ops") < 0 {
+		return derrors.NewInvalidArgumentError("valid maximum of concurrent operations (>= 0) must be specified")
+	}
+	if conf.GetInt("agent.health.failing_after") < 1 {
+		return derrors.NewInvalidArgumentError("valid number of errors before a plugin is failing (>= 1) must be specified")
+	}
+	if conf.GetBool("controller.stream") && conf.GetDuration("agent.stream.reconnect_interval") <= 0 {
+		return derrors.NewInvalidArgumentError("valid stream reconnect interval (> 0) must be specified")
+	}
+	if conf.GetDuration("agent.retry.max_age") > 0 {
+		if conf.GetDuration("agent.retry.initial_interval") <= 0 {
+			return derrors.NewInvalidArgumentError("valid retry interval (> 0) must be specified")
+		}
+		if conf.GetFloat64("agent.retry.multiplier") < 1 {
+			return derrors.NewInvalidArgumentError("valid retry multiplier (>= 1) must be specified")
+		}
+		jitter := conf.GetFloat64("agent.retry.jitter")
+		if jitter < 0 || jitter > 1 {
+			return derrors.NewInvalidArgumentError("valid retry jitter (between 0 and 1) must be specified")
+		}
+	}
 
 	return nil
 }
@@ -67,7 +155,7 @@ func (s *Service) RestartPlugins() derrors.Error {
 		if !conf.GetBool("enabled") {
 			continue
 		}
-		derr := plugin.StartPlugin(plugin.PluginName(k), conf)
+		derr := plugin.StartPlugin(plugin.PluginName(k), pluginConfig(conf))
 		if derr != nil {
 			return derr
 		}
@@ -82,6 +170,9 @@ func (s *Service) StartCorePlugin() derrors.Error {
 	conf := viper.New()
 	conf.Set("runner", s)
 	conf.Set("config", s.Config)
+	conf.Set("operations", s)
+	conf.Set("heartbeat", s)
+	conf.Set("credentials", s)
 
 	derr := plugin.StartPlugin("core", conf)
 	if derr != nil {
@@ -98,6 +189,7 @@ func (s *Service) Run() derrors.Error {
 
 	printRegisteredPlugins()
 	s.Config.Print()
+	s.setLogLevel()
 
 	derr := s.StartCorePlugin()
 	if derr != nil {
@@ -109,54 +201,178 @@ func (s *Service) Run() derrors.Error {
 		return derr
 	}
 
-	interval := s.Config.GetDuration("agent.interval")
-	beatTimeout := interval / 2
+	interval := newHeartbeatInterval(
+		s.Config.GetDuration("agent.interval"),
+		s.Config.GetDuration("agent.min_interval"),
+		s.Config.GetDuration("agent.max_interval"),
+		s.Config.GetFloat64("agent.interval_jitter"),
+	)
 	assetId := s.Config.GetString("agent.asset_id")
 
-	log.Debug().Str("interval", interval.String()).Msg("running")
+	log.Debug().Str("interval", interval.Get().String()).Msg("running")
 
 	// Create worker to execute operations
 	worker := NewWorker(s.Config.GetSubConfig(plugin.DefaultPluginPrefix))
 
+	// Open journal to survive restarts with operations in flight
+	journal, derr := NewJournal(filepath.Join(s.Config.Path, defaults.JournalDir), s.Config.Secrets)
+	if derr != nil {
+		return derr
+	}
+
+	// Remember operations we've seen, so we don't execute them twice
+	opCache, derr := NewOperationCache(filepath.Join(s.Config.Path, defaults.OpCacheFile),
+		s.Config.GetDuration("agent.dedup.ttl"), s.Config.GetInt("agent.dedup.max_entries"))
+	if derr != nil {
+		return derr
+	}
+
+	// Operations to execute later are kept in the configuration
+	scheduler, derr := NewScheduler(s.Config)
+	if derr != nil {
+		return derr
+	}
+
 	// Create dispatcher for operations to workers
-	dispatcher, derr := NewDispatcher(s.Client, worker, s.Config.GetInt("agent.opqueue_len"))
+	dispatcherOpts := &DispatcherOptions{
+		QueueLen:       s.Config.GetInt("agent.opqueue_len"),
+		LaneLen:        s.laneLen(),
+		Journal:        journal,
+		OperationCache: opCache,
+		Scheduler:      scheduler,
+		Retry:          s.retryOptions(),
+		MaxConcurrent:  s.Config.GetInt("agent.max_concurrent_ops"),
+	}
+	dispatcher, derr := NewDispatcher(s.Client, worker, dispatcherOpts)
 	if derr != nil {
 		return derr
 	}
 
-	beater := Beater{
-		client:     s.Client,
-		dispatcher: dispatcher,
-		assetId:    assetId,
+	// Stop what we started when we fail to start or give up running, in
+	// reverse order. On a normal stop, everything is stopped below.
+	cleanup := []func(){func() {
+		dispatcher.Stop(s.Config.GetDuration("agent.shutdown_timeout"))
+	}}
+	defer func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}()
+
+	// Keep heartbeats we couldn't send to send them later
+	beatSpool, derr := spool.NewSpool(filepath.Join(s.Config.Path, defaults.SpoolDir), s.Config.GetInt64("agent.spool.max_size"))
+	if derr != nil {
+		return derr
 	}
 
-	// Start main heartbeat ticker
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	health := newHealthTracker(s.Config.GetInt("agent.health.failing_after"), s.Config.GetStringSlice("agent.health.critical"))
+
+	s.setRunning(dispatcher, worker, interval, health)
+	defer s.setRunning(nil, nil, nil, nil)
+
+	// Stay within bandwidth budget on metered links
+	bandwidth, derr := s.budget()
+	if derr != nil {
+		return derr
+	}
+
+	beater := Beater{
+		client:      s.Client,
+		dispatcher:  dispatcher,
+		assetId:     assetId,
+		spool:       beatSpool,
+		replayLimit: s.Config.GetInt("agent.spool.replay_limit"),
+		health:      health,
+		status:      s.agentStatus(dispatcher),
+		budget:      bandwidth,
+		interval:    interval,
+	}
 
 	// Initial heartbeat so the edge controller knows we're running right away
-	_, derr = beater.Beat(beatTimeout)
+	_, derr = beater.Beat(interval.Get() / 2)
 	if derr != nil {
 		return derr
 	}
 
+	// Receive operations right away if the edge controller supports it
+	streamer := s.streamer(dispatcher, assetId)
+	streamer.Start()
+	cleanup = append(cleanup, streamer.Stop)
+
+	// Keep client certificate valid, if we have one
+	renewer := newCertRenewer(s.Client, assetId, s.Config.GetDuration("controller.cert_check_interval"))
+	renewer.Start()
+	cleanup = append(cleanup, renewer.Stop)
+
+	// Pick up changes to the configuration file without restarting
+	watcher := s.configWatcher()
+	watcher.Start()
+	cleanup = append(cleanup, watcher.Stop)
+
+	// Notice when our token is revoked
+	auth := newAuthMonitor(s.Client, s.Config.GetInt("agent.auth.max_failures"), backoff.Policy{
+		Initial:    interval.Get(),
+		Max:        s.Config.GetDuration("agent.auth.max_interval"),
+		Multiplier: 2,
+		Jitter:     s.Config.GetFloat64("agent.interval_jitter"),
+	})
+	nextBeat := func() time.Duration {
+		delay := interval.Next()
+		if auth.NeedsRejoin() {
+			delay = auth.Next()
+		}
+		delay = bandwidth.Delay(time.Now(), delay)
+		s.lock.Lock()
+		s.beatDelay = delay
+		s.lock.Unlock()
+		return delay
+	}
+
+	// Start main heartbeat timer
+	timer := time.NewTimer(nextBeat())
+	defer func() {
+		timer.Stop()
+	}()
+
 	s.stopChan = make(chan struct{})
 	s.disableChan = make(chan struct{})
 	for s.stopChan != nil && s.disableChan != nil {
 		select {
-		case <-ticker.C:
+		case <-timer.C:
 			// Send heartbeat
-			ok, derr := beater.Beat(beatTimeout)
+			ok, derr := beater.Beat(interval.Get() / 2)
 			if derr != nil {
 				// Something is wrong with the dispatcher,
-				// we're not going to try to stop it.
+				// we give up and stop what we can.
 				return derr
 			}
 
-			// Record last succesfull run
-			if ok {
+			if auth.Update(ok) {
+				if auth.NeedsRejoin() {
+					log.Error().Int("failures", s.Client.AuthFailures()).Msg("agent token rejected repeatedly, agent needs to re-join edge controller")
+					streamer.Stop()
+					dispatcher.Pause()
+				} else {
+					log.Info().Msg("agent token accepted again")
+					dispatcher.Resume()
+					streamer.Start()
+				}
+			}
+
+			// Record last succesfull run. Restarting won't get
+			// us a valid token, so we stay alive while we need
+			// to be joined again.
+			if ok || auth.NeedsRejoin() {
+				s.lock.Lock()
 				s.lastBeat = time.Now()
+				s.lock.Unlock()
 			}
+			timer = time.NewTimer(nextBeat())
+		case <-interval.changeChan:
+			// Apply new interval right away
+			log.Info().Str("interval", interval.Get().String()).Msg("heartbeat interval changed")
+			timer.Stop()
+			timer = time.NewTimer(nextBeat())
 		case <-s.stopChan:
 			s.stopChan = nil
 		case <-s.disableChan:
@@ -164,7 +380,12 @@ func (s *Service) Run() derrors.Error {
 		}
 	}
 
+	cleanup = nil
+	watcher.Stop()
+	renewer.Stop()
+	streamer.Stop()
 	derr = dispatcher.Stop(s.Config.GetDuration("agent.shutdown_timeout"))
+	bandwidth.Flush()
 
 	// Only disabled, still waiting for stop
 	if s.stopChan != nil {
@@ -175,6 +396,105 @@ func (s *Service) Run() derrors.Error {
 	return derr
 }
 
+// Make the components of the running service available to other
+// goroutines, or clear them when it stops
+func (s *Service) setRunning(dispatcher *Dispatcher, worker *Worker, interval *heartbeatInterval, health *healthTracker) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.dispatcher = dispatcher
+	s.worker = worker
+	s.interval = interval
+	s.health = health
+}
+
+// Queue length per operation lane; lanes without a configured length use
+// the default operation queue length.
+func (s *Service) laneLen() map[Lane]int {
+	laneLen := make(map[Lane]int, len(Lanes))
+	for _, lane := range Lanes {
+		laneLen[lane] = s.Config.GetInt(fmt.Sprintf("agent.lanes.%s.queue_len", lane.String()))
+	}
+
+	return laneLen
+}
+
+// Agent status reporter if enabled; nil otherwise
+func (s *Service) agentStatus(dispatcher *Dispatcher) *agentStatus {
+	if !s.Config.GetBool("agent.status.enabled") {
+		return nil
+	}
+
+	return newAgentStatus(dispatcher, s.Client, s.Config)
+}
+
+// Configuration file watcher if enabled; nil otherwise
+func (s *Service) configWatcher() *configWatcher {
+	if !s.Config.GetBool("agent.watch_config") || s.Config.ConfigFile == "" {
+		return nil
+	}
+
+	return newConfigWatcher(s.Config.ConfigFile, s.Reload)
+}
+
+// Bandwidth budget if there's a limit; nil otherwise
+func (s *Service) budget() (*budget, derrors.Error) {
+	limit := s.Config.GetSizeInBytes("agent.budget.limit")
+	if limit == 0 {
+		return nil, nil
+	}
+
+	opts := &BudgetOptions{
+		Limit:       uint64(limit),
+		Period:      BudgetPeriod(s.Config.GetString("agent.budget.period")),
+		ReduceAt:    s.Config.GetFloat64("agent.budget.reduce_at"),
+		StretchAt:   s.Config.GetFloat64("agent.budget.stretch_at"),
+		MaxInterval: s.Config.GetDuration("agent.budget.max_interval"),
+
+		WriteInterval: s.Config.GetDuration("agent.budget.write_interval"),
+	}
+
+	return newBudget(s.Client, filepath.Join(s.Config.Path, defaults.BudgetFile), opts)
+}
+
+// Operation stream if enabled; nil otherwise
+func (s *Service) streamer(dispatcher *Dispatcher, assetId string) *Streamer {
+	if !s.Config.GetBool("controller.stream") {
+		return nil
+	}
+
+	reconnect := backoff.Policy{
+		Initial:    s.Config.GetDuration("agent.stream.reconnect_interval"),
+		Max:        s.Config.GetDuration("agent.stream.max_reconnect_interval"),
+		Multiplier: 2,
+		Jitter:     s.Config.GetFloat64("agent.interval_jitter"),
+	}
+
+	return NewStreamer(s.Client, dispatcher, assetId, reconnect)
+}
+
+// Retry policy for operation responses; retrying is disabled if there is
+// no maximum age for responses.
+func (s *Service) retryOptions() *RetryOptions {
+	maxAge := s.Config.GetDuration("agent.retry.max_age")
+	if maxAge <= 0 {
+		return nil
+	}
+
+	opts := &RetryOptions{
+		Policy: backoff.Policy{
+			Initial:    s.Config.GetDuration("agent.retry.initial_interval"),
+			Max:        s.Config.GetDuration("agent.retry.max_interval"),
+			Multiplier: s.Config.GetFloat64("agent.retry.multiplier"),
+			Jitter:     s.Config.GetFloat64("agent.retry.jitter"),
+		},
+		MaxAge:    maxAge,
+		BufferLen: s.Config.GetInt("agent.retry.buffer_len"),
+	}
+
+	return opts
+}
+
 func (s *Service) errChanRun(errChan chan<- derrors.Error) {
 	derr := s.Run()
 	errChan <- derr
@@ -199,13 +519,82 @@ func (s *Service) Stop() {
 
 func (s *Service) Alive() (bool, derrors.Error) {
 	// If last successfull main loop run is longer than twice the heartbeat
-	// interval ago, we are not alive
-	if time.Since(s.lastBeat) > 2*s.Config.GetDuration("agent.interval") {
+	// interval in effect ago, we are not alive
+	s.lock.Lock()
+	interval, health := s.interval, s.health
+	lastBeat, beatDelay := s.lastBeat, s.beatDelay
+	s.lock.Unlock()
+
+	maxDelay := s.Config.GetDuration("agent.interval")
+	if interval != nil {
+		maxDelay = interval.MaxDelay()
+	}
+	if beatDelay > maxDelay {
+		maxDelay = beatDelay
+	}
+	if time.Since(lastBeat) > 2*maxDelay {
+		return false, nil
+	}
+
+	// We can't do without critical plugins
+	failed := health.Failed()
+	if len(failed) > 0 {
+		log.Warn().Interface("plugins", failed).Msg("critical plugins failing")
 		return false, nil
 	}
+
 	return true, nil
 }
 
+// CancelOperation implements core.Operations
+func (s *Service) CancelOperation(id string) derrors.Error {
+	s.lock.Lock()
+	dispatcher := s.dispatcher
+	s.lock.Unlock()
+
+	if dispatcher == nil {
+		return derrors.NewUnavailableError("agent not running operations")
+	}
+
+	return dispatcher.Cancel(id)
+}
+
+// SetInterval implements core.Heartbeat
+func (s *Service) SetInterval(interval time.Duration) (time.Duration, derrors.Error) {
+	s.lock.Lock()
+	current := s.interval
+	s.lock.Unlock()
+
+	if current == nil {
+		return 0, derrors.NewUnavailableError("agent not sending heartbeats")
+	}
+
+	return current.Set(interval), nil
+}
+
+// RotateToken implements core.Credentials
+func (s *Service) RotateToken(token string) derrors.Error {
+	s.lock.Lock()
+	agentClient := s.Client
+	s.lock.Unlock()
+
+	if agentClient == nil {
+		return derrors.NewUnavailableError("agent not connected to edge controller")
+	}
+
+	// The old token might be revoked as soon as the Edge Controller
+	// knows we received the new one, so we start using it right away
+	agentClient.SetToken(token)
+
+	derr := s.Config.SetAndWrite("agent.token", token)
+	if derr != nil {
+		return derrors.NewInternalError("using new token, but failed storing it", derr)
+	}
+
+	log.Info().Msg("agent token rotated")
+	return nil
+}
+
 func (s *Service) Disable() {
 	// Recover to avoid race conditions stopping and uninstalling
 	// simultaneously, or running multiple uninstalls
@@ -18,15 +18,49 @@
 package run
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-inventory-manager-go"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/service-net-agent/internal/pkg/config"
 
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 )
 
 var _ = ginkgo.Describe("service", func() {
+	ginkgo.It("should not set interval when not running", func() {
+		s := Service{
+			Config: testConfig,
+			Client: testClient,
+		}
+
+		_, derr := s.SetInterval(time.Second)
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should rotate token", func() {
+		s := &Service{
+			Config: testConfig,
+			Client: testClient,
+		}
+		defer testClient.SetToken("")
+
+		gomega.Expect(s.RotateToken("new-token")).To(gomega.Succeed())
+		gomega.Expect(testConfig.GetString("agent.token")).To(gomega.Equal("new-token"))
+
+		stored := config.NewConfig()
+		stored.ConfigFile = testConfigFile
+		gomega.Expect(stored.Read()).To(gomega.Succeed())
+		gomega.Expect(stored.GetString("agent.token")).To(gomega.Equal("new-token"))
+	})
+
 	ginkgo.It("should start, run and stop", func() {
 		s := Service{
 			Config: testConfig,
@@ -60,6 +94,11 @@ var _ = ginkgo.Describe("service", func() {
 		gomega.Expect(derr).To(gomega.Succeed())
 
 		gomega.Expect(testHandler.GetNumChecks()).To(gomega.BeNumerically(">=", cur+2))
+
+		// Nothing left to control once stopped
+		_, derr = s.SetInterval(time.Second)
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+		gomega.Expect(s.CancelOperation("op")).ToNot(gomega.Succeed())
 	})
 	ginkgo.It("should start, run and disable and stop", func() {
 		s := Service{
@@ -103,4 +142,85 @@ var _ = ginkgo.Describe("service", func() {
 		derr = <-errChan // wait until done
 		gomega.Expect(derr).To(gomega.Succeed())
 	})
+
+	ginkgo.Context("reloading configuration", func() {
+		var s *Service
+		var configFile string
+
+		// Extra agent and controller settings are indented to go in
+		// their sections
+		writeSettings := func(interval string, agent string, controller string, plugins string) {
+			data := fmt.Sprintf("agent:\n  token: token\n  asset_id: test-asset\n  interval: %s\n  health:\n    failing_after: 1\n%s"+
+				"controller:\n  address: localhost:5000\n%s%s", interval, agent, controller, plugins)
+			gomega.Expect(ioutil.WriteFile(configFile, []byte(data), 0600)).To(gomega.Succeed())
+		}
+		writeConfig := func(interval string, plugins string) {
+			writeSettings(interval, "", "", plugins)
+		}
+
+		ginkgo.BeforeEach(func() {
+			configFile = filepath.Join(testPath, "reload.yaml")
+			writeConfig("10s", "")
+
+			conf := config.NewConfig()
+			conf.Path = testPath
+			conf.ConfigFile = configFile
+			gomega.Expect(conf.Read()).To(gomega.Succeed())
+
+			s = &Service{
+				Config:   conf,
+				Client:   testClient,
+				interval: newHeartbeatInterval(10*time.Second, 0, 0, 0),
+			}
+			gomega.Expect(s.Validate()).To(gomega.Succeed())
+		})
+
+		ginkgo.AfterEach(func() {
+			plugin.StopPlugin(testPlugin)
+			os.Remove(configFile)
+		})
+
+		ginkgo.It("should apply a new configuration", func() {
+			writeConfig("20s", fmt.Sprintf("%s:\n  %s:\n    enabled: true\n", plugin.DefaultPluginPrefix, testPlugin))
+			gomega.Expect(s.Reload()).To(gomega.Succeed())
+
+			gomega.Expect(s.interval.Get()).To(gomega.Equal(20 * time.Second))
+			gomega.Expect(plugin.DefaultRegistry().Running()).To(gomega.HaveKey(plugin.PluginName(testPlugin)))
+		})
+
+		ginkgo.It("should reject an invalid configuration", func() {
+			writeConfig("-1s", "")
+			gomega.Expect(s.Reload()).ToNot(gomega.Succeed())
+
+			gomega.Expect(s.Config.GetDuration("agent.interval")).To(gomega.Equal(10 * time.Second))
+			gomega.Expect(s.interval.Get()).To(gomega.Equal(10 * time.Second))
+		})
+
+		ginkgo.It("should apply a new operation queue length", func() {
+			s.dispatcher = &Dispatcher{}
+			writeSettings("10s", "  opqueue_len: 2\n", "", "")
+			gomega.Expect(s.Reload()).To(gomega.Succeed())
+
+			op := &grpc_inventory_manager_go.AgentOpRequest{}
+			for _, id := range []string{"queuedop1", "queuedop2"} {
+				op.OperationId = id
+				tracked, _ := s.dispatcher.track(op, LaneNormal, false)
+				gomega.Expect(tracked).To(gomega.BeTrue())
+			}
+			op.OperationId = "queuedop3"
+			tracked, _ := s.dispatcher.track(op, LaneNormal, false)
+			gomega.Expect(tracked).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("should reject controller TLS settings it can't apply", func() {
+			writeSettings("20s", "", "  tls: true\n  pins:\n  - invalid\n", "")
+			derr := s.Reload()
+			gomega.Expect(derr).To(gomega.HaveOccurred())
+			gomega.Expect(derr.Type()).To(gomega.Equal(derrors.InvalidArgument))
+
+			// Nothing applied
+			gomega.Expect(s.Config.GetBool("controller.tls")).To(gomega.BeFalse())
+			gomega.Expect(s.interval.Get()).To(gomega.Equal(10 * time.Second))
+		})
+	})
 })
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Agent status reported with each heartbeat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin/metrics"
+	"github.com/nalej/service-net-agent/internal/pkg/client"
+	"github.com/nalej/service-net-agent/internal/pkg/config"
+	"github.com/nalej/service-net-agent/version"
+
+	"google.golang.org/grpc/status"
+)
+
+// Name of the metric reporting agent status to the Edge Controller
+const agentStatusMetric = "agent_status"
+
+// What the agent was doing when the last error happened. Tags are indexed
+// by the Edge Controller, so we only report one of these and the type of
+// error, not the error message.
+const (
+	errorClassHeartbeat = "heartbeat"
+	errorClassPlugin    = "plugin"
+)
+
+// The internals of the agent itself, reported to the Edge Controller
+// alongside the plugin data in each heartbeat, so it can see what the
+// agent is up to without logging in to the asset.
+//
+// All methods can be called on a nil agentStatus, in which case nothing
+// is reported.
+type agentStatus struct {
+	started    time.Time
+	dispatcher *Dispatcher
+	client     *client.AgentClient
+	config     *config.Config
+
+	lock          sync.Mutex
+	lastError     string
+	lastErrorCode string
+	lastErrorTime time.Time
+}
+
+func newAgentStatus(dispatcher *Dispatcher, agentClient *client.AgentClient, config *config.Config) *agentStatus {
+	return &agentStatus{
+		started:    time.Now(),
+		dispatcher: dispatcher,
+		client:     agentClient,
+		config:     config,
+	}
+}
+
+// Record an error to report as last error, with one of the error classes
+func (s *agentStatus) SetError(class string, err error) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastError = class
+	s.lastErrorCode = errorCode(err)
+	s.lastErrorTime = time.Now()
+}
+
+// The type of an error, which is one of a few
+func errorCode(err error) string {
+	if derr, ok := err.(derrors.Error); ok {
+		return string(derr.Type())
+	}
+	return status.Code(err).String()
+}
+
+// Heartbeat data with the agent status, as metric with the version, Edge
+// Controller endpoint and class and type of the last error as tags.
+func (s *agentStatus) HeartbeatData() agentplugin.PluginHeartbeatData {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	tags := map[string]string{
+		"version": version.AppVersion,
+		"commit":  version.Commit,
+	}
+	fields := map[string]uint64{
+		"uptime":            uint64(now.Sub(s.started) / time.Second),
+		"config_generation": s.config.Generation(),
+	}
+
+	if s.client != nil {
+		tags["controller"] = s.client.Address()
+	}
+
+	if s.dispatcher != nil {
+		status := s.dispatcher.Status()
+		fields["queued_ops"] = uint64(status.Queued)
+		fields["executing_ops"] = uint64(status.Executing)
+		fields["scheduled_ops"] = uint64(status.Scheduled)
+		fields["failed_callbacks"] = status.FailedCallbacks
+	}
+
+	if s.lastError != "" {
+		tags["last_error"] = s.lastError
+		tags["last_error_code"] = s.lastErrorCode
+		fields["last_error_time"] = uint64(s.lastErrorTime.UTC().Unix())
+	}
+
+	data := &metrics.MetricsData{
+		Timestamp: now,
+		Metrics: []*metrics.Metric{
+			&metrics.Metric{
+				Name:   agentStatusMetric,
+				Tags:   tags,
+				Fields: fields,
+			},
+		},
+	}
+
+	return data
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-inventory-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin/metrics"
+	"github.com/nalej/service-net-agent/version"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = ginkgo.Describe("agent status", func() {
+	var d *Dispatcher
+
+	ginkgo.BeforeEach(func() {
+		var derr error
+		d, derr = NewDispatcher(testClient, NewWorker(testConfig), &DispatcherOptions{QueueLen: 10})
+		gomega.Expect(derr).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(d.Stop(time.Second)).To(gomega.Succeed())
+	})
+
+	getMetric := func(s *agentStatus) *metrics.Metric {
+		data := s.HeartbeatData()
+		gomega.Expect(data).To(gomega.BeAssignableToTypeOf(&metrics.MetricsData{}))
+
+		metricsData := data.(*metrics.MetricsData)
+		gomega.Expect(metricsData.Metrics).To(gomega.HaveLen(1))
+		gomega.Expect(metricsData.Metrics[0].Name).To(gomega.Equal(agentStatusMetric))
+
+		return metricsData.Metrics[0]
+	}
+
+	ginkgo.It("should report agent internals", func() {
+		s := newAgentStatus(d, nil, testConfig)
+		metric := getMetric(s)
+
+		gomega.Expect(metric.Tags).To(gomega.HaveKeyWithValue("version", version.AppVersion))
+		gomega.Expect(metric.Tags).ToNot(gomega.HaveKey("last_error"))
+		gomega.Expect(metric.Fields).To(gomega.HaveKeyWithValue("queued_ops", uint64(0)))
+		gomega.Expect(metric.Fields).To(gomega.HaveKeyWithValue("executing_ops", uint64(0)))
+		gomega.Expect(metric.Fields).To(gomega.HaveKeyWithValue("failed_callbacks", uint64(0)))
+		gomega.Expect(metric.Fields).To(gomega.HaveKeyWithValue("config_generation", testConfig.Generation()))
+		gomega.Expect(metric.Fields).To(gomega.HaveKey("uptime"))
+	})
+
+	ginkgo.It("should report last error", func() {
+		s := newAgentStatus(d, nil, testConfig)
+		s.SetError(errorClassHeartbeat, status.Error(codes.Unavailable, "connection refused to 10.0.0.1"))
+		metric := getMetric(s)
+
+		gomega.Expect(metric.Tags).To(gomega.HaveKeyWithValue("last_error", errorClassHeartbeat))
+		gomega.Expect(metric.Tags).To(gomega.HaveKeyWithValue("last_error_code", codes.Unavailable.String()))
+		gomega.Expect(metric.Fields).To(gomega.HaveKey("last_error_time"))
+
+		s.SetError(errorClassPlugin, derrors.NewDeadlineExceededError("plugin timed out"))
+		metric = getMetric(s)
+
+		gomega.Expect(metric.Tags).To(gomega.HaveKeyWithValue("last_error", errorClassPlugin))
+		gomega.Expect(metric.Tags).To(gomega.HaveKeyWithValue("last_error_code", string(derrors.DeadlineExceeded)))
+	})
+
+	ginkgo.It("should report failed callbacks", func() {
+		testHandler.FailCallbacks(1)
+		defer testHandler.FailCallbacks(0)
+
+		s := newAgentStatus(d, nil, testConfig)
+		gomega.Expect(d.sendResponse(d.newResponse(newBlockRequest("status", 0), grpc_inventory_go.OpStatus_SUCCESS, ""))).To(gomega.BeFalse())
+
+		metric := getMetric(s)
+		gomega.Expect(metric.Fields).To(gomega.HaveKeyWithValue("failed_callbacks", uint64(1)))
+	})
+
+	ginkgo.It("should not report when nil", func() {
+		var s *agentStatus
+		s.SetError(errorClassHeartbeat, fmt.Errorf("failed"))
+		gomega.Expect(s.HeartbeatData()).To(gomega.BeNil())
+	})
+})
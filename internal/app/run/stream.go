@@ -0,0 +1,184 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Operations pushed by the Edge Controller over a long-lived stream
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/grpc-edge-controller-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
+	"github.com/nalej/service-net-agent/internal/pkg/client"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Streamer keeps an operation stream open to the Edge Controller, so
+// operations are dispatched as soon as they are sent instead of with the
+// next heartbeat. Heartbeats keep on running regardless, so when the
+// stream can't be established we simply fall back to receiving operations
+// by polling; operations received both ways are only executed once
+// thanks to the operation cache.
+//
+// Streaming is not part of the Edge Controller protocol yet, so it's off by
+// default and needs an Edge Controller that implements opstream.
+//
+// All methods can be called on a nil Streamer, which never connects.
+type Streamer struct {
+	client     *client.AgentClient
+	dispatcher *Dispatcher
+	assetId    string
+
+	// Delay between attempts to (re-)establish the stream
+	reconnect backoff.Policy
+
+	connected int32
+	cancel    context.CancelFunc
+	waitgroup sync.WaitGroup
+}
+
+func NewStreamer(client *client.AgentClient, dispatcher *Dispatcher, assetId string, reconnect backoff.Policy) *Streamer {
+	s := &Streamer{
+		client:     client,
+		dispatcher: dispatcher,
+		assetId:    assetId,
+		reconnect:  reconnect,
+	}
+
+	return s
+}
+
+// Start keeping the stream open in the background
+func (s *Streamer) Start() {
+	if s == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	s.waitgroup.Add(1)
+	go s.loop(ctx)
+}
+
+// Stop closes the stream; no operations are dispatched after this
+func (s *Streamer) Stop() {
+	if s == nil || s.cancel == nil {
+		return
+	}
+
+	s.cancel()
+	s.waitgroup.Wait()
+}
+
+// Connected returns whether operations are currently being streamed
+func (s *Streamer) Connected() bool {
+	if s == nil {
+		return false
+	}
+
+	return atomic.LoadInt32(&s.connected) == 1
+}
+
+func (s *Streamer) loop(ctx context.Context) {
+	defer s.waitgroup.Done()
+
+	log.Debug().Msg("starting operation stream")
+
+	delay := backoff.NewBackoff(s.reconnect)
+	for ctx.Err() == nil {
+		derr := s.receive(ctx, delay)
+		if ctx.Err() != nil {
+			break
+		}
+		log.Warn().Err(derr).Msg("operation stream unavailable, relying on heartbeat for operations")
+
+		select {
+		case <-time.After(delay.Next()):
+		case <-ctx.Done():
+		}
+	}
+
+	log.Debug().Msg("stopped operation stream")
+}
+
+// Open the stream and dispatch operations until it fails. The backoff is
+// reset once the stream is established.
+func (s *Streamer) receive(ctx context.Context, delay *backoff.Backoff) derrors.Error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := s.client.OperationStream(streamCtx)
+	if err != nil {
+		return derrors.NewUnavailableError("failed opening operation stream", err)
+	}
+
+	// Identify ourselves
+	err = stream.Send(&grpc_edge_controller_go.AgentCheckRequest{
+		AssetId:   s.assetId,
+		Timestamp: time.Now().UTC().Unix(),
+	})
+	if err != nil {
+		return derrors.NewUnavailableError("failed opening operation stream", err)
+	}
+
+	// The Edge Controller sends headers when it accepts the stream;
+	// one that doesn't implement streaming fails here
+	_, err = stream.Header()
+	if err != nil {
+		if ctx.Err() == nil {
+			err = s.client.RecordStreamError(err)
+		}
+		return derrors.NewUnavailableError("operation stream not accepted by edge controller", err)
+	}
+	atomic.StoreInt32(&s.connected, 1)
+	log.Info().Msg("operation stream established")
+	delay.Reset()
+
+	for {
+		operation, err := stream.Recv()
+		if err == io.EOF {
+			atomic.StoreInt32(&s.connected, 0)
+			return derrors.NewUnavailableError("operation stream closed by edge controller")
+		}
+		if err != nil {
+			atomic.StoreInt32(&s.connected, 0)
+			// Being stopped is not a connection problem
+			if ctx.Err() == nil {
+				err = s.client.RecordStreamError(err)
+			}
+			return derrors.NewUnavailableError("operation stream failed", err)
+		}
+
+		log.Debug().Str("operation_id", operation.GetOperationId()).Msg("operation received on stream")
+		derr := dispatchOperations(s.dispatcher, s.assetId, []*grpc_inventory_manager_go.AgentOpRequest{operation})
+		if derr != nil {
+			atomic.StoreInt32(&s.connected, 0)
+			return derr
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+import (
+	"time"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("streamer", func() {
+	var d *Dispatcher
+	var streamer *Streamer
+
+	ginkgo.BeforeEach(func() {
+		var derr error
+		d, derr = NewDispatcher(testClient, NewWorker(testConfig), &DispatcherOptions{QueueLen: 10})
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		streamer = NewStreamer(testClient, d, "test-asset", backoff.Policy{Initial: 10 * time.Millisecond})
+	})
+
+	ginkgo.AfterEach(func() {
+		testHandler.FailStreams(0)
+		streamer.Stop()
+		gomega.Expect(d.Stop(time.Second)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should dispatch streamed operations", func() {
+		cur := testHandler.GetNumCallbacks()
+		streamer.Start()
+
+		gomega.Eventually(streamer.Connected).Should(gomega.BeTrue())
+
+		// Three operations, scheduled and succeeded, equals 6 callbacks
+		gomega.Eventually(testHandler.GetNumCallbacks).Should(gomega.Equal(cur + 6))
+	})
+
+	ginkgo.It("should reconnect when stream is unavailable", func() {
+		cur := testHandler.GetNumStreams()
+		testHandler.FailStreams(2)
+		streamer.Start()
+
+		gomega.Eventually(streamer.Connected).Should(gomega.BeTrue())
+		gomega.Expect(testHandler.GetNumStreams()).To(gomega.Equal(cur + 1))
+	})
+
+	ginkgo.It("should be disconnected when stopped", func() {
+		streamer.Start()
+		gomega.Eventually(streamer.Connected).Should(gomega.BeTrue())
+
+		streamer.Stop()
+		gomega.Expect(streamer.Connected()).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should not connect when nil", func() {
+		var nilStreamer *Streamer
+		nilStreamer.Start()
+		gomega.Expect(nilStreamer.Connected()).To(gomega.BeFalse())
+		nilStreamer.Stop()
+	})
+})
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package run
+
+// Plugin with a long-running command, for testing operation scheduling
+
+import (
+	"context"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/grpc-inventory-manager-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	testBlockPlugin = "block"
+)
+
+var blockDescriptor = plugin.PluginDescriptor{
+	Name:        testBlockPlugin,
+	Description: "test plugin with long-running command",
+	NewFunc:     newBlock,
+}
+
+type block struct {
+	plugin.BasePlugin
+}
+
+func init() {
+	blockCmd := plugin.CommandDescriptor{
+		Name:        "block",
+		Description: "block for duration or until cancelled, optionally reporting progress",
+	}
+	blockDescriptor.AddCommand(blockCmd)
+
+	plugin.Register(&blockDescriptor)
+}
+
+func newBlock(config *viper.Viper) (plugin.Plugin, derrors.Error) {
+	return &block{}, nil
+}
+
+func (b *block) GetPluginDescriptor() *plugin.PluginDescriptor {
+	return &blockDescriptor
+}
+
+func (b *block) GetCommandFunc(cmd plugin.CommandName) plugin.CommandFunc {
+	if cmd == "block" {
+		return b.block
+	}
+	return nil
+}
+
+func (b *block) block(ctx context.Context, params map[string]string) (string, derrors.Error) {
+	duration, err := time.ParseDuration(params["duration"])
+	if err != nil {
+		return "", derrors.NewInvalidArgumentError("invalid duration", err)
+	}
+
+	if message, found := params["progress"]; found {
+		agentplugin.ReportProgress(ctx, 50, message)
+	}
+
+	select {
+	case <-time.After(duration):
+		return "unblocked", nil
+	case <-ctx.Done():
+		return "", derrors.NewDeadlineExceededError("block interrupted", ctx.Err())
+	}
+}
+
+// Operation request for the block plugin
+func newBlockRequest(id string, duration time.Duration) *grpc_inventory_manager_go.AgentOpRequest {
+	return &grpc_inventory_manager_go.AgentOpRequest{
+		AssetId:     "testasset",
+		Plugin:      testBlockPlugin,
+		Operation:   "block",
+		OperationId: id,
+		Params: map[string]string{
+			"duration": duration.String(),
+		},
+	}
+}
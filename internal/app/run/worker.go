@@ -22,6 +22,8 @@ package run
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nalej/derrors"
@@ -34,22 +36,39 @@ import (
 	"github.com/spf13/viper"
 )
 
+const (
+	// Operation parameters starting with this prefix are for the agent
+	// and are not passed to plugins
+	reservedParamPrefix = "_"
+
+	// Maximum duration of the operation, e.g. "90s"
+	timeoutParam = reservedParamPrefix + "timeout"
+	// Absolute deadline of the operation, in RFC3339 format
+	deadlineParam = reservedParamPrefix + "deadline"
+
+	// Plugin configuration below this key is for the agent and is not
+	// passed to plugins, so it doesn't get in the way of their settings
+	pluginAgentKey = reservedParamPrefix + "agent"
+
+	// Plugin configuration with default and maximum operation timeout
+	pluginTimeoutKey    = pluginAgentKey + ".timeout"
+	pluginMaxTimeoutKey = pluginAgentKey + ".max_timeout"
+)
+
 // Worker instance handles the actual execution of a plugin operation and the
 // interaction with the plugin infrastructure.
 //
-// Currently, we have a single worker; if we introduce parallel operation
-// execution in the agent, we will have likely a worker per running plugin.
-// We also have one thread dispatching work,
-// so all operations are serialized. If we introduce multiple dispatcher
-// threads, we need to ensure that operations are still in the right order;
-// at least per plugin. We can either maintain a single worker with proper
-// locking to ensure this, or dynamically create a worker per plugin and
-// make sure the worker always executes in a serial manner. We also have to
-// take care that a single plugin (with serialized actions) shouldn't block
-// all (or actually, more than one) dispatcher thread.
+// We have a single worker that is shared by all operations. The dispatcher
+// makes sure operations for the same plugin are executed one after the
+// other, while operations for different plugins can be executed in
+// parallel; hence, Execute can be called concurrently for different
+// plugins and the worker takes care of locking shared state such as the
+// configuration.
 
 type Worker struct {
-	config *config.Config
+	// Serializes updates of plugin configuration and protects config
+	configLock sync.Mutex
+	config     *config.Config
 }
 
 func NewWorker(config *config.Config) *Worker {
@@ -60,10 +79,40 @@ func NewWorker(config *config.Config) *Worker {
 	return w
 }
 
+// SetConfig replaces the plugin configuration, after it's reloaded
+func (w *Worker) SetConfig(config *config.Config) {
+	w.configLock.Lock()
+	defer w.configLock.Unlock()
+
+	w.config = config
+}
+
+func (w *Worker) getConfig() *config.Config {
+	w.configLock.Lock()
+	defer w.configLock.Unlock()
+
+	return w.config
+}
+
 func (w *Worker) Execute(ctx context.Context, name plugin.PluginName, cmd plugin.CommandName, params map[string]string) (string, derrors.Error) {
 	var result string
 	var derr derrors.Error = nil
 
+	timeout, deadline, derr := w.operationTimeout(name, params)
+	if derr != nil {
+		return "", derr
+	}
+	if !deadline.IsZero() {
+		// Waited in the queue for too long
+		if !time.Now().Before(deadline) {
+			return "", derrors.NewDeadlineExceededError("operation deadline passed before execution").WithParams(deadline.String())
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	params = pluginParams(params)
+
 	switch cmd {
 	case plugin.StartCommand:
 		config := createPluginConfig(params)
@@ -80,7 +129,7 @@ func (w *Worker) Execute(ctx context.Context, name plugin.PluginName, cmd plugin
 			result = fmt.Sprintf("%s disabled", name.String())
 		}
 	default:
-		execCtx, cancel := context.WithTimeout(ctx, defaults.AgentOpTimeout*time.Second)
+		execCtx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 		result, derr = plugin.ExecuteCommand(execCtx, name, cmd, params)
 	}
@@ -88,14 +137,77 @@ func (w *Worker) Execute(ctx context.Context, name plugin.PluginName, cmd plugin
 	return result, derr
 }
 
+// Timeout and optional deadline for an operation. The timeout is taken
+// from the operation parameters, the plugin configuration or the agent
+// default, in that order, and is limited by the maximum in the plugin
+// configuration.
+func (w *Worker) operationTimeout(name plugin.PluginName, params map[string]string) (time.Duration, time.Time, derrors.Error) {
+	var deadline time.Time
+	conf := w.getConfig()
+
+	timeout := defaults.AgentOpTimeout * time.Second
+	if configured := conf.GetDuration(fmt.Sprintf("%s.%s", name.String(), pluginTimeoutKey)); configured > 0 {
+		timeout = configured
+	}
+
+	if value, found := params[timeoutParam]; found {
+		requested, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, deadline, derrors.NewInvalidArgumentError("invalid operation timeout", err).WithParams(value)
+		}
+		if requested <= 0 {
+			return 0, deadline, derrors.NewInvalidArgumentError("operation timeout must be positive").WithParams(value)
+		}
+		timeout = requested
+	}
+
+	maxTimeout := conf.GetDuration(fmt.Sprintf("%s.%s", name.String(), pluginMaxTimeoutKey))
+	if maxTimeout > 0 && timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+
+	if value, found := params[deadlineParam]; found {
+		var err error
+		deadline, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return 0, deadline, derrors.NewInvalidArgumentError("invalid operation deadline", err).WithParams(value)
+		}
+	}
+
+	return timeout, deadline, nil
+}
+
+// Parameters to pass to a plugin, without those reserved for the agent
+func pluginParams(params map[string]string) map[string]string {
+	filtered := make(map[string]string, len(params))
+	for k, v := range params {
+		if strings.HasPrefix(k, reservedParamPrefix) {
+			continue
+		}
+		filtered[k] = v
+	}
+
+	return filtered
+}
+
 func (w *Worker) writePluginConfig(name plugin.PluginName, config *viper.Viper) {
 	confName := name.String()
 
+	w.configLock.Lock()
+	defer w.configLock.Unlock()
+
 	log.Debug().Str("name", confName).Msg("writing plugin configuration")
 	if config == nil {
 		w.config.Unset(confName)
 	} else {
+		// Keep what's configured for the agent, which doesn't come
+		// with the plugin configuration
+		agentKey := fmt.Sprintf("%s.%s", confName, pluginAgentKey)
+		agentConf := w.config.Get(agentKey)
 		w.config.ReplaceSubtree(confName, config)
+		if agentConf != nil {
+			w.config.Set(agentKey, agentConf)
+		}
 		// We always set something to make to config file entry exist
 		w.config.Set(fmt.Sprintf("%s.enabled", confName), true)
 	}
@@ -107,6 +219,24 @@ func (w *Worker) writePluginConfig(name plugin.PluginName, config *viper.Viper)
 	}
 }
 
+// Plugin configuration to pass to a plugin, without what's reserved for
+// the agent
+func pluginConfig(conf *viper.Viper) *viper.Viper {
+	if conf == nil {
+		return nil
+	}
+
+	filtered := viper.New()
+	for k, v := range conf.AllSettings() {
+		if k == pluginAgentKey {
+			continue
+		}
+		filtered.Set(k, v)
+	}
+
+	return filtered
+}
+
 func createPluginConfig(params map[string]string) *viper.Viper {
 	conf := viper.New()
 	for k, v := range params {
@@ -19,6 +19,10 @@ package run
 
 import (
 	"context"
+	"time"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/infra-net-plugin"
 
 	"github.com/nalej/service-net-agent/internal/pkg/config"
 
@@ -65,6 +69,112 @@ var _ = ginkgo.Describe("worker", func() {
 		gomega.Expect(worker.Execute(context.Background(), testPlugin, "ping", params)).To(gomega.Equal("pong test"))
 	})
 
+	ginkgo.It("should not pass reserved parameters to plugin", func() {
+		params := map[string]string{
+			"testparam1": "value1",
+			"_timeout":   "10s",
+		}
+
+		worker := NewWorker(testConfig.GetSubConfig("test"))
+		gomega.Expect(worker.Execute(context.Background(), testPlugin, "start", params)).To(gomega.Equal("ping enabled"))
+
+		c2 := config.NewConfig()
+		c2.ConfigFile = testConfigFile
+		gomega.Expect(c2.Read()).To(gomega.Succeed())
+		gomega.Expect(c2.GetStringMapString("test." + testPlugin)).ToNot(gomega.HaveKey("_timeout"))
+	})
+
+	ginkgo.It("should keep agent configuration of plugin apart", func() {
+		worker := NewWorker(testConfig.GetSubConfig("test"))
+		worker.config.Set(testPlugin+"."+pluginTimeoutKey, "5s")
+		worker.config.Set(testPlugin+".timeout", "plugin setting")
+
+		params := map[string]string{
+			"testparam1": "value1",
+		}
+		gomega.Expect(worker.Execute(context.Background(), testPlugin, "start", params)).To(gomega.Equal("ping enabled"))
+		gomega.Expect(worker.config.GetDuration(testPlugin + "." + pluginTimeoutKey)).To(gomega.Equal(5 * time.Second))
+		gomega.Expect(worker.config.GetString(testPlugin + ".testparam1")).To(gomega.Equal("value1"))
+		gomega.Expect(worker.config.IsSet(testPlugin + ".timeout")).To(gomega.BeFalse())
+
+		conf := pluginConfig(worker.config.Sub(testPlugin))
+		gomega.Expect(conf.IsSet(pluginAgentKey)).To(gomega.BeFalse())
+		gomega.Expect(conf.GetString("testparam1")).To(gomega.Equal("value1"))
+	})
+
+	ginkgo.Context("timeouts", func() {
+		var worker *Worker
+
+		ginkgo.BeforeEach(func() {
+			gomega.Expect(plugin.StartPlugin(testBlockPlugin, nil)).To(gomega.Succeed())
+			worker = NewWorker(testConfig.GetSubConfig("test"))
+		})
+
+		ginkgo.AfterEach(func() {
+			worker.config.Unset(testBlockPlugin)
+		})
+
+		ginkgo.It("should use timeout from parameters", func() {
+			params := map[string]string{
+				"duration": "1m",
+				"_timeout": "10ms",
+			}
+			_, derr := worker.Execute(context.Background(), testBlockPlugin, "block", params)
+			gomega.Expect(derr).To(gomega.HaveOccurred())
+			gomega.Expect(derr.Type()).To(gomega.Equal(derrors.DeadlineExceeded))
+		})
+
+		ginkgo.It("should use timeout from plugin configuration", func() {
+			worker.config.Set(testBlockPlugin+"."+pluginTimeoutKey, "10ms")
+			params := map[string]string{
+				"duration": "1m",
+			}
+			_, derr := worker.Execute(context.Background(), testBlockPlugin, "block", params)
+			gomega.Expect(derr).To(gomega.HaveOccurred())
+		})
+
+		ginkgo.It("should limit timeout to plugin maximum", func() {
+			worker.config.Set(testBlockPlugin+"."+pluginMaxTimeoutKey, "10ms")
+			params := map[string]string{
+				"duration": "1m",
+				"_timeout": "1h",
+			}
+			_, derr := worker.Execute(context.Background(), testBlockPlugin, "block", params)
+			gomega.Expect(derr).To(gomega.HaveOccurred())
+		})
+
+		ginkgo.It("should use deadline from parameters", func() {
+			params := map[string]string{
+				"duration":  "1m",
+				"_deadline": time.Now().Add(time.Second).Format(time.RFC3339),
+			}
+			start := time.Now()
+			_, derr := worker.Execute(context.Background(), testBlockPlugin, "block", params)
+			gomega.Expect(derr).To(gomega.HaveOccurred())
+			gomega.Expect(time.Since(start)).To(gomega.BeNumerically("<", 2*time.Second))
+		})
+
+		ginkgo.It("should not execute operations past their deadline", func() {
+			params := map[string]string{
+				"duration":  "0s",
+				"_deadline": time.Now().Add(-time.Second).Format(time.RFC3339),
+			}
+			_, derr := worker.Execute(context.Background(), testBlockPlugin, "block", params)
+			gomega.Expect(derr).To(gomega.HaveOccurred())
+			gomega.Expect(derr.Error()).To(gomega.ContainSubstring("before execution"))
+		})
+
+		ginkgo.It("should reject invalid timeouts", func() {
+			params := map[string]string{
+				"duration": "0s",
+				"_timeout": "soon",
+			}
+			_, derr := worker.Execute(context.Background(), testBlockPlugin, "block", params)
+			gomega.Expect(derr).To(gomega.HaveOccurred())
+			gomega.Expect(derr.Type()).To(gomega.Equal(derrors.InvalidArgument))
+		})
+	})
+
 	ginkgo.It("should not write config file when plugin doesn't start", func() {
 		worker := NewWorker(testConfig.GetSubConfig("test"))
 		_, err := worker.Execute(context.Background(), "invalid", "start", nil)
@@ -21,12 +21,14 @@ package core
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"time"
 
 	"github.com/nalej/derrors"
 	"github.com/nalej/infra-net-plugin"
 
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
 	"github.com/nalej/service-net-agent/internal/pkg/config"
 	"github.com/nalej/service-net-agent/internal/pkg/defaults"
 	"github.com/nalej/service-net-agent/pkg/svcmgr"
@@ -41,6 +43,27 @@ var coreDescriptor = plugin.PluginDescriptor{
 	NewFunc:     NewCore,
 }
 
+// Operations lets the core plugin control operations received from the
+// Edge Controller
+type Operations interface {
+	// Cancel an operation that is queued or executing
+	CancelOperation(id string) derrors.Error
+}
+
+// Heartbeat lets the core plugin change the heartbeat interval
+type Heartbeat interface {
+	// Set the heartbeat interval, or go back to the configured interval
+	// if zero. Returns the interval in effect, which is limited to the
+	// configured bounds.
+	SetInterval(interval time.Duration) (time.Duration, derrors.Error)
+}
+
+// Credentials lets the core plugin replace the agent token
+type Credentials interface {
+	// Start using a new token and store it in the configuration
+	RotateToken(token string) derrors.Error
+}
+
 type Core struct {
 	// Note: this is not an agent plugin as it doesn't have a heartbeat
 	// callback function
@@ -52,6 +75,13 @@ type Core struct {
 	// Config variables needed
 	config *config.Config
 
+	// To control operations
+	operations Operations
+	// To control heartbeat
+	heartbeat Heartbeat
+	// To replace agent token
+	credentials Credentials
+
 	commandMap plugin.CommandFuncMap
 }
 
@@ -62,6 +92,25 @@ func init() {
 	}
 	coreDescriptor.AddCommand(uninstallCmd)
 
+	cancelCmd := plugin.CommandDescriptor{
+		Name:        "cancel",
+		Description: "cancel queued or executing operation with operation_id",
+	}
+	coreDescriptor.AddCommand(cancelCmd)
+
+	setIntervalCmd := plugin.CommandDescriptor{
+		Name:        "set_interval",
+		Description: "set heartbeat interval, or back to configured interval with \"default\"",
+	}
+	coreDescriptor.AddCommand(setIntervalCmd)
+
+	rotateTokenCmd := plugin.CommandDescriptor{
+		Name:        "rotate_token",
+		Description: "replace agent token with token",
+	}
+	coreDescriptor.AddCommand(rotateTokenCmd)
+	agentplugin.SecretParams(coreDescriptor.Name, "token")
+
 	plugin.Register(&coreDescriptor)
 }
 
@@ -78,13 +127,37 @@ func NewCore(cfg *viper.Viper) (plugin.Plugin, derrors.Error) {
 		return nil, derrors.NewInvalidArgumentError("no valid config for core plugin")
 	}
 
+	operationsI := cfg.Get("operations")
+	operations, ok := operationsI.(Operations)
+	if !ok {
+		return nil, derrors.NewInvalidArgumentError("no valid operations control for core plugin")
+	}
+
+	heartbeatI := cfg.Get("heartbeat")
+	heartbeat, ok := heartbeatI.(Heartbeat)
+	if !ok {
+		return nil, derrors.NewInvalidArgumentError("no valid heartbeat control for core plugin")
+	}
+
+	credentialsI := cfg.Get("credentials")
+	credentials, ok := credentialsI.(Credentials)
+	if !ok {
+		return nil, derrors.NewInvalidArgumentError("no valid credentials control for core plugin")
+	}
+
 	c := &Core{
-		runner: runner,
-		config: runnerCfg,
+		runner:      runner,
+		config:      runnerCfg,
+		operations:  operations,
+		heartbeat:   heartbeat,
+		credentials: credentials,
 	}
 
 	c.commandMap = plugin.CommandFuncMap{
-		"uninstall": c.uninstall,
+		"uninstall":    c.uninstall,
+		"cancel":       c.cancel,
+		"set_interval": c.setInterval,
+		"rotate_token": c.rotateToken,
 	}
 
 	return c, nil
@@ -113,6 +186,65 @@ func (c *Core) uninstall(ctx context.Context, params map[string]string) (string,
 	return "Uninstall in progress", nil
 }
 
+// Cancel command stops an operation from being executed, or interrupts
+// it if it's executing. The cancelled operation reports its own result.
+func (c *Core) cancel(ctx context.Context, params map[string]string) (string, derrors.Error) {
+	id, found := params["operation_id"]
+	if !found || id == "" {
+		return "", derrors.NewInvalidArgumentError("operation_id parameter required")
+	}
+
+	derr := c.operations.CancelOperation(id)
+	if derr != nil {
+		return "", derr
+	}
+
+	return fmt.Sprintf("Operation %s cancelled", id), nil
+}
+
+// Set interval command changes the heartbeat interval until the agent is
+// restarted, e.g. to speed up while the Edge Controller has operations for
+// us.
+func (c *Core) setInterval(ctx context.Context, params map[string]string) (string, derrors.Error) {
+	value, found := params["interval"]
+	if !found || value == "" {
+		return "", derrors.NewInvalidArgumentError("interval parameter required")
+	}
+
+	var interval time.Duration
+	if value != "default" {
+		var err error
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return "", derrors.NewInvalidArgumentError("invalid interval").WithParams(value)
+		}
+	}
+
+	current, derr := c.heartbeat.SetInterval(interval)
+	if derr != nil {
+		return "", derr
+	}
+
+	return fmt.Sprintf("Heartbeat interval %s", current.String()), nil
+}
+
+// Rotate token command replaces the agent token, so the Edge Controller
+// can revoke the old one. The response to this command is already sent
+// with the new token.
+func (c *Core) rotateToken(ctx context.Context, params map[string]string) (string, derrors.Error) {
+	token, found := params["token"]
+	if !found || token == "" {
+		return "", derrors.NewInvalidArgumentError("token parameter required")
+	}
+
+	derr := c.credentials.RotateToken(token)
+	if derr != nil {
+		return "", derr
+	}
+
+	return "Token rotated", nil
+}
+
 func (c *Core) doUninstall(ctx context.Context) {
 	log.Debug().Msg("executing uninstall")
 
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package agentplugin
+
+// Progress reporting for long-running plugin commands
+
+import (
+	"context"
+)
+
+// Progress of an operation that is executing
+type Progress struct {
+	// Between 0 and 100
+	Percent int    `json:"percent"`
+	Message string `json:"message,omitempty"`
+}
+
+// ProgressFunc receives the progress reported by a plugin command
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// WithProgress returns a context through which a plugin command can
+// report progress to f.
+func WithProgress(ctx context.Context, f ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, f)
+}
+
+// ReportProgress can be called by a plugin command with the context it was
+// given, to report how far along it is. Reports can be dropped when they
+// come in faster than they can be sent to the Edge Controller, so a
+// command should not rely on each one arriving. Does nothing if the
+// operation doesn't accept progress reports.
+func ReportProgress(ctx context.Context, percent int, message string) {
+	f, ok := ctx.Value(progressKey{}).(ProgressFunc)
+	if !ok || f == nil {
+		return
+	}
+
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+
+	f(Progress{
+		Percent: percent,
+		Message: message,
+	})
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package agentplugin
+
+// Secret plugin parameters
+
+import (
+	"fmt"
+
+	"github.com/nalej/derrors"
+	"github.com/nalej/infra-net-plugin"
+
+	"github.com/nalej/service-net-agent/internal/pkg/config"
+)
+
+// SecretParams marks parameters of a plugin as secret. This applies to
+// both the plugin configuration, which gets encrypted in the agent
+// configuration file, and the parameters of operations for the plugin,
+// which are redacted when logged and encrypted when persisted. Plugins
+// call this when registering.
+func SecretParams(name plugin.PluginName, params ...string) {
+	for _, param := range params {
+		config.MarkSecret(fmt.Sprintf("%s.%s", paramPrefix(name), param))
+	}
+}
+
+// RedactParams returns a copy of the parameters for a plugin with secret
+// values masked
+func RedactParams(name plugin.PluginName, params map[string]string) map[string]string {
+	return config.RedactParams(paramPrefix(name), params)
+}
+
+// SealParams returns a copy of the parameters for a plugin with secret
+// values encrypted, so operations can be persisted
+func SealParams(store *config.SecretStore, name plugin.PluginName, params map[string]string) (map[string]string, derrors.Error) {
+	return store.SealParams(paramPrefix(name), params)
+}
+
+// OpenParams decrypts the parameters for a plugin sealed with SealParams
+func OpenParams(store *config.SecretStore, name plugin.PluginName, params map[string]string) (map[string]string, derrors.Error) {
+	return store.OpenParams(paramPrefix(name), params)
+}
+
+func paramPrefix(name plugin.PluginName) string {
+	return fmt.Sprintf("%s.%s", plugin.DefaultPluginPrefix, name)
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package test
+
+import (
+	"context"
+
+	"github.com/nalej/service-net-agent/internal/pkg/agentplugin"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("progress", func() {
+	ginkgo.It("should pass progress to the reporting function", func() {
+		reported := []agentplugin.Progress{}
+		ctx := agentplugin.WithProgress(context.Background(), func(p agentplugin.Progress) {
+			reported = append(reported, p)
+		})
+
+		agentplugin.ReportProgress(ctx, 50, "halfway")
+		agentplugin.ReportProgress(ctx, 150, "overachieving")
+
+		gomega.Expect(reported).To(gomega.Equal([]agentplugin.Progress{
+			{Percent: 50, Message: "halfway"},
+			{Percent: 100, Message: "overachieving"},
+		}))
+	})
+
+	ginkgo.It("should ignore progress without reporting function", func() {
+		agentplugin.ReportProgress(context.Background(), 50, "halfway")
+	})
+})
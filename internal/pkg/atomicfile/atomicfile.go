@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Writing files atomically
+
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/nalej/derrors"
+)
+
+// Extension of the temporary file that is written before it's renamed
+// into place. Left-over temporary files were never completely written.
+const TmpExt = ".tmp"
+
+// WriteFile writes data to a temporary file next to file, syncs it to disk
+// and renames it into place, so readers see either the old or the new
+// contents, even after a crash. The directory is created if needed; as
+// files are written by the agent only, only the agent user can read them.
+func WriteFile(file string, data []byte) derrors.Error {
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return derrors.NewPermissionDeniedError("failed creating directory", err).WithParams(filepath.Dir(file))
+	}
+
+	tmpFile := file + TmpExt
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return derrors.NewPermissionDeniedError("failed creating file", err).WithParams(tmpFile)
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return derrors.NewInternalError("failed writing file", err).WithParams(tmpFile)
+	}
+
+	err = os.Rename(tmpFile, file)
+	if err != nil {
+		os.Remove(tmpFile)
+		return derrors.NewInternalError("failed writing file", err).WithParams(file)
+	}
+
+	// Make sure the rename is on disk as well. Directories can't be
+	// synced on all platforms, which we can't do anything about.
+	dir, err := os.Open(filepath.Dir(file))
+	if err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
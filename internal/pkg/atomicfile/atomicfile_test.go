@@ -0,0 +1,58 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("atomicfile", func() {
+
+	var path string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		path, err = ioutil.TempDir("", "atomicfile")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(path)
+	})
+
+	ginkgo.It("should replace a file", func() {
+		file := filepath.Join(path, "dir", "file")
+
+		gomega.Expect(WriteFile(file, []byte("first"))).To(gomega.Succeed())
+		gomega.Expect(WriteFile(file, []byte("second"))).To(gomega.Succeed())
+
+		data, err := ioutil.ReadFile(file)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(string(data)).To(gomega.Equal("second"))
+		gomega.Expect(file + TmpExt).ToNot(gomega.BeAnExistingFile())
+
+		info, err := os.Stat(file)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(info.Mode().Perm()).To(gomega.BeEquivalentTo(0600))
+	})
+})
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Exponential backoff with jitter
+
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+type Policy struct {
+	// First delay
+	Initial time.Duration
+	// Upper bound for delay; no bound if zero
+	Max time.Duration
+	// Factor by which the delay grows after each attempt
+	Multiplier float64
+	// Fraction of the delay that is randomly added or subtracted, so
+	// agents that started failing together don't retry together
+	Jitter float64
+}
+
+// Backoff keeps track of the delay between consecutive attempts. It is
+// not safe for concurrent use.
+type Backoff struct {
+	policy  Policy
+	current time.Duration
+}
+
+func NewBackoff(policy Policy) *Backoff {
+	b := &Backoff{
+		policy: policy,
+	}
+
+	return b
+}
+
+// Next returns the delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	if b.current == 0 {
+		b.current = b.policy.Initial
+	} else if b.policy.Multiplier > 1 {
+		b.current = time.Duration(float64(b.current) * b.policy.Multiplier)
+	}
+
+	if b.policy.Max > 0 && b.current > b.policy.Max {
+		b.current = b.policy.Max
+	}
+
+	return b.jitter(b.current)
+}
+
+// Reset after a successful attempt
+func (b *Backoff) Reset() {
+	b.current = 0
+}
+
+func (b *Backoff) jitter(delay time.Duration) time.Duration {
+	if b.policy.Jitter <= 0 {
+		return delay
+	}
+
+	// Random factor in [1 - jitter, 1 + jitter)
+	factor := 1 + b.policy.Jitter*(2*rand.Float64()-1)
+	return time.Duration(float64(delay) * factor)
+}
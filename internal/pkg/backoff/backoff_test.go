@@ -0,0 +1,64 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package backoff
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("backoff", func() {
+	ginkgo.It("should grow the delay up to the maximum", func() {
+		b := NewBackoff(Policy{
+			Initial:    time.Second,
+			Max:        5 * time.Second,
+			Multiplier: 2,
+		})
+
+		gomega.Expect(b.Next()).To(gomega.Equal(time.Second))
+		gomega.Expect(b.Next()).To(gomega.Equal(2 * time.Second))
+		gomega.Expect(b.Next()).To(gomega.Equal(4 * time.Second))
+		gomega.Expect(b.Next()).To(gomega.Equal(5 * time.Second))
+		gomega.Expect(b.Next()).To(gomega.Equal(5 * time.Second))
+	})
+
+	ginkgo.It("should start over after reset", func() {
+		b := NewBackoff(Policy{
+			Initial:    time.Second,
+			Multiplier: 2,
+		})
+
+		b.Next()
+		b.Next()
+		b.Reset()
+		gomega.Expect(b.Next()).To(gomega.Equal(time.Second))
+	})
+
+	ginkgo.It("should add jitter within bounds", func() {
+		b := NewBackoff(Policy{
+			Initial: 10 * time.Second,
+			Jitter:  0.1,
+		})
+
+		for i := 0; i < 100; i++ {
+			gomega.Expect(b.Next()).To(gomega.BeNumerically("~", 10*time.Second, time.Second))
+		}
+	})
+})
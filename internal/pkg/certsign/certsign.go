@@ -0,0 +1,104 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Signing of agent client certificates by the Edge Controller. The Edge
+// Controller protocol doesn't define this; this is the hand-written
+// equivalent of generated gRPC code for the service
+//
+//   service AgentCertificate {
+//     rpc SignCertificate(google.protobuf.BytesValue) returns (google.protobuf.BytesValue);
+//   }
+//
+// The request holds a PEM-encoded certificate signing request; the
+// response holds the PEM-encoded signed certificate, optionally followed
+// by intermediate certificates. The agent authenticates with its token.
+//
+// Until the service is added to grpc-edge-controller-go, only an Edge
+// Controller built with this package (like ec-stub) implements it, so
+// requesting a client certificate is opt-in.
+
+package certsign
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"google.golang.org/grpc"
+)
+
+const signCertificateMethod = "/edge_controller.AgentCertificate/SignCertificate"
+
+type AgentCertificateClient interface {
+	SignCertificate(ctx context.Context, in *wrappers.BytesValue, opts ...grpc.CallOption) (*wrappers.BytesValue, error)
+}
+
+type agentCertificateClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAgentCertificateClient(cc *grpc.ClientConn) AgentCertificateClient {
+	return &agentCertificateClient{cc}
+}
+
+func (c *agentCertificateClient) SignCertificate(ctx context.Context, in *wrappers.BytesValue, opts ...grpc.CallOption) (*wrappers.BytesValue, error) {
+	out := new(wrappers.BytesValue)
+	err := c.cc.Invoke(ctx, signCertificateMethod, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type AgentCertificateServer interface {
+	SignCertificate(context.Context, *wrappers.BytesValue) (*wrappers.BytesValue, error)
+}
+
+func RegisterAgentCertificateServer(s *grpc.Server, srv AgentCertificateServer) {
+	s.RegisterService(&agentCertificateServiceDesc, srv)
+}
+
+func agentCertificateSignCertificateHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrappers.BytesValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentCertificateServer).SignCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: signCertificateMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentCertificateServer).SignCertificate(ctx, req.(*wrappers.BytesValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var agentCertificateServiceDesc = grpc.ServiceDesc{
+	ServiceName: "edge_controller.AgentCertificate",
+	HandlerType: (*AgentCertificateServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SignCertificate",
+			Handler:    agentCertificateSignCertificateHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "certsign.go",
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+// Circuit breaker for the Edge Controller connection
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
+)
+
+type BreakerState int
+
+const (
+	// Connection is fine
+	BreakerClosed BreakerState = iota
+	// Connection is down; requests fail right away
+	BreakerOpen
+	// Connection was down; the next request tests if it is back, others
+	// fail right away until we know
+	BreakerHalfOpen
+)
+
+var breakerStateNames = map[BreakerState]string{
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half-open",
+}
+
+func (s BreakerState) String() string {
+	return breakerStateNames[s]
+}
+
+// Breaker opens after a number of consecutive failures, after which
+// requests are not even attempted until some time has passed. That time
+// grows while the connection stays down. It closes again on the first
+// successful request.
+//
+// All methods can be called on a nil Breaker, which never opens.
+type Breaker struct {
+	// Consecutive failures after which we open
+	threshold int
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	delay    *backoff.Backoff
+	retryAt  time.Time
+	// Whether the request testing the connection while half-open is
+	// under way
+	trial bool
+}
+
+func NewBreaker(threshold int, policy backoff.Policy) *Breaker {
+	b := &Breaker{
+		threshold: threshold,
+		delay:     backoff.NewBackoff(policy),
+	}
+
+	return b
+}
+
+func (b *Breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.stateLocked()
+}
+
+// Allow returns whether a request should be attempted. While half-open,
+// only the first caller is let through to test the connection; its
+// outcome has to be reported with Success or Failure.
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.stateLocked() {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+	}
+
+	return true
+}
+
+// Available returns whether a request would be allowed, without taking
+// the place of the request testing the connection
+func (b *Breaker) Available() bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state := b.stateLocked()
+	return state == BreakerClosed || (state == BreakerHalfOpen && !b.trial)
+}
+
+// Success closes the breaker
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.trial = false
+	b.delay.Reset()
+}
+
+// Failure counts a failed request. Returns true if the breaker opened
+// because of it, which is when the connection should be re-established.
+func (b *Breaker) Failure() bool {
+	if b == nil {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	b.trial = false
+
+	// A failed test while half-open opens right away
+	state := b.stateLocked()
+	if state == BreakerOpen || (state == BreakerClosed && b.failures < b.threshold) {
+		return false
+	}
+
+	b.state = BreakerOpen
+	b.retryAt = time.Now().Add(b.delay.Next())
+
+	return true
+}
+
+func (b *Breaker) stateLocked() BreakerState {
+	if b.state == BreakerOpen && !time.Now().Before(b.retryAt) {
+		b.state = BreakerHalfOpen
+	}
+
+	return b.state
+}
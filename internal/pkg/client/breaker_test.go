@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("breaker", func() {
+	ginkgo.It("should open after consecutive failures", func() {
+		b := NewBreaker(3, backoff.Policy{Initial: time.Hour})
+
+		gomega.Expect(b.Failure()).To(gomega.BeFalse())
+		gomega.Expect(b.Failure()).To(gomega.BeFalse())
+		gomega.Expect(b.State()).To(gomega.Equal(BreakerClosed))
+		gomega.Expect(b.Failure()).To(gomega.BeTrue())
+		gomega.Expect(b.State()).To(gomega.Equal(BreakerOpen))
+		gomega.Expect(b.Allow()).To(gomega.BeFalse())
+	})
+
+	ginkgo.It("should start counting over after success", func() {
+		b := NewBreaker(2, backoff.Policy{Initial: time.Hour})
+
+		gomega.Expect(b.Failure()).To(gomega.BeFalse())
+		b.Success()
+		gomega.Expect(b.Failure()).To(gomega.BeFalse())
+		gomega.Expect(b.State()).To(gomega.Equal(BreakerClosed))
+	})
+
+	ginkgo.It("should test connection after delay", func() {
+		b := NewBreaker(1, backoff.Policy{Initial: 10 * time.Millisecond, Multiplier: 2})
+
+		gomega.Expect(b.Failure()).To(gomega.BeTrue())
+		gomega.Eventually(b.State).Should(gomega.Equal(BreakerHalfOpen))
+		gomega.Expect(b.Allow()).To(gomega.BeTrue())
+
+		// Failed test opens again
+		gomega.Expect(b.Failure()).To(gomega.BeTrue())
+		gomega.Expect(b.State()).To(gomega.Equal(BreakerOpen))
+		gomega.Eventually(b.State).Should(gomega.Equal(BreakerHalfOpen))
+
+		b.Success()
+		gomega.Expect(b.State()).To(gomega.Equal(BreakerClosed))
+	})
+
+	ginkgo.It("should let a single request test the connection", func() {
+		b := NewBreaker(1, backoff.Policy{Initial: 10 * time.Millisecond, Multiplier: 2})
+
+		gomega.Expect(b.Failure()).To(gomega.BeTrue())
+		gomega.Eventually(b.State).Should(gomega.Equal(BreakerHalfOpen))
+		gomega.Expect(b.Available()).To(gomega.BeTrue())
+
+		var allowed int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if b.Allow() {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		gomega.Expect(allowed).To(gomega.Equal(int32(1)))
+		gomega.Expect(b.Available()).To(gomega.BeFalse())
+
+		// Failed test, next one after delay
+		gomega.Expect(b.Failure()).To(gomega.BeTrue())
+		gomega.Eventually(b.State).Should(gomega.Equal(BreakerHalfOpen))
+		gomega.Expect(b.Allow()).To(gomega.BeTrue())
+		gomega.Expect(b.Allow()).To(gomega.BeFalse())
+
+		b.Success()
+		gomega.Expect(b.Allow()).To(gomega.BeTrue())
+		gomega.Expect(b.Allow()).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should never open when nil", func() {
+		var b *Breaker
+		gomega.Expect(b.Failure()).To(gomega.BeFalse())
+		gomega.Expect(b.Allow()).To(gomega.BeTrue())
+		gomega.Expect(b.Available()).To(gomega.BeTrue())
+		gomega.Expect(b.State()).To(gomega.Equal(BreakerClosed))
+	})
+})
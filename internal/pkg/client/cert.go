@@ -0,0 +1,237 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+// Client certificate to authenticate to the Edge Controller
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/service-net-agent/internal/pkg/atomicfile"
+	"github.com/nalej/service-net-agent/internal/pkg/certsign"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ClientCertificate is the certificate and key the agent uses to
+// authenticate to the Edge Controller, stored together in one file under
+// the agent path, so they can't get out of sync. It can be replaced while
+// connected; new connections use the new certificate.
+type ClientCertificate struct {
+	file string
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewClientCertificate creates a certificate stored in the given file,
+// without loading it; it needs to be stored before it can be used.
+func NewClientCertificate(file string) *ClientCertificate {
+	return &ClientCertificate{
+		file: file,
+	}
+}
+
+// LoadClientCertificate loads the certificate and key from file. A
+// certificate that wasn't stored by the agent can have its key in a
+// separate keyFile; the key in file takes precedence, as that's where a
+// renewed certificate is stored.
+func LoadClientCertificate(file, keyFile string) (*ClientCertificate, derrors.Error) {
+	c := NewClientCertificate(file)
+
+	certPEM, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, derrors.NewPermissionDeniedError("unable to read client certificate", err).WithParams(file)
+	}
+	keyPEM := certPEM
+	if !hasPrivateKey(certPEM) && keyFile != "" {
+		keyPEM, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, derrors.NewPermissionDeniedError("unable to read client key", err).WithParams(keyFile)
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, derrors.NewInvalidArgumentError("unable to load client certificate", err).WithParams(file, keyFile)
+	}
+	derr := c.set(&cert)
+	if derr != nil {
+		return nil, derr
+	}
+
+	return c, nil
+}
+
+func hasPrivateKey(data []byte) bool {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return false
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return true
+		}
+	}
+}
+
+// Expiry of the certificate; zero if there is none
+func (c *ClientCertificate) NotAfter() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.cert == nil {
+		return time.Time{}
+	}
+	return c.cert.Leaf.NotAfter
+}
+
+// NeedsRenewal returns whether less than a third of the validity of the
+// certificate is left, or there is no certificate at all.
+func (c *ClientCertificate) NeedsRenewal(now time.Time) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.cert == nil {
+		return true
+	}
+
+	leaf := c.cert.Leaf
+	validity := leaf.NotAfter.Sub(leaf.NotBefore)
+	return now.After(leaf.NotAfter.Add(-validity / 3))
+}
+
+// Store a new PEM-encoded certificate and key, and start using them. Both
+// go in a single file that is replaced atomically, so we never end up with
+// a certificate that doesn't match the key.
+func (c *ClientCertificate) Store(certPEM, keyPEM []byte) derrors.Error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return derrors.NewInvalidArgumentError("invalid client certificate", err)
+	}
+
+	// The key is secret; the file is only readable by the agent user
+	data := bytes.Join([][]byte{bytes.TrimSpace(certPEM), keyPEM}, []byte("\n"))
+	derr := atomicfile.WriteFile(c.file, data)
+	if derr != nil {
+		return derrors.NewInternalError("failed storing client certificate", derr).WithParams(c.file)
+	}
+
+	return c.set(&cert)
+}
+
+// For tls.Config.GetClientCertificate
+func (c *ClientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.cert == nil {
+		// No certificate is sent; the server decides if that's ok
+		return &tls.Certificate{}, nil
+	}
+	return c.cert, nil
+}
+
+func (c *ClientCertificate) set(cert *tls.Certificate) derrors.Error {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return derrors.NewInvalidArgumentError("invalid client certificate", err)
+	}
+	cert.Leaf = leaf
+
+	c.lock.Lock()
+	c.cert = cert
+	c.lock.Unlock()
+
+	log.Debug().Str("subject", leaf.Subject.String()).Time("expires", leaf.NotAfter).Msg("using client certificate")
+	return nil
+}
+
+// Generate a new key and a PEM-encoded certificate signing request for it
+func newCertificateRequest(commonName string) ([]byte, []byte, derrors.Error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, derrors.NewInternalError("failed generating client key", err)
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, derrors.NewInternalError("failed creating certificate signing request", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, derrors.NewInternalError("failed encoding client key", err)
+	}
+
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return csrPEM, keyPEM, nil
+}
+
+// RequestCertificate generates a new key, has the Edge Controller sign a
+// certificate for it, and stores both in cert.
+func (c *AgentClient) RequestCertificate(commonName string, cert *ClientCertificate) derrors.Error {
+	csrPEM, keyPEM, derr := newCertificateRequest(commonName)
+	if derr != nil {
+		return derr
+	}
+
+	if !c.breaker.Allow() {
+		return derrors.NewUnavailableError("unable to request client certificate", errConnectionDown)
+	}
+
+	c.lock.RLock()
+	conn := c.conn
+	c.lock.RUnlock()
+
+	response, err := certsign.NewAgentCertificateClient(conn).SignCertificate(c.GetContext(), &wrappers.BytesValue{Value: csrPEM})
+	err = c.record(err)
+	if status.Code(err) == codes.PermissionDenied {
+		return derrors.NewPermissionDeniedError("unable to request client certificate", err)
+	}
+	if err != nil {
+		return derrors.NewUnavailableError("unable to request client certificate", err)
+	}
+
+	return cert.Store(response.GetValue(), keyPEM)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// Self-sign the public key in a certificate signing request
+func selfSign(csrPEM, keyPEM []byte, notBefore, notAfter time.Time) []byte {
+	block, _ := pem.Decode(csrPEM)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	gomega.Expect(err).To(gomega.Succeed())
+
+	block, _ = pem.Decode(keyPEM)
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	gomega.Expect(err).To(gomega.Succeed())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      csr.Subject,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, key)
+	gomega.Expect(err).To(gomega.Succeed())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+var _ = ginkgo.Describe("client certificate", func() {
+	var path string
+	var certFile string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		path, err = ioutil.TempDir("", "certs")
+		gomega.Expect(err).To(gomega.Succeed())
+
+		certFile = filepath.Join(path, "etc", "agent.pem")
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(os.RemoveAll(path)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should create a certificate signing request", func() {
+		csrPEM, keyPEM, derr := newCertificateRequest("test-asset")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(keyPEM).ToNot(gomega.BeEmpty())
+
+		block, _ := pem.Decode(csrPEM)
+		gomega.Expect(block).ToNot(gomega.BeNil())
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(csr.CheckSignature()).To(gomega.Succeed())
+		gomega.Expect(csr.Subject.CommonName).To(gomega.Equal("test-asset"))
+	})
+
+	ginkgo.It("should store and load a certificate", func() {
+		csrPEM, keyPEM, derr := newCertificateRequest("test-asset")
+		gomega.Expect(derr).To(gomega.Succeed())
+		notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+		certPEM := selfSign(csrPEM, keyPEM, time.Now().Add(-time.Hour), notAfter)
+
+		cert := NewClientCertificate(certFile)
+		gomega.Expect(cert.NotAfter().IsZero()).To(gomega.BeTrue())
+		gomega.Expect(cert.Store(certPEM, keyPEM)).To(gomega.Succeed())
+		gomega.Expect(cert.NotAfter()).To(gomega.BeTemporally("==", notAfter))
+
+		info, err := os.Stat(certFile)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(info.Mode().Perm()).To(gomega.BeEquivalentTo(0600))
+
+		loaded, derr := LoadClientCertificate(certFile, "")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(loaded.NotAfter()).To(gomega.BeTemporally("==", notAfter))
+	})
+
+	ginkgo.It("should prefer the stored key over a separate key file", func() {
+		csrPEM, keyPEM, derr := newCertificateRequest("test-asset")
+		gomega.Expect(derr).To(gomega.Succeed())
+		certPEM := selfSign(csrPEM, keyPEM, time.Now(), time.Now().Add(time.Hour))
+
+		// Provisioned with a separate key file
+		keyFile := filepath.Join(path, "etc", "agent.key")
+		gomega.Expect(os.MkdirAll(filepath.Dir(certFile), 0700)).To(gomega.Succeed())
+		gomega.Expect(ioutil.WriteFile(certFile, certPEM, 0600)).To(gomega.Succeed())
+		gomega.Expect(ioutil.WriteFile(keyFile, keyPEM, 0600)).To(gomega.Succeed())
+		cert, derr := LoadClientCertificate(certFile, keyFile)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		// Renewed with a new key
+		csrPEM, newKeyPEM, derr := newCertificateRequest("test-asset")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(cert.Store(selfSign(csrPEM, newKeyPEM, time.Now(), time.Now().Add(time.Hour)), newKeyPEM)).To(gomega.Succeed())
+
+		_, derr = LoadClientCertificate(certFile, keyFile)
+		gomega.Expect(derr).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should not store a certificate that doesn't match the key", func() {
+		csrPEM, keyPEM, derr := newCertificateRequest("test-asset")
+		gomega.Expect(derr).To(gomega.Succeed())
+		certPEM := selfSign(csrPEM, keyPEM, time.Now(), time.Now().Add(time.Hour))
+
+		_, otherKeyPEM, derr := newCertificateRequest("test-asset")
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		cert := NewClientCertificate(certFile)
+		gomega.Expect(cert.Store(certPEM, otherKeyPEM)).ToNot(gomega.Succeed())
+		gomega.Expect(certFile).ToNot(gomega.BeAnExistingFile())
+	})
+
+	ginkgo.It("should need renewal when a third of validity is left", func() {
+		csrPEM, keyPEM, derr := newCertificateRequest("test-asset")
+		gomega.Expect(derr).To(gomega.Succeed())
+		now := time.Now()
+		certPEM := selfSign(csrPEM, keyPEM, now.Add(-time.Hour), now.Add(2*time.Hour))
+
+		cert := NewClientCertificate(certFile)
+		gomega.Expect(cert.NeedsRenewal(now)).To(gomega.BeTrue())
+
+		gomega.Expect(cert.Store(certPEM, keyPEM)).To(gomega.Succeed())
+		gomega.Expect(cert.NeedsRenewal(now)).To(gomega.BeFalse())
+		gomega.Expect(cert.NeedsRenewal(now.Add(90 * time.Minute))).To(gomega.BeTrue())
+	})
+})
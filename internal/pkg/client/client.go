@@ -26,15 +26,22 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-common-go"
 	"github.com/nalej/grpc-edge-controller-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
+	"github.com/nalej/service-net-agent/internal/pkg/opstream"
 
 	"github.com/rs/zerolog/log"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -44,59 +51,333 @@ type ConnectionOptions struct {
 	Insecure bool
 	Timeout  time.Duration
 	Token    string
+
+	// Certificate to authenticate with, in addition to the token;
+	// requires TLS
+	ClientCert *ClientCertificate
+
+	// Name to verify the Edge Controller certificate against, instead
+	// of the host we connect to; requires TLS
+	ServerName string
+	// Public key pins the Edge Controller certificate chain has to
+	// match one of; see PublicKeyPin. Requires TLS.
+	Pins []string
+
+	// Ping the Edge Controller after this long without activity on an
+	// open stream, to detect dead connections; no pings if zero
+	KeepaliveTime time.Duration
+	// Time to wait for a ping to be answered
+	KeepaliveTimeout time.Duration
+
+	// Consecutive failed requests after which the connection is
+	// considered down and re-established; never if zero
+	FailureThreshold int
+	// Delay before trying again after the connection went down
+	Redial backoff.Policy
+
+	// Connect through a proxy; directly if nil
+	Proxy *ProxyOptions
+
+	// Endpoints to fail over to, in order of preference, when the
+	// connection goes down
+	FallbackAddresses []string
+	// DNS SRV name that resolves to more endpoints to fail over to
+	SRV string
+	// Check this often if a more preferred endpoint is reachable again
+	// after failing over; never if zero
+	ProbeInterval time.Duration
 }
 
 type AgentClient struct {
-	grpc_edge_controller_go.AgentClient
-	*grpc.ClientConn
+	// Most preferred endpoint
+	preferred string
+	// Used to connect and count traffic; nil for fake clients
+	dialer *dialer
+
+	// Protects the connection, which is replaced when re-established,
+	// the endpoint it connects to and the token, which is replaced when
+	// rotated. Also protects the options and the dial options, which are
+	// replaced when reconfigured.
+	lock sync.RWMutex
+	opts *ConnectionOptions
+	// Used to re-establish the connection; nil if we can't
+	dialOpts []grpc.DialOption
+
 	address string
-	opts    *ConnectionOptions
+	conn    *grpc.ClientConn
+	client  grpc_edge_controller_go.AgentClient
+	token   string
+	// Endpoints the SRV name last resolved to
+	resolved []string
+	// Pins to trust the Edge Controller of the last TLS handshake
+	serverPins []string
+	// Set if the last TLS handshake didn't match our pins
+	pinMismatch error
+	// Stops monitoring the current connection
+	cancelMonitor context.CancelFunc
+
+	breaker *Breaker
+	// Consecutive requests rejected because of the token
+	authFailures int32
 }
 
 func NewAgentClient(address string, opts *ConnectionOptions) (*AgentClient, derrors.Error) {
-	log.Debug().Str("address", address).Msg("creating connection")
-
 	agentClient := &AgentClient{
-		address: address,
-		opts:    opts,
+		preferred: address,
+		opts:      opts,
+		token:     opts.Token,
 	}
+	agentClient.dialer = &dialer{proxy: opts.Proxy}
 
-	dialOpts, derr := agentClient.getDialOptions()
+	dialOpts, derr := agentClient.newDialOptions(opts)
 	if derr != nil {
 		return nil, derr
 	}
+	agentClient.dialOpts = dialOpts
 
+	endpoints := agentClient.endpoints()
+	if len(endpoints) == 0 {
+		return nil, derrors.NewInvalidArgumentError("no edge controller address").WithParams(opts.SRV)
+	}
+	address = endpoints[0]
+
+	log.Debug().Str("address", address).Msg("creating connection")
 	conn, err := grpc.Dial(address, dialOpts...)
 	if err != nil {
 		return nil, derrors.NewInternalError("unable to create client connection", err).WithParams(address)
 	}
+	agentClient.setConn(address, conn)
 
-	agentClient.ClientConn = conn
-	agentClient.AgentClient = grpc_edge_controller_go.NewAgentClient(conn)
+	if opts.FailureThreshold > 0 {
+		agentClient.breaker = NewBreaker(opts.FailureThreshold, opts.Redial)
+	}
 
 	return agentClient, nil
 }
 
 func (c *AgentClient) GetContext() context.Context {
-	meta := metadata.New(map[string]string{"Authorization": c.opts.Token})
-	ctx := metadata.NewOutgoingContext(context.Background(), meta)
-	if c.opts.Timeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, c.opts.Timeout)
+	ctx := c.withToken(context.Background())
+	if timeout := c.options().Timeout; timeout > 0 {
+		ctx, _ = context.WithTimeout(ctx, timeout)
 	}
 	return ctx
 }
 
+func (c *AgentClient) AgentJoin(ctx context.Context, in *grpc_edge_controller_go.AgentJoinRequest, opts ...grpc.CallOption) (*grpc_inventory_manager_go.AgentJoinResponse, error) {
+	client, err := c.agentClient()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.AgentJoin(ctx, in, opts...)
+	err = c.record(err)
+	return response, err
+}
+
+func (c *AgentClient) AgentCheck(ctx context.Context, in *grpc_edge_controller_go.AgentCheckRequest, opts ...grpc.CallOption) (*grpc_edge_controller_go.CheckResult, error) {
+	client, err := c.agentClient()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := client.AgentCheck(ctx, in, opts...)
+	err = c.record(err)
+	return result, err
+}
+
+func (c *AgentClient) CallbackAgentOperation(ctx context.Context, in *grpc_inventory_manager_go.AgentOpResponse, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	client, err := c.agentClient()
+	if err != nil {
+		return nil, err
+	}
+
+	success, err := client.CallbackAgentOperation(ctx, in, opts...)
+	err = c.record(err)
+	return success, err
+}
+
+// Open a stream on which the Edge Controller pushes operations as soon as
+// it has them. The stream lives until ctx is cancelled or the connection
+// fails, so the communication timeout doesn't apply. Errors received on
+// the stream have to be passed to RecordStreamError.
+func (c *AgentClient) OperationStream(ctx context.Context) (opstream.AgentStream_OperationStreamClient, error) {
+	if !c.breaker.Allow() {
+		return nil, errConnectionDown
+	}
+
+	c.lock.RLock()
+	conn := c.conn
+	c.lock.RUnlock()
+
+	stream, err := opstream.NewAgentStreamClient(conn).OperationStream(c.withToken(ctx))
+	err = c.record(err)
+	return stream, err
+}
+
+// RecordStreamError records an error received on a stream like the
+// outcome of any other request, so a connection that is down, a rejected
+// token or a certificate that doesn't match are noticed. Returns the
+// error to pass on.
+func (c *AgentClient) RecordStreamError(err error) error {
+	return c.record(err)
+}
+
+// Available returns whether the Edge Controller connection is expected to
+// work; requests fail right away if not.
+func (c *AgentClient) Available() bool {
+	return c.breaker.Available()
+}
+
+// Traffic returns the bytes sent to and received from the Edge Controller
+// so far, including TLS and HTTP/2 overhead, as that's what counts on
+// metered links
+func (c *AgentClient) Traffic() (sent uint64, received uint64) {
+	return c.dialer.Traffic()
+}
+
+// Endpoint currently connected to
+func (c *AgentClient) Address() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.address
+}
+
+// Endpoints to connect to, most preferred first
+func (c *AgentClient) Endpoints() []string {
+	return c.endpoints()
+}
+
+// Failover switches to the next endpoint right away
+func (c *AgentClient) Failover() {
+	c.redial()
+}
+
+// Certificate used to authenticate; nil if none
+func (c *AgentClient) ClientCertificate() *ClientCertificate {
+	return c.options().ClientCert
+}
+
+func (c *AgentClient) options() *ConnectionOptions {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.opts
+}
+
+// Options to re-establish the connection with; nil if we can't
+func (c *AgentClient) dialOptions() []grpc.DialOption {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.dialOpts
+}
+
+// Reconfigure switches to the TLS settings in opts: whether to use TLS,
+// the CA certificate, whether to verify the Edge Controller certificate,
+// the server name and the pins. The connection is re-established with
+// them. Other options stay as they are. Invalid settings are rejected
+// and the connection is kept.
+func (c *AgentClient) Reconfigure(opts *ConnectionOptions) derrors.Error {
+	current := c.options()
+	if sameTLS(current, opts) {
+		return nil
+	}
+
+	updated := *current
+	updated.UseTLS = opts.UseTLS
+	updated.CACert = opts.CACert
+	updated.Insecure = opts.Insecure
+	updated.ServerName = opts.ServerName
+	updated.Pins = opts.Pins
+
+	dialOpts, derr := c.newDialOptions(&updated)
+	if derr != nil {
+		return derr
+	}
+
+	c.lock.Lock()
+	c.opts = &updated
+	// Fake clients can't dial
+	if c.dialOpts != nil {
+		c.dialOpts = dialOpts
+	}
+	c.lock.Unlock()
+
+	log.Info().Bool("tls", updated.UseTLS).Msg("edge controller connection reconfigured, re-establishing")
+	c.reconnect()
+	return nil
+}
+
+func sameTLS(a, b *ConnectionOptions) bool {
+	if a.UseTLS != b.UseTLS || a.CACert != b.CACert || a.Insecure != b.Insecure || a.ServerName != b.ServerName {
+		return false
+	}
+	if len(a.Pins) != len(b.Pins) {
+		return false
+	}
+	for i := range a.Pins {
+		if a.Pins[i] != b.Pins[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *AgentClient) BreakerState() BreakerState {
+	return c.breaker.State()
+}
+
+func (c *AgentClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cancelMonitor != nil {
+		c.cancelMonitor()
+	}
+
+	return c.conn.Close()
+}
+
+// Use a new token for all following requests
+func (c *AgentClient) SetToken(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.token = token
+}
+
+func (c *AgentClient) withToken(ctx context.Context) context.Context {
+	c.lock.RLock()
+	token := c.token
+	c.lock.RUnlock()
+
+	meta := metadata.New(map[string]string{"Authorization": token})
+	return metadata.NewOutgoingContext(ctx, meta)
+}
+
 // Get local address used for connecting to server
 func (c *AgentClient) LocalAddress() string {
+	// Once connected, we know the address of the last connection
+	if addr := c.dialer.LocalAddress(); addr != "" {
+		return addr
+	}
+
 	// We cannot directly determine the local peer address from a gRPC
 	// connection and we don't have access to the raw net.Conn. Hence,
 	// we set up a dummy connection (we don't actually send any packets
 	// when using a UDP connection) to figure/ out the local IP we would
 	// be using.
 	// See also the Golang source: srcAddrs() in net/addrselect.go.
-	conn, err := net.Dial("udp", c.address)
+	// Through a proxy, that's the route to the proxy.
+	address := c.Address()
+	if proxy := c.options().Proxy; proxy != nil && !proxy.Bypass(address) {
+		address = proxy.Address
+	}
+	conn, err := net.Dial("udp", address)
 	if err != nil {
-		log.Warn().Err(err).Str("address", c.address).Msg("no route to server")
+		log.Warn().Err(err).Str("address", address).Msg("no route to server")
 		return ""
 	}
 	defer conn.Close()
@@ -106,30 +387,42 @@ func (c *AgentClient) LocalAddress() string {
 }
 
 // Get the dial options based on the ConnectionOptions
-func (c *AgentClient) getDialOptions() ([]grpc.DialOption, derrors.Error) {
+func (c *AgentClient) newDialOptions(opts *ConnectionOptions) ([]grpc.DialOption, derrors.Error) {
 	var options []grpc.DialOption
 
-	if c.opts.UseTLS {
+	if opts.UseTLS {
 		// A nil certificate pool for RootCAs in a tls.Config uses
 		// the system certificates to validate servers, in a
 		// cross-platform way.
 		var pool *x509.CertPool = nil
-		if c.opts.CACert != "" {
+		if opts.CACert != "" {
 			pool = x509.NewCertPool()
-			derr := addCert(pool, c.opts.CACert)
+			derr := addCert(pool, opts.CACert)
 			if derr != nil {
 				return nil, derr
 			}
 		}
 
-		if c.opts.Insecure {
+		if opts.Insecure {
 			log.Warn().Msg("creating insecure connection")
 		}
 
+		derr := validatePins(opts.Pins)
+		if derr != nil {
+			return nil, derr
+		}
+
+		// An empty ServerName means the certificate is checked against
+		// the host we connect to. Pins are checked even if the
+		// connection is insecure.
 		tlsConfig := &tls.Config{
-			RootCAs:            pool,
-			ServerName:         "", // we don't need to check the serverName
-			InsecureSkipVerify: c.opts.Insecure,
+			RootCAs:               pool,
+			ServerName:            opts.ServerName,
+			InsecureSkipVerify:    opts.Insecure,
+			VerifyPeerCertificate: c.verifyServer,
+		}
+		if opts.ClientCert != nil {
+			tlsConfig.GetClientCertificate = opts.ClientCert.get
 		}
 
 		creds := credentials.NewTLS(tlsConfig)
@@ -137,10 +430,28 @@ func (c *AgentClient) getDialOptions() ([]grpc.DialOption, derrors.Error) {
 
 		options = append(options, grpc.WithTransportCredentials(creds))
 	} else {
+		if opts.ClientCert != nil {
+			return nil, derrors.NewInvalidArgumentError("client certificate requires TLS")
+		}
+		if opts.ServerName != "" || len(opts.Pins) > 0 {
+			return nil, derrors.NewInvalidArgumentError("server name and pins require TLS")
+		}
 		log.Warn().Msg("creating unencrypted connection")
 		options = append(options, grpc.WithInsecure())
 	}
 
+	if opts.Proxy != nil {
+		log.Debug().Str("proxy", opts.Proxy.Address).Msg("connecting through proxy")
+	}
+	options = append(options, grpc.WithContextDialer(c.dialer.dial))
+
+	if opts.KeepaliveTime > 0 {
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    opts.KeepaliveTime,
+			Timeout: opts.KeepaliveTimeout,
+		}))
+	}
+
 	return options, nil
 }
 
@@ -18,10 +18,15 @@
 package client
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"time"
 
+	"github.com/nalej/grpc-edge-controller-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
+
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 
@@ -123,6 +128,49 @@ rUCGwbCUDI0mxadJ3Bz4WxR6fyNpBK2yAinWEsikxqEt
 		gomega.Expect(err).To(gomega.Succeed())
 	})
 
+	ginkgo.It("should reconnect with new TLS settings", func() {
+		opts := &ConnectionOptions{
+			Timeout: time.Second,
+		}
+		client, err := NewAgentClient(address, opts)
+		gomega.Expect(err).To(gomega.Succeed())
+		defer client.Close()
+		conn := client.conn
+
+		err = client.Reconfigure(&ConnectionOptions{
+			UseTLS: true,
+			CACert: certfile,
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(client.conn).ToNot(gomega.BeIdenticalTo(conn))
+		gomega.Expect(client.address).To(gomega.Equal(address))
+		gomega.Expect(client.opts.UseTLS).To(gomega.BeTrue())
+		gomega.Expect(client.opts.CACert).To(gomega.Equal(certfile))
+		// Other options are kept
+		gomega.Expect(client.opts.Timeout).To(gomega.Equal(time.Second))
+
+		// Same settings, same connection
+		conn = client.conn
+		gomega.Expect(client.Reconfigure(&ConnectionOptions{UseTLS: true, CACert: certfile})).To(gomega.Succeed())
+		gomega.Expect(client.conn).To(gomega.BeIdenticalTo(conn))
+	})
+
+	ginkgo.It("should keep the connection when new TLS settings are invalid", func() {
+		opts := &ConnectionOptions{}
+		client, err := NewAgentClient(address, opts)
+		gomega.Expect(err).To(gomega.Succeed())
+		defer client.Close()
+		conn := client.conn
+
+		err = client.Reconfigure(&ConnectionOptions{
+			UseTLS: true,
+			Pins:   []string{"invalid"},
+		})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(client.conn).To(gomega.BeIdenticalTo(conn))
+		gomega.Expect(client.opts).To(gomega.Equal(opts))
+	})
+
 	ginkgo.It("should create a context with a token", func() {
 		opts := &ConnectionOptions{
 			Token: "testtoken",
@@ -150,4 +198,47 @@ rUCGwbCUDI0mxadJ3Bz4WxR6fyNpBK2yAinWEsikxqEt
 		// second (due to execution time of the test)
 		gomega.Expect(deadline).To(gomega.BeTemporally("~", time.Now().Add(10*time.Second), time.Second))
 	})
+	ginkgo.It("should stop sending requests when connection is down", func() {
+		opts := &ConnectionOptions{
+			Timeout:          time.Second,
+			FailureThreshold: 1,
+			Redial:           backoff.Policy{Initial: time.Hour},
+		}
+		client, err := NewAgentClient(address, opts)
+		gomega.Expect(err).To(gomega.Succeed())
+		defer client.Close()
+		gomega.Expect(client.Available()).To(gomega.BeTrue())
+
+		// Nothing listening
+		_, rpcErr := client.AgentCheck(client.GetContext(), &grpc_edge_controller_go.AgentCheckRequest{})
+		gomega.Expect(rpcErr).To(gomega.HaveOccurred())
+		gomega.Expect(client.Available()).To(gomega.BeFalse())
+		gomega.Expect(client.BreakerState()).To(gomega.Equal(BreakerOpen))
+
+		_, rpcErr = client.AgentCheck(client.GetContext(), &grpc_edge_controller_go.AgentCheckRequest{})
+		gomega.Expect(rpcErr).To(gomega.Equal(errConnectionDown))
+	})
+
+	ginkgo.It("should count stream failures with the breaker", func() {
+		opts := &ConnectionOptions{
+			Timeout:          time.Second,
+			FailureThreshold: 1,
+			Redial:           backoff.Policy{Initial: time.Hour},
+		}
+		client, err := NewAgentClient(closedAddress(), opts)
+		gomega.Expect(err).To(gomega.Succeed())
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// Nothing listening; fails either opening or receiving
+		stream, streamErr := client.OperationStream(ctx)
+		if streamErr == nil {
+			_, streamErr = stream.Recv()
+			streamErr = client.RecordStreamError(streamErr)
+		}
+		gomega.Expect(streamErr).To(gomega.HaveOccurred())
+		gomega.Expect(client.BreakerState()).To(gomega.Equal(BreakerOpen))
+	})
 })
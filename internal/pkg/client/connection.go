@@ -0,0 +1,181 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+// Monitoring and re-establishing the Edge Controller connection
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/nalej/grpc-edge-controller-go"
+
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// Returned without attempting a request while the circuit breaker is open
+var errConnectionDown = status.Error(codes.Unavailable, "edge controller connection down")
+
+// Current state of the underlying connection
+func (c *AgentClient) ConnectionState() connectivity.State {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.conn.GetState()
+}
+
+func (c *AgentClient) agentClient() (grpc_edge_controller_go.AgentClient, error) {
+	if !c.breaker.Allow() {
+		return nil, errConnectionDown
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.client, nil
+}
+
+// Number of consecutive requests rejected because the Edge Controller
+// doesn't accept our token
+func (c *AgentClient) AuthFailures() int {
+	return int(atomic.LoadInt32(&c.authFailures))
+}
+
+// Record the outcome of a request with the circuit breaker, and
+// re-establish the connection if it opens. Also keep track of rejected
+// tokens. Returns the error to pass on to the caller.
+func (c *AgentClient) record(err error) error {
+	// gRPC reports a failed handshake as the connection being unavailable.
+	// Re-establishing the connection doesn't fix a certificate that
+	// doesn't match, so report that instead.
+	if connectionFailure(err) {
+		if mismatch := c.lastPinMismatch(); mismatch != nil {
+			return mismatch
+		}
+	}
+
+	if status.Code(err) == codes.Unauthenticated {
+		failures := atomic.AddInt32(&c.authFailures, 1)
+		log.Warn().Err(err).Int32("failures", failures).Msg("edge controller rejected agent token")
+	} else if err == nil {
+		atomic.StoreInt32(&c.authFailures, 0)
+	}
+
+	if !connectionFailure(err) {
+		c.breaker.Success()
+		return err
+	}
+
+	if c.breaker.Failure() {
+		log.Warn().Err(err).Str("address", c.Address()).Msg("edge controller connection down, re-establishing")
+		c.redial()
+	}
+
+	return err
+}
+
+// Only errors reaching the Edge Controller count as failures; anything
+// else means the connection is fine.
+func connectionFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+
+	return false
+}
+
+// Replace the connection with a new one to the next endpoint, so a
+// changed address is resolved again and a stuck connection is dropped.
+// With a single endpoint, that's the same one.
+func (c *AgentClient) redial() {
+	previous := c.Address()
+	address := c.nextEndpoint()
+	if address != previous {
+		log.Warn().Str("address", address).Str("previous", previous).Msg("failing over to next edge controller endpoint")
+	}
+
+	c.dial(address)
+}
+
+// Replace the connection with a new one to the same endpoint
+func (c *AgentClient) reconnect() {
+	c.dial(c.Address())
+}
+
+func (c *AgentClient) dial(address string) {
+	// Fake clients can't dial
+	dialOpts := c.dialOptions()
+	if dialOpts == nil {
+		return
+	}
+
+	conn, err := grpc.Dial(address, dialOpts...)
+	if err != nil {
+		log.Warn().Err(err).Str("address", address).Msg("unable to re-create client connection")
+		return
+	}
+
+	c.setConn(address, conn)
+}
+
+// Start using a connection, closing the previous one
+func (c *AgentClient) setConn(address string, conn *grpc.ClientConn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	failedOver := !c.isPreferred(address)
+
+	c.lock.Lock()
+	oldConn, oldCancel := c.conn, c.cancelMonitor
+	c.address = address
+	c.conn = conn
+	c.client = grpc_edge_controller_go.NewAgentClient(conn)
+	c.cancelMonitor = cancel
+	c.lock.Unlock()
+
+	go monitor(ctx, address, conn)
+
+	// Switch back when possible if we failed over
+	if failedOver && c.dialOptions() != nil && c.options().ProbeInterval > 0 {
+		go c.probe(ctx, address)
+	}
+
+	if oldCancel != nil {
+		oldCancel()
+	}
+	if oldConn != nil {
+		oldConn.Close()
+	}
+}
+
+// Log connection state changes, so we can tell when and how the connection
+// to the Edge Controller went down
+func monitor(ctx context.Context, address string, conn *grpc.ClientConn) {
+	state := conn.GetState()
+	for conn.WaitForStateChange(ctx, state) {
+		state = conn.GetState()
+		log.Debug().Str("address", address).Str("state", state.String()).Msg("connection state changed")
+		if state == connectivity.Shutdown {
+			return
+		}
+	}
+}
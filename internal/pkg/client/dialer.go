@@ -0,0 +1,102 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+// Dialing Edge Controller connections and counting their traffic
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Dials Edge Controller connections, through a proxy if needed, keeps the
+// local address of the last connection and counts the bytes sent and
+// received on all connections, including TLS and HTTP/2 overhead.
+type dialer struct {
+	// Connect directly if nil
+	proxy *ProxyOptions
+
+	sent     uint64
+	received uint64
+
+	lock      sync.Mutex
+	localAddr net.Addr
+}
+
+func (d *dialer) dial(ctx context.Context, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if d.proxy == nil || d.proxy.Bypass(address) {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = d.proxy.dial(ctx, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	d.localAddr = conn.LocalAddr()
+	d.lock.Unlock()
+
+	return &countingConn{Conn: conn, dialer: d}, nil
+}
+
+// Local IP address of the last connection; empty if none
+func (d *dialer) LocalAddress() string {
+	if d == nil {
+		return ""
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	addr, ok := d.localAddr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+// Bytes sent and received so far
+func (d *dialer) Traffic() (uint64, uint64) {
+	if d == nil {
+		return 0, 0
+	}
+
+	return atomic.LoadUint64(&d.sent), atomic.LoadUint64(&d.received)
+}
+
+type countingConn struct {
+	net.Conn
+	dialer *dialer
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.dialer.received, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.dialer.sent, uint64(n))
+	return n, err
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+// Failing over between Edge Controller endpoints
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc"
+)
+
+// Time to wait for a probed endpoint if there's no communication timeout
+const defaultProbeTimeout = 20 * time.Second
+
+// Replaced in tests
+var lookupSRV = net.LookupSRV
+
+// Ordered list of Edge Controller endpoints, most preferred first: the
+// address we were created with, the fallback addresses and then whatever
+// the SRV name resolves to. If resolving fails, we keep using what it
+// resolved to before.
+func (c *AgentClient) endpoints() []string {
+	endpoints := []string{}
+	seen := map[string]bool{}
+	add := func(address string) {
+		if address != "" && !seen[address] {
+			seen[address] = true
+			endpoints = append(endpoints, address)
+		}
+	}
+
+	opts := c.options()
+	add(c.preferred)
+	for _, address := range opts.FallbackAddresses {
+		add(address)
+	}
+
+	if opts.SRV != "" {
+		_, records, err := lookupSRV("", "", opts.SRV)
+		if err != nil {
+			log.Warn().Err(err).Str("srv", opts.SRV).Msg("unable to resolve edge controller endpoints")
+		} else {
+			// Records are sorted by priority and weight
+			resolved := make([]string, 0, len(records))
+			for _, record := range records {
+				host := strings.TrimSuffix(record.Target, ".")
+				resolved = append(resolved, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+			}
+			c.lock.Lock()
+			c.resolved = resolved
+			c.lock.Unlock()
+		}
+	}
+
+	c.lock.RLock()
+	for _, address := range c.resolved {
+		add(address)
+	}
+	c.lock.RUnlock()
+
+	return endpoints
+}
+
+// Whether address is the most preferred endpoint: the address we were
+// created with or, without one, the first one the SRV name resolved to
+func (c *AgentClient) isPreferred(address string) bool {
+	if c.preferred != "" {
+		return address == c.preferred
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.resolved) == 0 || address == c.resolved[0]
+}
+
+// Endpoint after the current one, wrapping around to the most preferred
+func (c *AgentClient) nextEndpoint() string {
+	endpoints := c.endpoints()
+	current := c.Address()
+	if len(endpoints) == 0 {
+		return current
+	}
+
+	for i, address := range endpoints {
+		if address == current {
+			return endpoints[(i+1)%len(endpoints)]
+		}
+	}
+	return endpoints[0]
+}
+
+// Periodically check if a more preferred endpoint than the current one is
+// reachable again, and switch back to it if so. Stops when ctx is
+// cancelled, which happens when the connection is replaced.
+func (c *AgentClient) probe(ctx context.Context, current string) {
+	ticker := time.NewTicker(c.options().ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, address := range c.endpoints() {
+			if address == current {
+				break
+			}
+
+			conn := c.probeEndpoint(ctx, address)
+			if conn == nil {
+				continue
+			}
+
+			log.Info().Str("address", address).Str("previous", current).Msg("preferred edge controller endpoint available again, switching")
+			c.setConn(address, conn)
+			c.breaker.Success()
+			return
+		}
+	}
+}
+
+// Open a connection to address and wait until it is ready; nil if it
+// doesn't get ready in time.
+func (c *AgentClient) probeEndpoint(ctx context.Context, address string) *grpc.ClientConn {
+	timeout := c.options().Timeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	log.Debug().Str("address", address).Msg("probing edge controller endpoint")
+	conn, err := grpc.DialContext(ctx, address, append(c.dialOptions(), grpc.WithBlock())...)
+	if err != nil {
+		log.Debug().Err(err).Str("address", address).Msg("edge controller endpoint not available")
+		return nil
+	}
+
+	return conn
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nalej/grpc-edge-controller-go"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc"
+)
+
+// Address of a local port nothing is listening on
+func closedAddress() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	gomega.Expect(err).To(gomega.Succeed())
+	address := listener.Addr().String()
+	gomega.Expect(listener.Close()).To(gomega.Succeed())
+
+	return address
+}
+
+var _ = ginkgo.Describe("endpoints", func() {
+	var srvRecords []*net.SRV
+	var srvErr error
+
+	ginkgo.BeforeEach(func() {
+		srvRecords = nil
+		srvErr = nil
+		lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+			return name, srvRecords, srvErr
+		}
+	})
+
+	ginkgo.AfterEach(func() {
+		lookupSRV = net.LookupSRV
+	})
+
+	ginkgo.It("should order endpoints by preference", func() {
+		srvRecords = []*net.SRV{
+			&net.SRV{Target: "ec3.local.", Port: 5588},
+			&net.SRV{Target: "ec1.local.", Port: 5588},
+		}
+		c, derr := NewAgentClient("ec1.local:5588", &ConnectionOptions{
+			FallbackAddresses: []string{"ec2.local:5588"},
+			SRV:               "_agent._tcp.local",
+		})
+		gomega.Expect(derr).To(gomega.Succeed())
+		defer c.Close()
+
+		gomega.Expect(c.Address()).To(gomega.Equal("ec1.local:5588"))
+		gomega.Expect(c.Endpoints()).To(gomega.Equal([]string{"ec1.local:5588", "ec2.local:5588", "ec3.local:5588"}))
+
+		// Keep what we resolved before when resolving fails
+		srvErr = fmt.Errorf("no such host")
+		gomega.Expect(c.Endpoints()).To(gomega.Equal([]string{"ec1.local:5588", "ec2.local:5588", "ec3.local:5588"}))
+	})
+
+	ginkgo.It("should connect to SRV endpoints without address", func() {
+		srvRecords = []*net.SRV{&net.SRV{Target: "ec.local.", Port: 5588}}
+		c, derr := NewAgentClient("", &ConnectionOptions{SRV: "_agent._tcp.local"})
+		gomega.Expect(derr).To(gomega.Succeed())
+		defer c.Close()
+
+		gomega.Expect(c.Address()).To(gomega.Equal("ec.local:5588"))
+
+		srvErr = fmt.Errorf("no such host")
+		_, derr = NewAgentClient("", &ConnectionOptions{SRV: "_other._tcp.local"})
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should fail over to the next endpoint when the connection is down", func() {
+		preferred, fallback := closedAddress(), closedAddress()
+		c, derr := NewAgentClient(preferred, &ConnectionOptions{
+			Timeout:           time.Second,
+			FailureThreshold:  1,
+			Redial:            backoff.Policy{Initial: time.Hour},
+			FallbackAddresses: []string{fallback},
+			Token:             "testtoken",
+		})
+		gomega.Expect(derr).To(gomega.Succeed())
+		defer c.Close()
+
+		// Nothing listening
+		_, err := c.AgentCheck(c.GetContext(), &grpc_edge_controller_go.AgentCheckRequest{})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(c.Address()).To(gomega.Equal(fallback))
+		gomega.Expect(c.token).To(gomega.Equal("testtoken"))
+
+		// Wrap around
+		c.Failover()
+		gomega.Expect(c.Address()).To(gomega.Equal(preferred))
+	})
+
+	ginkgo.It("should switch back to the preferred endpoint when it is available", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		gomega.Expect(err).To(gomega.Succeed())
+		server := grpc.NewServer()
+		go server.Serve(listener)
+		defer server.Stop()
+
+		fallback := closedAddress()
+		c, derr := NewAgentClient(listener.Addr().String(), &ConnectionOptions{
+			Timeout:           time.Second,
+			FallbackAddresses: []string{fallback},
+			ProbeInterval:     10 * time.Millisecond,
+		})
+		gomega.Expect(derr).To(gomega.Succeed())
+		defer c.Close()
+
+		c.Failover()
+		gomega.Expect(c.Address()).To(gomega.Equal(fallback))
+		gomega.Eventually(c.Address, 5*time.Second).Should(gomega.Equal(listener.Addr().String()))
+	})
+})
@@ -20,11 +20,28 @@ package client
 // Create client connection to Edge Controller from Config object
 
 import (
+	"io/ioutil"
+	"os"
+	"strings"
+
 	"github.com/nalej/derrors"
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
 	"github.com/nalej/service-net-agent/internal/pkg/config"
+	"github.com/nalej/service-net-agent/internal/pkg/defaults"
 )
 
 func FromConfig(config *config.Config, token ...string) (*AgentClient, derrors.Error) {
+	opts, derr := OptionsFromConfig(config, token...)
+	if derr != nil {
+		return nil, derr
+	}
+
+	return NewAgentClient(config.GetString("controller.address"), opts)
+}
+
+// Connection options in the configuration, with an optional token instead
+// of the configured one
+func OptionsFromConfig(config *config.Config, token ...string) (*ConnectionOptions, derrors.Error) {
 	// Get token from config
 	t := config.GetString("agent.token")
 	// Override from optional argument
@@ -39,7 +56,72 @@ func FromConfig(config *config.Config, token ...string) (*AgentClient, derrors.E
 		Insecure: config.GetBool("controller.insecure"),
 		Timeout:  config.GetDuration("agent.comm_timeout"),
 		Token:    t,
+
+		ServerName: config.GetString("controller.server_name"),
+		Pins:       config.GetStringSlice("controller.pins"),
+
+		KeepaliveTime:    config.GetDuration("controller.keepalive_time"),
+		KeepaliveTimeout: config.GetDuration("controller.keepalive_timeout"),
+
+		FailureThreshold: config.GetInt("controller.failure_threshold"),
+		Redial: backoff.Policy{
+			Initial:    config.GetDuration("controller.redial_interval"),
+			Max:        config.GetDuration("controller.max_redial_interval"),
+			Multiplier: 2,
+			Jitter:     config.GetFloat64("agent.interval_jitter"),
+		},
+
+		FallbackAddresses: config.GetStringSlice("controller.fallback_addresses"),
+		SRV:               config.GetString("controller.srv"),
+		ProbeInterval:     config.GetDuration("controller.probe_interval"),
 	}
 
-	return NewAgentClient(config.GetString("controller.address"), opts)
+	// Client certificate is stored when joining
+	certFile := config.GetString("controller.client_cert")
+	if certFile != "" {
+		cert, derr := LoadClientCertificate(certFile, config.GetString("controller.client_key"))
+		if derr != nil {
+			return nil, derr
+		}
+		opts.ClientCert = cert
+	}
+
+	proxyURL := config.GetString("controller.proxy.url")
+	if proxyURL != "" {
+		password, derr := proxyPassword(config)
+		if derr != nil {
+			return nil, derr
+		}
+		proxy, derr := ParseProxy(proxyURL,
+			config.GetString("controller.proxy.username"),
+			password,
+			config.GetStringSlice("controller.proxy.no_proxy"))
+		if derr != nil {
+			return nil, derr
+		}
+		opts.Proxy = proxy
+	}
+
+	return opts, nil
+}
+
+// Get the proxy password from the password file, the configuration or the
+// environment, in that order. There is no flag for it, as that would show
+// up in the process list.
+func proxyPassword(config *config.Config) (string, derrors.Error) {
+	file := config.GetString("controller.proxy.password_file")
+	if file != "" {
+		password, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", derrors.NewPermissionDeniedError("failed reading proxy password file", err).WithParams(file)
+		}
+		return strings.TrimRight(string(password), "\r\n"), nil
+	}
+
+	password := config.GetString("controller.proxy.password")
+	if password != "" {
+		return password, nil
+	}
+
+	return os.Getenv(defaults.ProxyPasswordEnv), nil
 }
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+// Heartbeat interval requested by the Edge Controller
+
+import (
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Header the Edge Controller can send along with a CheckResult to have the
+// agent send heartbeats at a different interval, in seconds. Zero means
+// going back to the configured interval.
+const IntervalHeader = "agent-interval"
+
+// Get the heartbeat interval the Edge Controller requested in the header
+// of a CheckResult. Returns false if it didn't request one.
+func RequestedInterval(header metadata.MD) (time.Duration, bool) {
+	values := header.Get(IntervalHeader)
+	if len(values) == 0 {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(values[len(values)-1], 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
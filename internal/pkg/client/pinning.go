@@ -0,0 +1,143 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+// Pinning the public key of the Edge Controller
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+
+	"github.com/nalej/derrors"
+
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Pins are the base64 encoded SHA-256 hash of a certificate's
+// SubjectPublicKeyInfo, prefixed with the hash algorithm
+const pinPrefix = "sha256/"
+
+// PublicKeyPin returns the pin for the public key of a certificate
+func PublicKeyPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func validatePins(pins []string) derrors.Error {
+	for _, pin := range pins {
+		if !strings.HasPrefix(pin, pinPrefix) {
+			return derrors.NewInvalidArgumentError("unsupported server pin, must start with " + pinPrefix).WithParams(pin)
+		}
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+		if err != nil || len(hash) != sha256.Size {
+			return derrors.NewInvalidArgumentError("invalid server pin", err).WithParams(pin)
+		}
+	}
+
+	return nil
+}
+
+// Pins to trust the Edge Controller of the last handshake on first use.
+// If its certificate was verified, these are the pins of the root CAs, so
+// other endpoints with certificates from the same CA match as well.
+// Otherwise, these are the pins of the certificates it presented, which
+// only match endpoints presenting the same keys.
+func (c *AgentClient) ServerPins() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.serverPins
+}
+
+// Called during the TLS handshake, after the regular certificate checks.
+// If we have pins, at least one certificate in the chain has to match one
+// of them. Multiple pins allow rotating keys.
+func (c *AgentClient) verifyServer(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	presented := make([]string, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return derrors.NewInvalidArgumentError("invalid edge controller certificate", err)
+		}
+		presented = append(presented, PublicKeyPin(cert))
+	}
+
+	// Certificates the chain was verified against, like the root CA,
+	// can be pinned as well
+	candidates := append([]string{}, presented...)
+	roots := []string{}
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			candidates = append(candidates, PublicKeyPin(cert))
+		}
+		if len(chain) > 0 {
+			roots = append(roots, PublicKeyPin(chain[len(chain)-1]))
+		}
+	}
+
+	trusted := presented
+	if len(roots) > 0 {
+		trusted = roots
+	}
+
+	pins := c.options().Pins
+	derr := matchPins(pins, candidates)
+	if derr != nil {
+		log.Error().Strs("presented", presented).Strs("pins", pins).Msg(derr.Error())
+	}
+
+	c.lock.Lock()
+	c.serverPins = trusted
+	c.pinMismatch = nil
+	if derr != nil {
+		c.pinMismatch = status.Error(codes.PermissionDenied, derr.Error())
+	}
+	c.lock.Unlock()
+
+	return derr
+}
+
+func matchPins(pins []string, candidates []string) derrors.Error {
+	if len(pins) == 0 {
+		return nil
+	}
+
+	for _, candidate := range candidates {
+		for _, pin := range pins {
+			if candidate == pin {
+				return nil
+			}
+		}
+	}
+
+	return derrors.NewPermissionDeniedError("edge controller public key doesn't match any pin").WithParams(candidates)
+}
+
+// Error for requests that failed because the last handshake didn't match
+// our pins; nil if it did
+func (c *AgentClient) lastPinMismatch() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.pinMismatch
+}
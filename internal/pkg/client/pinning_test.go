@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/service-net-agent/internal/pkg/backoff"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Self-signed certificate with a new key
+func newTestCertificate() *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	gomega.Expect(err).To(gomega.Succeed())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "edge-controller"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	gomega.Expect(err).To(gomega.Succeed())
+
+	cert, err := x509.ParseCertificate(der)
+	gomega.Expect(err).To(gomega.Succeed())
+
+	return cert
+}
+
+var _ = ginkgo.Describe("pinning", func() {
+	var cert *x509.Certificate
+
+	ginkgo.BeforeEach(func() {
+		cert = newTestCertificate()
+	})
+
+	ginkgo.It("should create valid pins", func() {
+		pin := PublicKeyPin(cert)
+		gomega.Expect(pin).To(gomega.HavePrefix(pinPrefix))
+		gomega.Expect(validatePins([]string{pin})).To(gomega.Succeed())
+
+		gomega.Expect(validatePins([]string{"sha1/AAAA"})).ToNot(gomega.Succeed())
+		gomega.Expect(validatePins([]string{"sha256/AAAA"})).ToNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should accept any certificate without pins and record it", func() {
+		c := &AgentClient{opts: &ConnectionOptions{}}
+
+		gomega.Expect(c.verifyServer([][]byte{cert.Raw}, nil)).To(gomega.Succeed())
+		gomega.Expect(c.ServerPins()).To(gomega.Equal([]string{PublicKeyPin(cert)}))
+	})
+
+	ginkgo.It("should accept certificates matching any pin", func() {
+		c := &AgentClient{opts: &ConnectionOptions{
+			Pins: []string{PublicKeyPin(newTestCertificate()), PublicKeyPin(cert)},
+		}}
+
+		gomega.Expect(c.verifyServer([][]byte{cert.Raw}, nil)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should accept certificates with a pinned CA", func() {
+		ca := newTestCertificate()
+		c := &AgentClient{opts: &ConnectionOptions{
+			Pins: []string{PublicKeyPin(ca)},
+		}}
+
+		gomega.Expect(c.verifyServer([][]byte{cert.Raw}, [][]*x509.Certificate{{cert, ca}})).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should reject certificates not matching any pin", func() {
+		c := &AgentClient{opts: &ConnectionOptions{
+			Pins: []string{PublicKeyPin(newTestCertificate())},
+		}}
+
+		err := c.verifyServer([][]byte{cert.Raw}, nil)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.(derrors.Error).Type()).To(gomega.Equal(derrors.PermissionDenied))
+	})
+
+	ginkgo.It("should trust the root CA of a verified chain", func() {
+		ca := newTestCertificate()
+		c := &AgentClient{opts: &ConnectionOptions{}}
+
+		gomega.Expect(c.verifyServer([][]byte{cert.Raw}, [][]*x509.Certificate{{cert, ca}})).To(gomega.Succeed())
+		gomega.Expect(c.ServerPins()).To(gomega.Equal([]string{PublicKeyPin(ca)}))
+	})
+
+	ginkgo.It("should report a pin mismatch instead of a connection failure", func() {
+		c := &AgentClient{
+			opts: &ConnectionOptions{
+				Pins: []string{PublicKeyPin(newTestCertificate())},
+			},
+			breaker: NewBreaker(1, backoff.Policy{Initial: time.Hour}),
+		}
+
+		gomega.Expect(c.verifyServer([][]byte{cert.Raw}, nil)).ToNot(gomega.Succeed())
+		err := c.record(status.Error(codes.Unavailable, "handshake failed"))
+		gomega.Expect(status.Code(err)).To(gomega.Equal(codes.PermissionDenied))
+		gomega.Expect(c.BreakerState()).To(gomega.Equal(BreakerClosed))
+
+		c.opts.Pins = append(c.opts.Pins, PublicKeyPin(cert))
+		gomega.Expect(c.verifyServer([][]byte{cert.Raw}, nil)).To(gomega.Succeed())
+		err = c.record(status.Error(codes.Unavailable, "connection lost"))
+		gomega.Expect(status.Code(err)).To(gomega.Equal(codes.Unavailable))
+	})
+
+	ginkgo.It("should not create a client with invalid pins", func() {
+		_, derr := NewAgentClient("localhost:12345", &ConnectionOptions{
+			UseTLS: true,
+			Pins:   []string{"invalid"},
+		})
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+		gomega.Expect(derr.Type()).To(gomega.Equal(derrors.InvalidArgument))
+
+		_, derr = NewAgentClient("localhost:12345", &ConnectionOptions{
+			Pins: []string{PublicKeyPin(cert)},
+		})
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+	})
+})
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+// Access to configuration values. The configuration can be replaced by a
+// reload while it's being used, so values are read and set while holding
+// the configuration lock.
+
+import (
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func (c *Config) Get(key string) interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.Get(key)
+}
+
+func (c *Config) GetString(key string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetString(key)
+}
+
+func (c *Config) GetBool(key string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetBool(key)
+}
+
+func (c *Config) GetInt(key string) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetInt(key)
+}
+
+func (c *Config) GetInt64(key string) int64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetInt64(key)
+}
+
+func (c *Config) GetFloat64(key string) float64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetFloat64(key)
+}
+
+func (c *Config) GetDuration(key string) time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetDuration(key)
+}
+
+func (c *Config) GetSizeInBytes(key string) uint {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetSizeInBytes(key)
+}
+
+func (c *Config) GetStringSlice(key string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetStringSlice(key)
+}
+
+func (c *Config) GetStringMap(key string) map[string]interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetStringMap(key)
+}
+
+func (c *Config) GetStringMapString(key string) map[string]string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.GetStringMapString(key)
+}
+
+func (c *Config) IsSet(key string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.IsSet(key)
+}
+
+func (c *Config) AllKeys() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.AllKeys()
+}
+
+func (c *Config) AllSettings() map[string]interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.AllSettings()
+}
+
+func (c *Config) Sub(key string) *viper.Viper {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Viper.Sub(key)
+}
+
+func (c *Config) Set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Viper.Set(key, value)
+}
+
+// SetDefault sets a default value, which is kept when reloading
+func (c *Config) SetDefault(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.defaults == nil {
+		c.defaults = make(map[string]interface{})
+	}
+	c.defaults[key] = value
+	c.Viper.SetDefault(key, value)
+}
+
+// BindPFlag binds a flag to a key, which is kept when reloading
+func (c *Config) BindPFlag(key string, flag *pflag.Flag) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.flags == nil {
+		c.flags = make(map[string]*pflag.Flag)
+	}
+	c.flags[key] = flag
+	return c.Viper.BindPFlag(key, flag)
+}
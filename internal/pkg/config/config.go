@@ -20,45 +20,75 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/nalej/derrors"
 
+	"github.com/nalej/service-net-agent/internal/pkg/atomicfile"
 	"github.com/nalej/service-net-agent/version"
 
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
 )
 
+// Number of previous configuration files kept, by default
+const DefaultBackups = 3
+
 type Config struct {
 	Path       string
 	ConfigFile string
 	LogFile    string
 
+	// Number of previous good configuration files to keep, to fall back
+	// on when the configuration file is corrupt
+	Backups int
+
+	// Encrypts secret values in the configuration file. Secrets are
+	// stored in plaintext if not set.
+	Secrets *SecretStore
+
 	// For plugins - calling write on a subtree will call write on parent
 	parent *Config
 	// Key under which this child sits at parent
 	childKey string
 
-	// Write lock
+	// Write lock; serializes changes to the configuration file
 	writeLock sync.Mutex
 
+	// Protects Viper, which is replaced when reloading. Values are read
+	// and set through the methods in access.go, which take this lock.
+	lock sync.RWMutex
+	// Defaults and flags, to apply them to a reloaded configuration
+	defaults map[string]interface{}
+	flags    map[string]*pflag.Flag
+
+	// Incremented each time the configuration is read or written
+	generation uint64
+
+	// File contents in effect, to go back to when a reload is rejected,
+	// and the contents we last wrote ourselves
+	loaded  []byte
+	written []byte
+
 	*viper.Viper
 }
 
 func NewConfig() *Config {
 	c := &Config{
-		Viper: viper.New(),
+		Backups: DefaultBackups,
+		Viper:   viper.New(),
 	}
 
-	// We store a token, make it only readable for user
-	// See comment in Write()
-	// c.Viper.SetConfigPermissions(0600)
-
 	return c
 }
 
@@ -66,7 +96,9 @@ func (c *Config) Read() derrors.Error {
 	log.Info().Str("file", c.ConfigFile).Msg("reading configuration file")
 
 	// Pass filename to Viper
-	c.SetConfigFile(c.ConfigFile)
+	c.lock.Lock()
+	c.Viper.SetConfigFile(c.ConfigFile)
+	c.lock.Unlock()
 
 	// Check if file exists. Ok if not, just don't try to read.
 	if _, err := os.Stat(c.ConfigFile); os.IsNotExist(err) {
@@ -74,14 +106,122 @@ func (c *Config) Read() derrors.Error {
 	}
 
 	// Read
-	err := c.ReadInConfig()
+	data, err := ioutil.ReadFile(c.ConfigFile)
 	if err != nil {
-		return derrors.NewInvalidArgumentError("failed reading configuration file", err)
+		return derrors.NewPermissionDeniedError("failed reading configuration file", err).WithParams(c.ConfigFile)
 	}
 
+	// Only a corrupt file is replaced by a backup; other failures, like
+	// secrets we can't decrypt, apply to the backups as well
+	err = c.parse(viper.New(), data)
+	if err != nil {
+		log.Warn().Err(err).Str("file", c.ConfigFile).Msg("corrupt configuration file, trying backups")
+		derr := c.restoreBackup()
+		if derr != nil {
+			return derrors.NewInvalidArgumentError("failed reading configuration file", err)
+		}
+	} else {
+		err = c.loadInPlace(data)
+		if err != nil {
+			return derrors.NewInvalidArgumentError("failed reading configuration file", err).WithParams(c.ConfigFile)
+		}
+		c.loaded = data
+	}
+	atomic.AddUint64(&c.generation, 1)
+
 	return nil
 }
 
+// Reload the configuration file while running. The new configuration is
+// only put in place if validate accepts it. Returns false if the file
+// didn't change since it was last read or written.
+//
+// The new configuration has the same defaults and flags, but values set
+// while running are dropped; they're written to the file, so the file is
+// leading.
+func (c *Config) Reload(validate func(*Config) derrors.Error) (bool, derrors.Error) {
+	if c.parent != nil {
+		return false, derrors.NewInvalidArgumentError("can't reload a sub-config")
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	data, err := ioutil.ReadFile(c.ConfigFile)
+	if err != nil {
+		return false, derrors.NewPermissionDeniedError("failed reading configuration file", err).WithParams(c.ConfigFile)
+	}
+	if bytes.Equal(data, c.loaded) || bytes.Equal(data, c.written) {
+		return false, nil
+	}
+
+	candidate := c.newViper()
+	err = c.load(candidate, data)
+	if err != nil {
+		return false, derrors.NewInvalidArgumentError("failed reading configuration file", err).WithParams(c.ConfigFile)
+	}
+	derr := validate(&Config{
+		Path:       c.Path,
+		ConfigFile: c.ConfigFile,
+		LogFile:    c.LogFile,
+		Viper:      candidate,
+	})
+	if derr != nil {
+		return false, derr
+	}
+
+	c.lock.Lock()
+	c.Viper = candidate
+	c.lock.Unlock()
+
+	c.loaded = data
+	atomic.AddUint64(&c.generation, 1)
+
+	return true, nil
+}
+
+// Read the newest backup that can be parsed, and put it back in place of
+// the configuration file
+func (c *Config) restoreBackup() derrors.Error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	for i := 1; i <= c.Backups; i++ {
+		backup := c.backupFile(i)
+		data, err := ioutil.ReadFile(backup)
+		if err != nil {
+			continue
+		}
+
+		err = c.loadInPlace(data)
+		if err != nil {
+			log.Warn().Err(err).Str("file", backup).Msg("skipping corrupt configuration backup")
+			continue
+		}
+
+		log.Warn().Str("file", backup).Msg("restoring configuration from backup")
+		c.loaded = data
+		derr := atomicfile.WriteFile(c.ConfigFile, data)
+		if derr != nil {
+			log.Warn().Err(derr).Str("file", c.ConfigFile).Msg("failed restoring configuration file")
+		}
+
+		return nil
+	}
+
+	return derrors.NewNotFoundError("no valid configuration backup").WithParams(c.ConfigFile)
+}
+
+// Generation of the configuration, which changes each time it is read or
+// written. Sub-configs share the generation of their parent.
+func (c *Config) Generation() uint64 {
+	if c.parent != nil {
+		return c.parent.Generation()
+	}
+
+	return atomic.LoadUint64(&c.generation)
+}
+
 func (c *Config) GetSubConfig(prefix string) *Config {
 	sub := c.Sub(prefix)
 	if sub == nil {
@@ -148,13 +288,21 @@ func (c *Config) DeleteConfigFile() derrors.Error {
 		return derrors.NewInternalError("failed to delete config file", err).WithParams(c.ConfigFile)
 	}
 
+	// Backups contain the same secrets
+	for i := 1; i <= c.Backups; i++ {
+		err = os.Remove(c.backupFile(i))
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("file", c.backupFile(i)).Msg("failed to delete config backup")
+		}
+	}
+
 	return nil
 }
 
 func (c *Config) unsetLocked(key string) {
 	// Viper is not meant for deleting keys - we deep-copy everything,
 	// skipping keys that match
-	newConf := viper.New()
+	newConf := c.newViper()
 	for _, k := range c.AllKeys() {
 		if k == key || strings.HasPrefix(k, key+".") {
 			continue
@@ -162,7 +310,9 @@ func (c *Config) unsetLocked(key string) {
 		newConf.Set(k, c.Get(k))
 	}
 
+	c.lock.Lock()
 	c.Viper = newConf
+	c.lock.Unlock()
 }
 
 func (c *Config) Write() derrors.Error {
@@ -177,41 +327,235 @@ func (c *Config) Write() derrors.Error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 
+	return c.writeLocked()
+}
+
+// SetAndWrite sets a value and writes the configuration file, without
+// other changes to the configuration getting in between
+func (c *Config) SetAndWrite(key string, value interface{}) derrors.Error {
+	if c.parent != nil {
+		c.Set(key, value)
+		return c.Write()
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.Set(key, value)
+	return c.writeLocked()
+}
+
+func (c *Config) writeLocked() derrors.Error {
 	confDir := filepath.Dir(c.ConfigFile)
 	err := os.MkdirAll(confDir, 0755)
 	if err != nil {
 		return derrors.NewPermissionDeniedError("failed creating config dir", err).WithParams(confDir)
 	}
 
-	// We set this here in case we re-created a config when deleting keys
-	c.SetConfigFile(c.ConfigFile)
+	data, derr := c.marshal()
+	if derr != nil {
+		return derr
+	}
+
+	c.rotateBackups()
 
-	// Unstable version of viper allows to set filemode, we need
-	// to do it after writing. This does introduce a slight vulnerability
-	// as there is a small window during which the file can be read.
-	// This will be fixed with the next version of viper.
-	err = c.WriteConfig()
+	// We store a token, so the file is only readable for the user. It's
+	// never partially written, as that could lose the token.
+	derr = atomicfile.WriteFile(c.ConfigFile, data)
+	if derr != nil {
+		return derr
+	}
+	c.written = data
+	atomic.AddUint64(&c.generation, 1)
+
+	return nil
+}
+
+// Configuration file type, from its extension
+func (c *Config) configType() string {
+	return strings.TrimPrefix(filepath.Ext(c.ConfigFile), ".")
+}
+
+func (c *Config) marshal() ([]byte, derrors.Error) {
+	settings := c.AllSettings()
+	if c.Secrets != nil {
+		derr := walkStrings("", settings, c.encryptValue)
+		if derr != nil {
+			return nil, derr
+		}
+	}
+
+	return c.marshalSettings(settings)
+}
+
+func (c *Config) marshalSettings(settings map[string]interface{}) ([]byte, derrors.Error) {
+	var data []byte
+	var err error
+
+	switch c.configType() {
+	case "yaml", "yml":
+		data, err = yaml.Marshal(settings)
+	case "json":
+		data, err = json.MarshalIndent(settings, "", "  ")
+	default:
+		return nil, derrors.NewInvalidArgumentError("unsupported config file type").WithParams(c.ConfigFile)
+	}
 	if err != nil {
-		return derrors.NewInternalError("failed writing config file", err).WithParams(c.ConfigFile)
+		return nil, derrors.NewInternalError("failed encoding config", err)
 	}
 
-	err = os.Chmod(c.ConfigFile, 0600)
+	return data, nil
+}
+
+// Parse data in the format of the configuration file into v
+func (c *Config) parse(v *viper.Viper, data []byte) error {
+	v.SetConfigType(c.configType())
+	return v.ReadConfig(bytes.NewReader(data))
+}
+
+// Load data in the configuration in effect
+func (c *Config) loadInPlace(data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.load(c.Viper, data)
+}
+
+// New Viper instance with our defaults and flags
+func (c *Config) newViper() *viper.Viper {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	v := viper.New()
+	v.SetConfigFile(c.ConfigFile)
+	for key, value := range c.defaults {
+		v.SetDefault(key, value)
+	}
+	for key, flag := range c.flags {
+		v.BindPFlag(key, flag)
+	}
+
+	return v
+}
+
+// Parse data into v, decrypting encrypted values
+func (c *Config) load(v *viper.Viper, data []byte) error {
+	parsed := viper.New()
+	err := c.parse(parsed, data)
 	if err != nil {
-		return derrors.NewInternalError("failed setting config file permissions", err).WithParams(c.ConfigFile)
+		return err
+	}
+
+	// Viper doesn't let us replace values without them shadowing the
+	// rest of the tree, so we parse the decrypted settings again
+	settings := parsed.AllSettings()
+	encrypted := false
+	derr := walkStrings("", settings, func(key, value string) (string, derrors.Error) {
+		if !IsEncrypted(value) {
+			if IsSecret(key) && value != "" {
+				log.Warn().Str("key", key).Msg("secret stored in plaintext; it will be encrypted on next write")
+			}
+			return value, nil
+		}
+		encrypted = true
+		return c.decryptValue(key, value)
+	})
+	if derr != nil {
+		return derr
+	}
+	if !encrypted {
+		return c.parse(v, data)
+	}
+
+	decrypted, derr := c.marshalSettings(settings)
+	if derr != nil {
+		return derr
+	}
+	return c.parse(v, decrypted)
+}
+
+func (c *Config) encryptValue(key, value string) (string, derrors.Error) {
+	if !IsSecret(key) || value == "" || IsEncrypted(value) {
+		return value, nil
+	}
+
+	return c.Secrets.Encrypt(key, value)
+}
+
+func (c *Config) decryptValue(key, value string) (string, derrors.Error) {
+	if c.Secrets == nil {
+		return "", derrors.NewFailedPreconditionError("configuration contains encrypted values but no secret store is set").WithParams(key)
+	}
+
+	return c.Secrets.Decrypt(key, value)
+}
+
+// Replace all string values in a nested settings map with the result of f
+func walkStrings(prefix string, settings map[string]interface{}, f func(key, value string) (string, derrors.Error)) derrors.Error {
+	for k, v := range settings {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+
+		switch value := v.(type) {
+		case string:
+			s, derr := f(key, value)
+			if derr != nil {
+				return derr
+			}
+			settings[k] = s
+		case map[string]interface{}:
+			derr := walkStrings(key, value, f)
+			if derr != nil {
+				return derr
+			}
+		}
 	}
 
 	return nil
 }
 
+// Backup file; the higher n, the older
+func (c *Config) backupFile(n int) string {
+	return fmt.Sprintf("%s.%d", c.ConfigFile, n)
+}
+
+// Keep the current configuration file as newest backup, if it's any good,
+// and drop the oldest backup.
+func (c *Config) rotateBackups() {
+	if c.Backups <= 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(c.ConfigFile)
+	if err != nil {
+		return
+	}
+	err = c.parse(viper.New(), data)
+	if err != nil {
+		log.Warn().Err(err).Str("file", c.ConfigFile).Msg("not keeping corrupt configuration file as backup")
+		return
+	}
+
+	for i := c.Backups - 1; i >= 1; i-- {
+		err = os.Rename(c.backupFile(i), c.backupFile(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("file", c.backupFile(i)).Msg("failed rotating configuration backup")
+		}
+	}
+
+	derr := atomicfile.WriteFile(c.backupFile(1), data)
+	if derr != nil {
+		log.Warn().Err(derr).Msg("failed writing configuration backup")
+	}
+}
+
 func (c *Config) Print() {
 	log.Info().Str("app", version.AppVersion).Str("commit", version.Commit).Msg("version")
 	for _, key := range c.AllKeys() {
-		val := c.Get(key)
-
 		// Don't print secrets
-		if strings.Contains(key, "token") {
-			val = interface{}(strings.Repeat("*", len(val.(string))))
-		}
+		val := Redact(key, c.Get(key))
 
 		log.Info().Interface(key, val).Msg("configuration value")
 	}
@@ -23,6 +23,10 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/service-net-agent/internal/pkg/atomicfile"
+
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 
@@ -65,6 +69,10 @@ var _ = ginkgo.Describe("config", func() {
 
 	ginkgo.AfterEach(func() {
 		os.Remove(file) // Ignore error in case file didn't exist
+		backups, _ := filepath.Glob(file + ".*")
+		for _, backup := range backups {
+			os.Remove(backup)
+		}
 		c = nil
 	})
 
@@ -87,6 +95,146 @@ var _ = ginkgo.Describe("config", func() {
 		gomega.Expect(c2.AllSettings()).To(gomega.Equal(c.AllSettings()))
 	})
 
+	ginkgo.It("should keep backups of previous configs", func() {
+		c.Backups = 2
+		for i := 1; i <= 4; i++ {
+			c.Set("generation", i)
+			gomega.Expect(c.Write()).To(gomega.Succeed())
+		}
+		gomega.Expect(file + atomicfile.TmpExt).ToNot(gomega.BeAnExistingFile())
+		gomega.Expect(c.backupFile(3)).ToNot(gomega.BeAnExistingFile())
+
+		for n, generation := range map[int]int{1: 3, 2: 2} {
+			backup := NewConfig()
+			backup.ConfigFile = c.backupFile(n)
+			data, err := ioutil.ReadFile(backup.ConfigFile)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(c.parse(backup.Viper, data)).To(gomega.Succeed())
+			gomega.Expect(backup.GetInt("generation")).To(gomega.Equal(generation))
+
+			info, err := os.Stat(backup.ConfigFile)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(info.Mode().Perm()).To(gomega.BeEquivalentTo(0600))
+		}
+	})
+
+	ginkgo.It("should fall back on the newest good backup when config is corrupt", func() {
+		for i := 1; i <= 3; i++ {
+			c.Set("generation", i)
+			gomega.Expect(c.Write()).To(gomega.Succeed())
+		}
+		gomega.Expect(ioutil.WriteFile(file, []byte("main: [corrupt"), 0600)).To(gomega.Succeed())
+		gomega.Expect(ioutil.WriteFile(c.backupFile(1), []byte("main: [corrupt"), 0600)).To(gomega.Succeed())
+
+		c2 := NewConfig()
+		c2.ConfigFile = file
+		gomega.Expect(c2.Read()).To(gomega.Succeed())
+		gomega.Expect(c2.GetInt("generation")).To(gomega.Equal(1))
+
+		// Backup is put back in place
+		c3 := NewConfig()
+		c3.ConfigFile = file
+		c3.Backups = 0
+		gomega.Expect(c3.Read()).To(gomega.Succeed())
+		gomega.Expect(c3.GetInt("generation")).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("should not fall back on backups when config can't be read", func() {
+		gomega.Expect(c.Write()).To(gomega.Succeed())
+		gomega.Expect(c.Write()).To(gomega.Succeed())
+		gomega.Expect(c.backupFile(1)).To(gomega.BeAnExistingFile())
+
+		// A directory exists, but can't be read as a file
+		gomega.Expect(os.Remove(file)).To(gomega.Succeed())
+		gomega.Expect(os.Mkdir(file, 0755)).To(gomega.Succeed())
+		defer os.Remove(file)
+
+		c2 := NewConfig()
+		c2.ConfigFile = file
+		gomega.Expect(c2.Read()).ToNot(gomega.Succeed())
+		gomega.Expect(file).To(gomega.BeADirectory())
+	})
+
+	ginkgo.It("should fail reading a corrupt config without backups", func() {
+		gomega.Expect(os.MkdirAll(path, 0755)).To(gomega.Succeed())
+		gomega.Expect(ioutil.WriteFile(file, []byte("main: [corrupt"), 0600)).To(gomega.Succeed())
+
+		c2 := NewConfig()
+		c2.ConfigFile = file
+		gomega.Expect(c2.Read()).ToNot(gomega.Succeed())
+	})
+
+	ginkgo.It("should reload a changed config", func() {
+		c.SetDefault("default", "value")
+		gomega.Expect(c.Write()).To(gomega.Succeed())
+
+		valid := func(*Config) derrors.Error { return nil }
+
+		// Nothing changed
+		changed, derr := c.Reload(valid)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(changed).To(gomega.BeFalse())
+
+		// File takes precedence over values set before; defaults stay
+		gen := c.Generation()
+		gomega.Expect(ioutil.WriteFile(file, []byte("main: false\nsub:\n  entry: reloaded\n"), 0600)).To(gomega.Succeed())
+		changed, derr = c.Reload(valid)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(changed).To(gomega.BeTrue())
+		gomega.Expect(c.GetString("sub.entry")).To(gomega.Equal("reloaded"))
+		gomega.Expect(c.GetBool("main")).To(gomega.BeFalse())
+		gomega.Expect(c.GetString("default")).To(gomega.Equal("value"))
+		gomega.Expect(c.Generation()).To(gomega.Equal(gen + 1))
+	})
+
+	ginkgo.It("should keep the config in effect when a reload is rejected", func() {
+		gomega.Expect(c.Write()).To(gomega.Succeed())
+		c2 := NewConfig()
+		c2.ConfigFile = file
+		gomega.Expect(c2.Read()).To(gomega.Succeed())
+		settings := c2.AllSettings()
+
+		gomega.Expect(ioutil.WriteFile(file, []byte("main: false\nsub:\n  entry: invalid\n"), 0600)).To(gomega.Succeed())
+		_, derr := c2.Reload(func(candidate *Config) derrors.Error {
+			// Validated before it's in effect
+			gomega.Expect(c2.GetString("sub.entry")).To(gomega.Equal("string"))
+			if candidate.GetString("sub.entry") == "invalid" {
+				return derrors.NewInvalidArgumentError("invalid entry")
+			}
+			return nil
+		})
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+		gomega.Expect(c2.AllSettings()).To(gomega.Equal(settings))
+
+		// Corrupt file is rejected as well
+		gomega.Expect(ioutil.WriteFile(file, []byte("main: [corrupt"), 0600)).To(gomega.Succeed())
+		_, derr = c2.Reload(func(*Config) derrors.Error { return nil })
+		gomega.Expect(derr).To(gomega.HaveOccurred())
+		gomega.Expect(c2.AllSettings()).To(gomega.Equal(settings))
+	})
+
+	ginkgo.It("should set and write a value", func() {
+		gomega.Expect(c.SetAndWrite("sub.entry", "written")).To(gomega.Succeed())
+
+		c2 := NewConfig()
+		c2.ConfigFile = file
+		gomega.Expect(c2.Read()).To(gomega.Succeed())
+		gomega.Expect(c2.GetString("sub.entry")).To(gomega.Equal("written"))
+	})
+
+	ginkgo.It("should change generation on write and read", func() {
+		gen := c.Generation()
+		gomega.Expect(c.Write()).To(gomega.Succeed())
+		gomega.Expect(c.Generation()).To(gomega.Equal(gen + 1))
+
+		sub := c.GetSubConfig("sub")
+		gomega.Expect(sub.Write()).To(gomega.Succeed())
+		gomega.Expect(sub.Generation()).To(gomega.Equal(gen + 2))
+
+		gomega.Expect(c.Read()).To(gomega.Succeed())
+		gomega.Expect(c.Generation()).To(gomega.Equal(gen + 3))
+	})
+
 	ginkgo.It("should create and merge a new subconfig", func() {
 		sub := c.GetSubConfig("subconfig")
 		gomega.Expect(sub).ToNot(gomega.BeNil())
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Cron-style schedules
+
+package cron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nalej/derrors"
+)
+
+// Schedules further away than this are considered to never happen, e.g.
+// "0 0 30 2 *"
+const maxLookahead = 5 * 366 * 24 * time.Hour
+
+// Schedule is a parsed cron expression with the standard five fields:
+// minute, hour, day of month, month and day of week. Each field can be
+// "*", a number, a range "a-b", a list "a,b" or a step "*/n" or "a-b/n".
+// The aliases @hourly, @daily, @weekly, @monthly and @yearly are supported
+// as well.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Day of month or day of week restricted
+	domAll, dowAll bool
+}
+
+var aliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+type fieldRange struct {
+	name     string
+	min, max int
+}
+
+var fieldRanges = []fieldRange{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // Both 0 and 7 are Sunday
+}
+
+func Parse(spec string) (*Schedule, derrors.Error) {
+	spec = strings.TrimSpace(spec)
+	if alias, found := aliases[spec]; found {
+		spec = alias
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(fieldRanges) {
+		return nil, derrors.NewInvalidArgumentError("cron schedule needs five fields").WithParams(spec)
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var derr derrors.Error
+		bits[i], derr = parseField(field, fieldRanges[i])
+		if derr != nil {
+			return nil, derr.WithParams(spec)
+		}
+	}
+
+	s := &Schedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAll: fields[2] == "*",
+		dowAll: fields[4] == "*",
+	}
+
+	// Sunday is both 0 and 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	return s, nil
+}
+
+func parseField(field string, r fieldRange) (uint64, derrors.Error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, derrors.NewInvalidArgumentError("invalid step in cron " + r.name)
+			}
+			part = part[:i]
+		}
+
+		low, high := r.min, r.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, derrors.NewInvalidArgumentError("invalid cron "+r.name, err)
+			}
+			high = low
+			if len(bounds) == 1 && step > 1 {
+				// "a/n" is from a to the end of the range
+				high = r.max
+			}
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, derrors.NewInvalidArgumentError("invalid cron "+r.name, err)
+				}
+			}
+		}
+		if low < r.min || high > r.max || low > high {
+			return 0, derrors.NewInvalidArgumentError("cron " + r.name + " out of range")
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// Next returns the first time after t that matches the schedule, in the
+// location of t. Returns the zero time if there is none.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.Add(maxLookahead)
+
+	for t.Before(end) {
+		if !has(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// As in cron, if both day of month and day of week are restricted, a day
+// matching either is good.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := has(s.dom, t.Day())
+	dowMatch := has(s.dow, int(t.Weekday()))
+
+	if s.domAll || s.dowAll {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
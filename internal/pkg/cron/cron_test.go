@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cron
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("cron", func() {
+	// Friday
+	var start = time.Date(2019, time.March, 15, 10, 30, 15, 0, time.UTC)
+
+	next := func(spec string) time.Time {
+		s, derr := Parse(spec)
+		gomega.Expect(derr).To(gomega.Succeed())
+		return s.Next(start)
+	}
+
+	ginkgo.It("should schedule every minute", func() {
+		gomega.Expect(next("* * * * *")).To(gomega.Equal(time.Date(2019, time.March, 15, 10, 31, 0, 0, time.UTC)))
+	})
+
+	ginkgo.It("should schedule daily", func() {
+		gomega.Expect(next("@daily")).To(gomega.Equal(time.Date(2019, time.March, 16, 0, 0, 0, 0, time.UTC)))
+		gomega.Expect(next("30 2 * * *")).To(gomega.Equal(time.Date(2019, time.March, 16, 2, 30, 0, 0, time.UTC)))
+	})
+
+	ginkgo.It("should schedule with steps, ranges and lists", func() {
+		gomega.Expect(next("*/20 * * * *")).To(gomega.Equal(time.Date(2019, time.March, 15, 10, 40, 0, 0, time.UTC)))
+		gomega.Expect(next("0 9-17/4 * * *")).To(gomega.Equal(time.Date(2019, time.March, 15, 13, 0, 0, 0, time.UTC)))
+		gomega.Expect(next("0 8,20 * * *")).To(gomega.Equal(time.Date(2019, time.March, 15, 20, 0, 0, 0, time.UTC)))
+	})
+
+	ginkgo.It("should schedule on days of the week", func() {
+		// Sunday as 0 and as 7
+		gomega.Expect(next("0 0 * * 0")).To(gomega.Equal(time.Date(2019, time.March, 17, 0, 0, 0, 0, time.UTC)))
+		gomega.Expect(next("0 0 * * 7")).To(gomega.Equal(time.Date(2019, time.March, 17, 0, 0, 0, 0, time.UTC)))
+	})
+
+	ginkgo.It("should match either day of month or day of week", func() {
+		// The 1st or a Monday
+		gomega.Expect(next("0 0 1 * 1")).To(gomega.Equal(time.Date(2019, time.March, 18, 0, 0, 0, 0, time.UTC)))
+	})
+
+	ginkgo.It("should schedule across months and years", func() {
+		gomega.Expect(next("0 0 1 1 *")).To(gomega.Equal(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)))
+		gomega.Expect(next("0 0 29 2 *")).To(gomega.Equal(time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)))
+	})
+
+	ginkgo.It("should not find impossible schedules", func() {
+		gomega.Expect(next("0 0 30 2 *").IsZero()).To(gomega.BeTrue())
+	})
+
+	ginkgo.It("should reject invalid schedules", func() {
+		for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+			_, derr := Parse(spec)
+			gomega.Expect(derr).To(gomega.HaveOccurred(), spec)
+		}
+	})
+})
@@ -31,12 +31,79 @@ const (
 	AgentCommTimeout       = 15
 	AgentShutdownTimeout   = 60
 	AgentOpQueueLen        = 32
-	AgentOpTimeout         = 15 // Any individual operation can take at most this long
+	AgentOpTimeout         = 15 // Operations without a timeout of their own can take at most this long
+	AgentMaxConcurrentOps  = 4  // Operations for different plugins executed in parallel
+
+	// Bounds for heartbeat interval set by Edge Controller
+	AgentMinInterval = 5
+	AgentMaxInterval = 600
+	// Fraction of heartbeat interval randomly added or subtracted
+	AgentIntervalJitter = 0.1
+
+	// Queue length of operation priority lanes; the normal lane uses
+	// AgentOpQueueLen
+	AgentControlQueueLen = 8
+	AgentHighQueueLen    = 16
+	AgentLowQueueLen     = 32
+
+	// Retrying of operation responses that failed to be sent
+	AgentRetryInitialInterval = 1
+	AgentRetryMaxInterval     = 60
+	AgentRetryMultiplier      = 2.0
+	AgentRetryJitter          = 0.2
+	AgentRetryMaxAge          = 3600 // Responses older than this are dropped
+	AgentRetryBufferLen       = 256
+
+	// Recognizing operations that are sent more than once
+	AgentDedupTTL        = 86400 // Operations are forgotten after this long
+	AgentDedupMaxEntries = 1024
+
+	// Spooling of heartbeats that failed to be sent
+	AgentSpoolMaxSize     = 16 * 1024 * 1024 // Oldest heartbeats are dropped beyond this many bytes
+	AgentSpoolReplayLimit = 10               // Spooled heartbeats sent with each heartbeat
+
+	// Consecutive token rejections before agent needs to be joined again
+	AgentAuthMaxFailures = 5
+	// Maximum delay between heartbeats while agent needs to be joined again
+	AgentAuthMaxInterval = 3600
+
+	// Bandwidth budget
+	AgentBudgetPeriod        = "monthly"
+	AgentBudgetReduceAt      = 0.8  // Fraction of budget used after which metrics data is dropped
+	AgentBudgetStretchAt     = 0.9  // Fraction of budget used after which heartbeat interval is stretched
+	AgentBudgetMaxInterval   = 3600 // Longest stretched heartbeat interval
+	AgentBudgetWriteInterval = 300  // How often usage is written to disk, unless the level changes
+
+	// Consecutive heartbeat errors before a plugin is failing
+	AgentPluginFailingAfter = 3
+
+	// Edge Controller connection
+	ControllerKeepaliveTime     = 300 // Matches default minimum allowed by gRPC servers
+	ControllerKeepaliveTimeout  = 20
+	ControllerFailureThreshold  = 3 // Consecutive failures before re-establishing connection
+	ControllerRedialInterval    = 5
+	ControllerMaxRedialInterval = 300
+	ControllerCertCheckInterval = 3600 // How often to check if client certificate needs renewal
+	ControllerProbeInterval     = 300  // How often to check if preferred endpoint is back after failing over
+
+	// Environment variable with proxy password, so it's not on the
+	// command line
+	ProxyPasswordEnv = "SERVICE_NET_AGENT_PROXY_PASSWORD"
+
+	// Reconnecting the operation stream
+	AgentStreamReconnectInterval    = 5
+	AgentStreamMaxReconnectInterval = 300
 
 	// Used to generate a unique but safe agent id
 	ApplicationID = "allyourbasearebelongtonalej"
 
-	ConfigFile string = "etc" + string(os.PathSeparator) + "agent.yaml"
-	LogFile    string = "log" + string(os.PathSeparator) + "agent.log"
-	BinDir     string = "bin"
+	ConfigFile  string = "etc" + string(os.PathSeparator) + "agent.yaml"
+	LogFile     string = "log" + string(os.PathSeparator) + "agent.log"
+	BinDir      string = "bin"
+	JournalDir  string = "var" + string(os.PathSeparator) + "journal"
+	OpCacheFile string = "var" + string(os.PathSeparator) + "operations.json"
+	SpoolDir    string = "var" + string(os.PathSeparator) + "spool"
+	BudgetFile  string = "var" + string(os.PathSeparator) + "bandwidth.json"
+	ClientCert  string = "etc" + string(os.PathSeparator) + "agent.pem"
+	SecretKey   string = "etc" + string(os.PathSeparator) + "secret.key"
 )
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package ec_stub
+
+// Client certificate signing for Edge Controller stub
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Validity of signed client certificates, unless set otherwise
+const defaultCertValidity = 24 * time.Hour
+
+// Self-signed CA for client certificates, created on first use
+type certAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	err  error
+}
+
+func newCertAuthority() *certAuthority {
+	ca := &certAuthority{}
+
+	ca.key, ca.err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if ca.err != nil {
+		return ca
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ec-stub client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		ca.err = err
+		return ca
+	}
+	ca.cert, ca.err = x509.ParseCertificate(der)
+
+	return ca
+}
+
+// SignCertificate implements certsign.AgentCertificateServer
+func (h *Handler) SignCertificate(ctx context.Context, request *wrappers.BytesValue) (*wrappers.BytesValue, error) {
+	h.caOnce.Do(func() {
+		h.ca = newCertAuthority()
+	})
+	if h.ca.err != nil {
+		return nil, status.Error(codes.Internal, h.ca.err.Error())
+	}
+
+	block, _ := pem.Decode(request.GetValue())
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, status.Error(codes.InvalidArgument, "no certificate signing request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	validity := time.Duration(atomic.LoadInt64(&h.certValidity))
+	if validity == 0 {
+		validity = defaultCertValidity
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(atomic.AddUint64(&h.certsSigned, 1)) + 1),
+		Subject:      csr.Subject,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, h.ca.cert, csr.PublicKey, h.ca.key)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	log.Info().Str("subject", csr.Subject.String()).Time("expires", template.NotAfter).Msg("client certificate signed")
+	response := &wrappers.BytesValue{
+		Value: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+
+	return response, nil
+}
+
+// Set validity of signed client certificates
+func (h *Handler) SetCertificateValidity(validity time.Duration) {
+	atomic.StoreInt64(&h.certValidity, int64(validity))
+}
+
+func (h *Handler) GetNumCertificates() uint64 {
+	return atomic.LoadUint64(&h.certsSigned)
+}
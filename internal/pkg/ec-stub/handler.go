@@ -22,13 +22,25 @@ package ec_stub
 import (
 	"context"
 	"fmt"
+	"io"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/nalej/grpc-common-go"
 	"github.com/nalej/grpc-edge-controller-go"
 	"github.com/nalej/grpc-inventory-manager-go"
 
+	"github.com/nalej/service-net-agent/internal/pkg/client"
+	"github.com/nalej/service-net-agent/internal/pkg/opstream"
+
 	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type Handler struct {
@@ -36,10 +48,29 @@ type Handler struct {
 
 	checksReceived    uint64
 	callbacksReceived uint64
+
+	// Number of upcoming callbacks to reject, to test retries
+	callbackFailures uint64
+	// Number of upcoming heartbeats to reject
+	checkFailures uint64
+	// Heartbeat interval to request in seconds; none if negative
+	checkInterval int64
+
+	streamsOpened uint64
+	// Number of upcoming operation streams to reject
+	streamFailures uint64
+
+	// Signs client certificates
+	caOnce       sync.Once
+	ca           *certAuthority
+	certValidity int64
+	certsSigned  uint64
 }
 
 func NewHandler() *Handler {
-	return &Handler{}
+	return &Handler{
+		checkInterval: -1,
+	}
 }
 
 func (h *Handler) AgentJoin(ctx context.Context, request *grpc_edge_controller_go.AgentJoinRequest) (*grpc_inventory_manager_go.AgentJoinResponse, error) {
@@ -54,38 +85,102 @@ func (h *Handler) AgentJoin(ctx context.Context, request *grpc_edge_controller_g
 }
 
 func (h *Handler) AgentCheck(ctx context.Context, request *grpc_edge_controller_go.AgentCheckRequest) (*grpc_edge_controller_go.CheckResult, error) {
+	if takeFailure(&h.checkFailures) {
+		log.Info().Interface("request", request).Msg("heartbeat rejected")
+		return nil, status.Error(codes.Unavailable, "heartbeat rejected by stub")
+	}
+
 	log.Info().Interface("request", request).Msg("heartbeat received")
 	atomic.AddUint64(&h.checksReceived, 1)
+
+	interval := atomic.LoadInt64(&h.checkInterval)
+	if interval >= 0 {
+		err := grpc.SetHeader(ctx, metadata.Pairs(client.IntervalHeader, strconv.FormatInt(interval, 10)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	response := &grpc_edge_controller_go.CheckResult{
-		PendingRequests: []*grpc_inventory_manager_go.AgentOpRequest{
-			&grpc_inventory_manager_go.AgentOpRequest{
-				AssetId:     "test-asset",
-				Plugin:      "ping",
-				Operation:   "start",
-				OperationId: h.nextOpID(),
-				Params: map[string]string{
-					"test-key": "test-val",
-				},
-			},
-			&grpc_inventory_manager_go.AgentOpRequest{
-				AssetId:     "test-asset",
-				Plugin:      "ping",
-				Operation:   "ping",
-				OperationId: h.nextOpID(),
-			},
-			&grpc_inventory_manager_go.AgentOpRequest{
-				AssetId:     "test-asset",
-				Plugin:      "ping",
-				Operation:   "stop",
-				OperationId: h.nextOpID(),
-			},
-		},
+		PendingRequests: h.pendingRequests(),
 	}
 
 	return response, nil
 }
 
+// OperationStream implements opstream.AgentStreamServer. We push the same
+// operations a heartbeat gets right after the agent identifies itself,
+// then keep the stream open until the agent closes it.
+func (h *Handler) OperationStream(stream opstream.AgentStream_OperationStreamServer) error {
+	if takeFailure(&h.streamFailures) {
+		log.Info().Msg("operation stream rejected")
+		return status.Error(codes.Unavailable, "operation stream rejected by stub")
+	}
+
+	request, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	log.Info().Interface("request", request).Msg("operation stream opened")
+	atomic.AddUint64(&h.streamsOpened, 1)
+
+	// Accept the stream
+	err = stream.SendHeader(metadata.MD{})
+	if err != nil {
+		return err
+	}
+
+	for _, operation := range h.pendingRequests() {
+		err := stream.Send(operation)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			log.Info().Msg("operation stream closed")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (h *Handler) pendingRequests() []*grpc_inventory_manager_go.AgentOpRequest {
+	return []*grpc_inventory_manager_go.AgentOpRequest{
+		&grpc_inventory_manager_go.AgentOpRequest{
+			AssetId:     "test-asset",
+			Plugin:      "ping",
+			Operation:   "start",
+			OperationId: h.nextOpID(),
+			Params: map[string]string{
+				"test-key": "test-val",
+			},
+		},
+		&grpc_inventory_manager_go.AgentOpRequest{
+			AssetId:     "test-asset",
+			Plugin:      "ping",
+			Operation:   "ping",
+			OperationId: h.nextOpID(),
+		},
+		&grpc_inventory_manager_go.AgentOpRequest{
+			AssetId:     "test-asset",
+			Plugin:      "ping",
+			Operation:   "stop",
+			OperationId: h.nextOpID(),
+		},
+	}
+}
+
 func (h *Handler) CallbackAgentOperation(ctx context.Context, request *grpc_inventory_manager_go.AgentOpResponse) (*grpc_common_go.Success, error) {
+	if takeFailure(&h.callbackFailures) {
+		log.Info().Interface("request", request).Msg("operation callback rejected")
+		return nil, status.Error(codes.Unavailable, "callback rejected by stub")
+	}
+
 	log.Info().Interface("request", request).Msg("operation callback received")
 	atomic.AddUint64(&h.callbacksReceived, 1)
 	response := &grpc_common_go.Success{}
@@ -103,3 +198,48 @@ func (h *Handler) GetNumChecks() uint64 {
 func (h *Handler) GetNumCallbacks() uint64 {
 	return atomic.LoadUint64(&h.callbacksReceived)
 }
+
+func (h *Handler) GetNumStreams() uint64 {
+	return atomic.LoadUint64(&h.streamsOpened)
+}
+
+// Reject the next num callbacks as if the Edge Controller is unavailable.
+// Rejected callbacks are not counted as received.
+func (h *Handler) FailCallbacks(num uint64) {
+	atomic.StoreUint64(&h.callbackFailures, num)
+}
+
+// Reject the next num heartbeats as if the Edge Controller is unavailable.
+// Rejected heartbeats are not counted as received.
+func (h *Handler) FailChecks(num uint64) {
+	atomic.StoreUint64(&h.checkFailures, num)
+}
+
+// Request a heartbeat interval with every heartbeat response; zero requests
+// the configured interval and a negative interval stops requesting one
+func (h *Handler) RequestInterval(interval time.Duration) {
+	seconds := int64(interval / time.Second)
+	if interval < 0 {
+		seconds = -1
+	}
+	atomic.StoreInt64(&h.checkInterval, seconds)
+}
+
+// Reject the next num operation streams as if the Edge Controller doesn't
+// support them
+func (h *Handler) FailStreams(num uint64) {
+	atomic.StoreUint64(&h.streamFailures, num)
+}
+
+// Count down failures; returns true if this request should fail
+func takeFailure(failures *uint64) bool {
+	for {
+		current := atomic.LoadUint64(failures)
+		if current == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(failures, current, current-1) {
+			return true
+		}
+	}
+}
@@ -26,6 +26,9 @@ import (
 
 	"github.com/nalej/grpc-edge-controller-go"
 
+	"github.com/nalej/service-net-agent/internal/pkg/certsign"
+	"github.com/nalej/service-net-agent/internal/pkg/opstream"
+
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
@@ -36,6 +39,8 @@ func Start(grpcListener net.Listener, errChan chan<- error) (*grpc.Server, derro
 	handler := NewHandler()
 	grpcServer := grpc.NewServer()
 	grpc_edge_controller_go.RegisterAgentServer(grpcServer, handler)
+	opstream.RegisterAgentStreamServer(grpcServer, handler)
+	certsign.RegisterAgentCertificateServer(grpcServer, handler)
 
 	// Start gRPC server
 	reflection.Register(grpcServer)
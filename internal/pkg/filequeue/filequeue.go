@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Queue of entries in files on disk
+
+package filequeue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/service-net-agent/internal/pkg/atomicfile"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Queue keeps entries as separate files in a directory, named after a
+// sequence number and an extension for the kind of entry, so they can be
+// read back in the order they were added, also after a restart. Entries
+// are written atomically and synced to disk; temporary files left over
+// from a crash are cleaned up.
+type Queue struct {
+	path string
+
+	// Protects the sequence number
+	lock sync.Mutex
+	seq  uint64
+}
+
+type Entry struct {
+	// File name in the queue directory
+	Name string
+	Size int64
+}
+
+// Open the queue in path. Entries might contain sensitive information, so
+// only the agent user can read the directory.
+func Open(path string) (*Queue, derrors.Error) {
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, derrors.NewPermissionDeniedError("failed creating queue dir", err).WithParams(path)
+	}
+
+	q := &Queue{
+		path: path,
+	}
+
+	// Continue sequence after existing entries
+	entries, derr := q.Entries()
+	if derr != nil {
+		return nil, derr
+	}
+	for _, entry := range entries {
+		seq, _ := sequence(entry.Name)
+		if seq > q.seq {
+			q.seq = seq
+		}
+	}
+
+	return q, nil
+}
+
+// Entries returns the entries in the queue, in the order they were added
+func (q *Queue) Entries() ([]Entry, derrors.Error) {
+	infos, err := ioutil.ReadDir(q.path)
+	if err != nil {
+		return nil, derrors.NewInternalError("failed reading queue dir", err).WithParams(q.path)
+	}
+
+	entries := make([]Entry, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, atomicfile.TmpExt) {
+			// Never completely written
+			q.Remove(name)
+			continue
+		}
+		if _, ok := sequence(name); !ok {
+			continue
+		}
+		entries = append(entries, Entry{name, info.Size()})
+	}
+
+	// Zero-padded sequence numbers sort correctly as strings
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	return entries, nil
+}
+
+// Add an entry at the end of the queue
+func (q *Queue) Add(data []byte, ext string) (Entry, derrors.Error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.seq++
+	name := fmt.Sprintf("%020d%s", q.seq, ext)
+	derr := atomicfile.WriteFile(filepath.Join(q.path, name), data)
+	if derr != nil {
+		return Entry{}, derr
+	}
+
+	return Entry{name, int64(len(data))}, nil
+}
+
+func (q *Queue) Read(name string) ([]byte, derrors.Error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.path, name))
+	if err != nil {
+		return nil, derrors.NewInternalError("failed reading queue entry", err).WithParams(name)
+	}
+
+	return data, nil
+}
+
+// Remove an entry; failing to do so is not fatal, so only logged
+func (q *Queue) Remove(name string) {
+	err := os.Remove(filepath.Join(q.path, name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("file", name).Msg("failed removing queue entry")
+	}
+}
+
+func sequence(name string) (uint64, bool) {
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return seq, true
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package filequeue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nalej/service-net-agent/internal/pkg/atomicfile"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("filequeue", func() {
+
+	var path string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		path, err = ioutil.TempDir("", "filequeue")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(path)
+	})
+
+	ginkgo.It("should return entries in order after restart", func() {
+		q, derr := Open(path)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		first, derr := q.Add([]byte("first"), ".a")
+		gomega.Expect(derr).To(gomega.Succeed())
+		_, derr = q.Add([]byte("second"), ".b")
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		// Left over from a crash
+		gomega.Expect(ioutil.WriteFile(filepath.Join(path, "00000000000000000003.a"+atomicfile.TmpExt), []byte("partial"), 0600)).To(gomega.Succeed())
+
+		q2, derr := Open(path)
+		gomega.Expect(derr).To(gomega.Succeed())
+		entries, derr := q2.Entries()
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(entries).To(gomega.HaveLen(2))
+		gomega.Expect(entries[0]).To(gomega.Equal(first))
+		gomega.Expect(filepath.Ext(entries[1].Name)).To(gomega.Equal(".b"))
+		gomega.Expect(q2.Read(entries[1].Name)).To(gomega.Equal([]byte("second")))
+
+		// Sequence continues
+		third, derr := q2.Add([]byte("third"), ".a")
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(third.Name > entries[1].Name).To(gomega.BeTrue())
+
+		q2.Remove(first.Name)
+		entries, derr = q2.Entries()
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(entries).To(gomega.HaveLen(2))
+	})
+})
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Streaming operations from the Edge Controller to the agent. The Edge
+// Controller protocol only defines heartbeat polling; this is the
+// hand-written equivalent of generated gRPC code for the service
+//
+//   service AgentStream {
+//     rpc OperationStream(stream AgentCheckRequest) returns (stream AgentOpRequest);
+//   }
+//
+// The agent opens the stream and sends an AgentCheckRequest to identify
+// itself; the Edge Controller sends operations as soon as it has them.
+
+package opstream
+
+import (
+	"context"
+
+	"github.com/nalej/grpc-edge-controller-go"
+	"github.com/nalej/grpc-inventory-manager-go"
+
+	"google.golang.org/grpc"
+)
+
+const operationStreamMethod = "/edge_controller.AgentStream/OperationStream"
+
+type AgentStreamClient interface {
+	OperationStream(ctx context.Context, opts ...grpc.CallOption) (AgentStream_OperationStreamClient, error)
+}
+
+type agentStreamClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAgentStreamClient(cc *grpc.ClientConn) AgentStreamClient {
+	return &agentStreamClient{cc}
+}
+
+func (c *agentStreamClient) OperationStream(ctx context.Context, opts ...grpc.CallOption) (AgentStream_OperationStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &agentStreamServiceDesc.Streams[0], operationStreamMethod, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &agentStreamOperationStreamClient{stream}, nil
+}
+
+type AgentStream_OperationStreamClient interface {
+	Send(*grpc_edge_controller_go.AgentCheckRequest) error
+	Recv() (*grpc_inventory_manager_go.AgentOpRequest, error)
+	grpc.ClientStream
+}
+
+type agentStreamOperationStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentStreamOperationStreamClient) Send(m *grpc_edge_controller_go.AgentCheckRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *agentStreamOperationStreamClient) Recv() (*grpc_inventory_manager_go.AgentOpRequest, error) {
+	m := new(grpc_inventory_manager_go.AgentOpRequest)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type AgentStreamServer interface {
+	OperationStream(AgentStream_OperationStreamServer) error
+}
+
+func RegisterAgentStreamServer(s *grpc.Server, srv AgentStreamServer) {
+	s.RegisterService(&agentStreamServiceDesc, srv)
+}
+
+func agentStreamOperationStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentStreamServer).OperationStream(&agentStreamOperationStreamServer{stream})
+}
+
+type AgentStream_OperationStreamServer interface {
+	Send(*grpc_inventory_manager_go.AgentOpRequest) error
+	Recv() (*grpc_edge_controller_go.AgentCheckRequest, error)
+	grpc.ServerStream
+}
+
+type agentStreamOperationStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentStreamOperationStreamServer) Send(m *grpc_inventory_manager_go.AgentOpRequest) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *agentStreamOperationStreamServer) Recv() (*grpc_edge_controller_go.AgentCheckRequest, error) {
+	m := new(grpc_edge_controller_go.AgentCheckRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var agentStreamServiceDesc = grpc.ServiceDesc{
+	ServiceName: "edge_controller.AgentStream",
+	HandlerType: (*AgentStreamServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "OperationStream",
+			Handler:       agentStreamOperationStreamHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "opstream.go",
+}
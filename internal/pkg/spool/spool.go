@@ -0,0 +1,163 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Bounded on-disk spool
+
+package spool
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/nalej/derrors"
+
+	"github.com/nalej/service-net-agent/internal/pkg/filequeue"
+
+	"github.com/rs/zerolog/log"
+)
+
+const entryExt = ".spool"
+
+// Spool is a first-in, first-out queue of records on disk, limited in
+// total size. When a new record doesn't fit, the oldest records are
+// dropped to make room. Records are kept in a file queue.
+//
+// All methods can be called on a nil Spool, which doesn't keep anything.
+type Spool struct {
+	queue    *filequeue.Queue
+	maxBytes int64
+
+	lock sync.Mutex
+	// Records, oldest first
+	entries []filequeue.Entry
+	size    int64
+}
+
+// NewSpool opens the spool in path, picking up records that were left
+// there before. No limit on the size if maxBytes is zero.
+func NewSpool(path string, maxBytes int64) (*Spool, derrors.Error) {
+	queue, derr := filequeue.Open(path)
+	if derr != nil {
+		return nil, derr
+	}
+
+	entries, derr := queue.Entries()
+	if derr != nil {
+		return nil, derr
+	}
+
+	s := &Spool{
+		queue:    queue,
+		maxBytes: maxBytes,
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name) != entryExt {
+			continue
+		}
+		s.entries = append(s.entries, entry)
+		s.size += entry.Size
+	}
+
+	// The limit might have been lowered since
+	s.evictLocked(0)
+
+	return s, nil
+}
+
+// Push adds a record at the end of the spool
+func (s *Spool) Push(data []byte) derrors.Error {
+	if s == nil {
+		return nil
+	}
+
+	size := int64(len(data))
+	if s.maxBytes > 0 && size > s.maxBytes {
+		return derrors.NewInvalidArgumentError("record larger than spool").WithParams(size, s.maxBytes)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.evictLocked(size)
+
+	entry, derr := s.queue.Add(data, entryExt)
+	if derr != nil {
+		return derr
+	}
+
+	s.entries = append(s.entries, entry)
+	s.size += size
+
+	return nil
+}
+
+// Peek returns the oldest record, or nil if the spool is empty
+func (s *Spool) Peek() ([]byte, derrors.Error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.entries) == 0 {
+		return nil, nil
+	}
+
+	return s.queue.Read(s.entries[0].Name)
+}
+
+// Pop removes the oldest record
+func (s *Spool) Pop() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.entries) == 0 {
+		return
+	}
+	s.removeLocked()
+}
+
+// Len returns the number of records in the spool
+func (s *Spool) Len() int {
+	if s == nil {
+		return 0
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.entries)
+}
+
+// Drop the oldest records until there's room for a new record of size
+func (s *Spool) evictLocked(size int64) {
+	for s.maxBytes > 0 && len(s.entries) > 0 && s.size+size > s.maxBytes {
+		log.Warn().Str("file", s.entries[0].Name).Msg("spool full, dropping oldest record")
+		s.removeLocked()
+	}
+}
+
+func (s *Spool) removeLocked() {
+	s.queue.Remove(s.entries[0].Name)
+	s.size -= s.entries[0].Size
+	s.entries = s.entries[1:]
+}
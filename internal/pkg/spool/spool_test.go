@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package spool
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("spool", func() {
+
+	var spoolPath string
+
+	ginkgo.BeforeEach(func() {
+		var err error
+		spoolPath, err = ioutil.TempDir("", "spool")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.AfterEach(func() {
+		os.RemoveAll(spoolPath)
+	})
+
+	ginkgo.It("should return records in order", func() {
+		s, derr := NewSpool(spoolPath, 0)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		gomega.Expect(s.Push([]byte("first"))).To(gomega.Succeed())
+		gomega.Expect(s.Push([]byte("second"))).To(gomega.Succeed())
+		gomega.Expect(s.Len()).To(gomega.Equal(2))
+
+		gomega.Expect(s.Peek()).To(gomega.Equal([]byte("first")))
+		s.Pop()
+		gomega.Expect(s.Peek()).To(gomega.Equal([]byte("second")))
+		s.Pop()
+		gomega.Expect(s.Peek()).To(gomega.BeNil())
+		gomega.Expect(s.Len()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should keep records after restart", func() {
+		s, derr := NewSpool(spoolPath, 0)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(s.Push([]byte("first"))).To(gomega.Succeed())
+		gomega.Expect(s.Push([]byte("second"))).To(gomega.Succeed())
+
+		s2, derr := NewSpool(spoolPath, 0)
+		gomega.Expect(derr).To(gomega.Succeed())
+		gomega.Expect(s2.Len()).To(gomega.Equal(2))
+		gomega.Expect(s2.Peek()).To(gomega.Equal([]byte("first")))
+
+		// New records go after existing ones
+		gomega.Expect(s2.Push([]byte("third"))).To(gomega.Succeed())
+		s2.Pop()
+		s2.Pop()
+		gomega.Expect(s2.Peek()).To(gomega.Equal([]byte("third")))
+	})
+
+	ginkgo.It("should drop oldest records when full", func() {
+		s, derr := NewSpool(spoolPath, 10)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		gomega.Expect(s.Push([]byte("aaaa"))).To(gomega.Succeed())
+		gomega.Expect(s.Push([]byte("bbbb"))).To(gomega.Succeed())
+		gomega.Expect(s.Push([]byte("cccc"))).To(gomega.Succeed())
+
+		gomega.Expect(s.Len()).To(gomega.Equal(2))
+		gomega.Expect(s.Peek()).To(gomega.Equal([]byte("bbbb")))
+	})
+
+	ginkgo.It("should refuse records larger than the spool", func() {
+		s, derr := NewSpool(spoolPath, 4)
+		gomega.Expect(derr).To(gomega.Succeed())
+
+		gomega.Expect(s.Push([]byte("too large"))).ToNot(gomega.Succeed())
+		gomega.Expect(s.Len()).To(gomega.BeZero())
+	})
+
+	ginkgo.It("should ignore a nil spool", func() {
+		var s *Spool
+		gomega.Expect(s.Push([]byte("first"))).To(gomega.Succeed())
+		gomega.Expect(s.Peek()).To(gomega.BeNil())
+		s.Pop()
+		gomega.Expect(s.Len()).To(gomega.BeZero())
+	})
+})
@@ -60,6 +60,10 @@ func (i *Implementation) Run() derrors.Error {
 	signal.Notify(sigterm, syscall.SIGTERM)
 	signal.Notify(sigterm, syscall.SIGINT)
 
+	// Reload configuration on hangup
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
 	for {
 		// We loop so we wait for errChan to receive nil (or error)
 		// after calling Stop()
@@ -69,6 +73,10 @@ func (i *Implementation) Run() derrors.Error {
 			watchdogStopChan <- true
 			notifyStopping()
 			i.runner.Stop()
+		case <-sighup:
+			notifyReloading()
+			reload(i.runner)
+			notifyReady()
 		case err := <-errChan:
 			if err != nil {
 				log.Error().Err(err).Msg("service returned error")
@@ -72,7 +72,7 @@ func (i *Implementation) Run() derrors.Error {
 }
 
 func (i *Implementation) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
+	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
 	changes <- svc.Status{State: svc.StartPending}
 
 	errChan := make(chan derrors.Error, 1)
@@ -107,6 +107,10 @@ func (i *Implementation) Execute(args []string, r <-chan svc.ChangeRequest, chan
 				log.Info().Msg("Gracefully shutting down")
 				changes <- svc.Status{State: svc.StopPending}
 				i.runner.Stop()
+			case svc.ParamChange:
+				// Reload configuration
+				reload(i.runner)
+				changes <- c.CurrentStatus
 			default:
 				log.Error().Interface("request", c).Msg("unexpected control request")
 				errno = uint32(windows.ERROR_INVALID_SERVICE_CONTROL)
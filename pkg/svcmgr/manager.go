@@ -38,6 +38,14 @@ type Runner interface {
 	Alive() (bool, derrors.Error)
 }
 
+// Reloader is implemented by runners that can reload their configuration
+// while running
+type Reloader interface {
+	// Reload returns an error and keeps the running configuration if
+	// the new configuration is invalid
+	Reload() derrors.Error
+}
+
 type Manager struct {
 	Name   string
 	runner Runner
@@ -82,3 +90,18 @@ func (m *Manager) Run(asService bool) derrors.Error {
 	log.Info().Str("name", m.Name).Msg("service stopped")
 	return nil
 }
+
+// Reload the runner configuration, if supported
+func reload(runner Runner) {
+	reloader, ok := runner.(Reloader)
+	if !ok {
+		log.Warn().Msg("reloading configuration not supported")
+		return
+	}
+
+	log.Info().Msg("reloading configuration")
+	derr := reloader.Reload()
+	if derr != nil {
+		log.Error().Err(derr).Msg("failed reloading configuration")
+	}
+}
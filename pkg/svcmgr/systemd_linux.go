@@ -53,6 +53,7 @@ const (
 	nameNotifyAccess = "NotifyAccess"
 	nameRestart      = "Restart"
 	nameExecStart    = "ExecStart"
+	nameExecReload   = "ExecReload"
 	nameWantedBy     = "WantedBy"
 	nameWatchdogSec  = "WatchdogSec"
 
@@ -61,6 +62,10 @@ const (
 	valueMain      = "main"
 	valueOnFailure = "on-failure"
 	valueMultiUser = "multi-user.target"
+	valueReload    = "/bin/kill -HUP $MAINPID"
+
+	// Not defined by our version of the daemon package
+	sdNotifyReloading = "RELOADING=1"
 )
 
 // Determine the absolute path for the unit file
@@ -82,6 +87,7 @@ func createUnitFile(desc, bin string, args []string) (io.Reader, derrors.Error)
 		unit.NewUnitOption(sectionService, nameRestart, valueOnFailure),
 		unit.NewUnitOption(sectionService, nameWatchdogSec, defaultWatchdogSec),
 		unit.NewUnitOption(sectionService, nameExecStart, execCommand),
+		unit.NewUnitOption(sectionService, nameExecReload, valueReload),
 
 		unit.NewUnitOption(sectionInstall, nameWantedBy, valueMultiUser),
 	}
@@ -159,6 +165,10 @@ func notifyReady() {
 	notify(daemon.SdNotifyReady)
 }
 
+func notifyReloading() {
+	notify(sdNotifyReloading)
+}
+
 func notifyStopping() {
 	notify(daemon.SdNotifyStopping)
 }